@@ -0,0 +1,137 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package classb implements the gateway side of LoRaWAN Class B: beacon frames and ping slots.
+package classb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	// BeaconPeriod is the time between two beacons
+	BeaconPeriod = 128 * time.Second
+	// BeaconReserved is the time reserved for the beacon at the start of each beacon period
+	BeaconReserved = 2120 * time.Millisecond
+	// BeaconGuard is the time before each beacon during which no downlink can be transmitted
+	BeaconGuard = 3 * time.Second
+
+	// gpsLeapSeconds is the offset between the GPS time and UTC, since the 1st of January 2017
+	gpsLeapSeconds = 18
+
+	// infoDescGPS is the info descriptor of a GwSpecific field carrying the coordinates of the antenna
+	infoDescGPS    = 0
+	gwSpecificSize = 7
+)
+
+// gpsEpoch is the start of the GPS time scale
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// Region describes the beacon parameters of a frequency plan
+type Region struct {
+	// Frequencies of the beacon. When there are several, the beacon hops between them each beacon period.
+	Frequencies     []uint32
+	SpreadingFactor uint32
+	Bandwidth       uint32 // In Hz
+	RFU1Size        int    // Size of the RFU field before the time field
+	RFU2Size        int    // Size of the RFU field after the GwSpecific field
+}
+
+// usBeaconFrequencies are the beacon frequencies of the frequency plans with 500kHz downlink channels
+var usBeaconFrequencies = []uint32{923300000, 923900000, 924500000, 925100000, 925700000, 926300000, 926900000, 927500000}
+
+var regions = map[string]Region{
+	"EU_863_870": {Frequencies: []uint32{869525000}, SpreadingFactor: 9, Bandwidth: 125000, RFU1Size: 2},
+	"US_902_928": {Frequencies: usBeaconFrequencies, SpreadingFactor: 12, Bandwidth: 500000, RFU1Size: 5, RFU2Size: 3},
+	"AU_915_928": {Frequencies: usBeaconFrequencies, SpreadingFactor: 12, Bandwidth: 500000, RFU1Size: 5, RFU2Size: 3},
+	"AS_920_923": {Frequencies: []uint32{923400000}, SpreadingFactor: 9, Bandwidth: 125000, RFU1Size: 2},
+	"AS_923_925": {Frequencies: []uint32{923400000}, SpreadingFactor: 9, Bandwidth: 125000, RFU1Size: 2},
+	"KR_920_923": {Frequencies: []uint32{923100000}, SpreadingFactor: 9, Bandwidth: 125000, RFU1Size: 2},
+}
+
+// GetRegion returns the beacon parameters of a frequency plan
+func GetRegion(frequencyPlan string) (Region, error) {
+	if region, ok := regions[frequencyPlan]; ok {
+		return region, nil
+	}
+	return Region{}, fmt.Errorf("No Class B beacon parameters for the %s frequency plan", frequencyPlan)
+}
+
+// Frequency returns the frequency of the beacon sent at the given beacon time
+func (r Region) Frequency(beaconTime uint32) uint32 {
+	return r.Frequencies[(beaconTime/uint32(BeaconPeriod/time.Second))%uint32(len(r.Frequencies))]
+}
+
+// Beacon is a beacon frame
+type Beacon struct {
+	Time      uint32 // Seconds since the GPS epoch, modulo 2^32
+	Latitude  float64
+	Longitude float64
+}
+
+// BeaconTime returns the GPS time of a UTC time, in the format of the beacon time field
+func BeaconTime(utc time.Time) uint32 {
+	return uint32(int64(utc.Sub(gpsEpoch)/time.Second) + gpsLeapSeconds)
+}
+
+// NextBeacon returns the UTC time of the first beacon after t
+func NextBeacon(t time.Time) time.Time {
+	period := uint32(BeaconPeriod / time.Second)
+	gpsTime := BeaconTime(t)
+	next := (gpsTime/period + 1) * period
+	return t.Truncate(time.Second).Add(time.Duration(next-gpsTime) * time.Second)
+}
+
+// BeaconStart returns the UTC time of the beacon starting the beacon period of t
+func BeaconStart(t time.Time) time.Time {
+	period := uint32(BeaconPeriod / time.Second)
+	return t.Truncate(time.Second).Add(-time.Duration(BeaconTime(t)%period) * time.Second)
+}
+
+// crc16 is the CRC-16/CCITT of the beacon fields
+func crc16(data []byte) uint16 {
+	const poly = 0x1021
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// encodeCoordinate encodes a coordinate on 24 bits, scaled so that max is 2^23
+func encodeCoordinate(coordinate, max float64) uint32 {
+	value := math.Floor(coordinate / max * (1 << 23))
+	value = math.Max(math.Min(value, 1<<23-1), -(1 << 23))
+	return uint32(int32(value)) & 0xFFFFFF
+}
+
+// Frame encodes the beacon in the frame format of the region
+func (b Beacon) Frame(r Region) []byte {
+	frame := make([]byte, r.RFU1Size+4+2+gwSpecificSize+r.RFU2Size+2)
+
+	// Network common part: RFU, time and CRC
+	binary.LittleEndian.PutUint32(frame[r.RFU1Size:], b.Time)
+	crcOffset := r.RFU1Size + 4
+	binary.LittleEndian.PutUint16(frame[crcOffset:], crc16(frame[:crcOffset]))
+
+	// Gateway specific part: info descriptor, coordinates, RFU and CRC
+	gwSpecific := frame[crcOffset+2:]
+	gwSpecific[0] = infoDescGPS
+	latitude := encodeCoordinate(b.Latitude, 90)
+	longitude := encodeCoordinate(b.Longitude, 180)
+	gwSpecific[1], gwSpecific[2], gwSpecific[3] = byte(latitude), byte(latitude>>8), byte(latitude>>16)
+	gwSpecific[4], gwSpecific[5], gwSpecific[6] = byte(longitude), byte(longitude>>8), byte(longitude>>16)
+	crcOffset = len(gwSpecific) - 2
+	binary.LittleEndian.PutUint16(gwSpecific[crcOffset:], crc16(gwSpecific[:crcOffset]))
+
+	return frame
+}
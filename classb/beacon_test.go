@@ -0,0 +1,131 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package classb
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// beaconUTC returns the UTC time of a beacon time
+func beaconUTC(beaconTime uint32) time.Time {
+	return gpsEpoch.Add(time.Duration(int64(beaconTime)-gpsLeapSeconds) * time.Second)
+}
+
+func TestCRC16(t *testing.T) {
+	// Check value of CRC-16/XMODEM (polynomial 0x1021, initial value 0)
+	if crc := crc16([]byte("123456789")); crc != 0x31C3 {
+		t.Errorf("CRC is 0x%04X, expected 0x31C3", crc)
+	}
+}
+
+func TestBeaconFrame(t *testing.T) {
+	// The expected frames are encoded like the beacons of the Semtech packet forwarder
+	for _, tc := range []struct {
+		name   string
+		plan   string
+		beacon Beacon
+		frame  string
+	}{
+		{
+			name:   "EU",
+			plan:   "EU_863_870",
+			beacon: Beacon{Time: 1300000000, Latitude: 52.3730641, Longitude: 4.8928437},
+			frame:  "0000006d7c4d670d00737c4ab77a0378b7",
+		},
+		{
+			name:   "US",
+			plan:   "US_902_928",
+			beacon: Beacon{Time: 1300000128, Latitude: 37.5, Longitude: -122.34375},
+			frame:  "0000000000806d7c4d5fd0005555350000a90000001ac1",
+		},
+		{
+			name:   "Maximal coordinates",
+			plan:   "EU_863_870",
+			beacon: Beacon{Latitude: 90, Longitude: 180},
+			frame:  "000000000000000000ffff7fffff7f6fdb",
+		},
+		{
+			name:   "Minimal coordinates",
+			plan:   "EU_863_870",
+			beacon: Beacon{Latitude: -90, Longitude: -180},
+			frame:  "000000000000000000000080000080b04c",
+		},
+	} {
+		region, err := GetRegion(tc.plan)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		frame := hex.EncodeToString(tc.beacon.Frame(region))
+		if frame != tc.frame {
+			t.Errorf("%s: frame is %s, expected %s", tc.name, frame, tc.frame)
+		}
+	}
+}
+
+func TestBeaconSizes(t *testing.T) {
+	for plan, size := range map[string]int{
+		"EU_863_870": 17,
+		"US_902_928": 23,
+		"AU_915_928": 23,
+		"AS_923_925": 17,
+		"KR_920_923": 17,
+	} {
+		region, err := GetRegion(plan)
+		if err != nil {
+			t.Fatalf("%s: %v", plan, err)
+		}
+		if frame := (Beacon{}).Frame(region); len(frame) != size {
+			t.Errorf("%s: beacon of %d bytes, expected %d", plan, len(frame), size)
+		}
+	}
+	if _, err := GetRegion("EU_433"); err == nil {
+		t.Error("Expected an error for a frequency plan without beacon parameters")
+	}
+}
+
+func TestBeaconFrequency(t *testing.T) {
+	us, _ := GetRegion("US_902_928")
+	eu, _ := GetRegion("EU_863_870")
+	for _, tc := range []struct {
+		region     Region
+		beaconTime uint32
+		frequency  uint32
+	}{
+		{region: eu, beaconTime: 1300000000, frequency: 869525000},
+		{region: eu, beaconTime: 1300000128, frequency: 869525000},
+		{region: us, beaconTime: 0, frequency: 923300000},
+		{region: us, beaconTime: 1300000128, frequency: 925100000},
+		{region: us, beaconTime: 7 * 128, frequency: 927500000},
+		{region: us, beaconTime: 8 * 128, frequency: 923300000},
+	} {
+		if frequency := tc.region.Frequency(tc.beaconTime); frequency != tc.frequency {
+			t.Errorf("Beacon at %d on %d Hz, expected %d Hz", tc.beaconTime, frequency, tc.frequency)
+		}
+	}
+}
+
+func TestBeaconTiming(t *testing.T) {
+	beacon := beaconUTC(1300000000)
+	if beaconTime := BeaconTime(beacon); beaconTime != 1300000000 {
+		t.Errorf("Beacon time is %d, expected 1300000000", beaconTime)
+	}
+	for _, tc := range []struct {
+		name  string
+		t     time.Time
+		start time.Time
+		next  time.Time
+	}{
+		{name: "On the beacon", t: beacon, start: beacon, next: beacon.Add(BeaconPeriod)},
+		{name: "After the beacon", t: beacon.Add(1500 * time.Millisecond), start: beacon, next: beacon.Add(BeaconPeriod)},
+		{name: "Before the beacon", t: beacon.Add(-time.Millisecond), start: beacon.Add(-BeaconPeriod), next: beacon},
+	} {
+		if start := BeaconStart(tc.t); !start.Equal(tc.start) {
+			t.Errorf("%s: beacon period starts at %s, expected %s", tc.name, start, tc.start)
+		}
+		if next := NextBeacon(tc.t); !next.Equal(tc.next) {
+			t.Errorf("%s: next beacon at %s, expected %s", tc.name, next, tc.next)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package classb
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// SlotLength is the duration of a ping slot
+	SlotLength = 30 * time.Millisecond
+	// pingSlotsPerPeriod is the number of ping slots in the ping window of a beacon period
+	pingSlotsPerPeriod = 1 << 12
+	// maxPingNb is the highest number of ping slots a device opens per beacon period
+	maxPingNb = 128
+)
+
+// PingPeriod returns the number of slots between two ping slots of a device that opens pingNb
+// ping slots per beacon period
+func PingPeriod(pingNb int) (int, error) {
+	if pingNb < 1 || pingNb > maxPingNb || pingNb&(pingNb-1) != 0 {
+		return 0, fmt.Errorf("Invalid number of ping slots per beacon period: %d", pingNb)
+	}
+	return pingSlotsPerPeriod / pingNb, nil
+}
+
+// PingOffset returns the offset of the first ping slot of a device in the beacon period starting
+// at beaconTime, randomised with AES as specified by LoRaWAN so that devices don't collide
+func PingOffset(beaconTime uint32, devAddr uint32, pingPeriod int) int {
+	var input [aes.BlockSize]byte
+	binary.LittleEndian.PutUint32(input[0:], beaconTime)
+	binary.LittleEndian.PutUint32(input[4:], devAddr)
+
+	// The key is 16 zero bytes, so NewCipher can't fail
+	block, _ := aes.NewCipher(make([]byte, 16))
+	var rand [aes.BlockSize]byte
+	block.Encrypt(rand[:], input[:])
+	return (int(rand[0]) + int(rand[1])*256) % pingPeriod
+}
+
+// PingSlots returns the UTC times of the ping slots of a device in the beacon period starting at
+// beaconStart (UTC time of the beacon)
+func PingSlots(beaconStart time.Time, devAddr uint32, pingNb int) ([]time.Time, error) {
+	pingPeriod, err := PingPeriod(pingNb)
+	if err != nil {
+		return nil, err
+	}
+	offset := PingOffset(BeaconTime(beaconStart), devAddr, pingPeriod)
+
+	slots := make([]time.Time, 0, pingNb)
+	windowStart := beaconStart.Add(BeaconReserved)
+	for n := 0; n < pingNb; n++ {
+		slot := offset + n*pingPeriod
+		slots = append(slots, windowStart.Add(time.Duration(slot)*SlotLength))
+	}
+	return slots, nil
+}
+
+// MatchPingSlot returns the UTC time of the ping slot starting within tolerance of t, if the device
+// opens this ping slot with one of the ping slot periodicities. As the ping periods are multiples of
+// each other, a device opens the slot with one of them if it opens it with the shortest.
+func MatchPingSlot(t time.Time, devAddr uint32, tolerance time.Duration) (time.Time, bool) {
+	beaconStart := BeaconStart(t)
+	windowStart := beaconStart.Add(BeaconReserved)
+	slot := int((t.Sub(windowStart) + SlotLength/2) / SlotLength)
+	if slot < 0 || slot >= pingSlotsPerPeriod {
+		return time.Time{}, false
+	}
+	slotTime := windowStart.Add(time.Duration(slot) * SlotLength)
+	if diff := t.Sub(slotTime); diff > tolerance || diff < -tolerance {
+		return time.Time{}, false
+	}
+	shortestPeriod := pingSlotsPerPeriod / maxPingNb
+	if slot%shortestPeriod != PingOffset(BeaconTime(beaconStart), devAddr, shortestPeriod) {
+		return time.Time{}, false
+	}
+	return slotTime, true
+}
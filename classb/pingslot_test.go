@@ -0,0 +1,94 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package classb
+
+import (
+	"testing"
+	"time"
+)
+
+const testDevAddr = 0x26011BDA
+
+func TestPingPeriod(t *testing.T) {
+	for pingNb, period := range map[int]int{1: 4096, 2: 2048, 32: 128, 128: 32, 0: 0, 3: 0, 256: 0} {
+		got, err := PingPeriod(pingNb)
+		if period == 0 {
+			if err == nil {
+				t.Errorf("Expected an error for %d ping slots per beacon period", pingNb)
+			}
+			continue
+		}
+		if err != nil || got != period {
+			t.Errorf("Ping period of %d ping slots is %d (%v), expected %d", pingNb, got, err, period)
+		}
+	}
+}
+
+func TestPingOffset(t *testing.T) {
+	// The expected offsets are computed from AES-128 with a zero key, encrypting the beacon time and
+	// the device address
+	for _, tc := range []struct {
+		beaconTime uint32
+		devAddr    uint32
+		period     int
+		offset     int
+	}{
+		{beaconTime: 1300000000, devAddr: testDevAddr, period: 4096, offset: 308},
+		{beaconTime: 1300000000, devAddr: testDevAddr, period: 32, offset: 20},
+		{beaconTime: 1300000128, devAddr: testDevAddr, period: 4096, offset: 3730},
+		{beaconTime: 1300000000, devAddr: 1, period: 128, offset: 120},
+	} {
+		if offset := PingOffset(tc.beaconTime, tc.devAddr, tc.period); offset != tc.offset {
+			t.Errorf("Ping offset of %08X at %d is %d, expected %d", tc.devAddr, tc.beaconTime, offset, tc.offset)
+		}
+	}
+}
+
+func TestPingSlots(t *testing.T) {
+	beacon := beaconUTC(1300000000)
+	slots, err := PingSlots(beacon, testDevAddr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	windowStart := beacon.Add(BeaconReserved)
+	expected := []time.Time{windowStart.Add(308 * SlotLength), windowStart.Add((308 + 2048) * SlotLength)}
+	if len(slots) != len(expected) {
+		t.Fatalf("%d ping slots, expected %d", len(slots), len(expected))
+	}
+	for i := range slots {
+		if !slots[i].Equal(expected[i]) {
+			t.Errorf("Ping slot %d at %s, expected %s", i, slots[i], expected[i])
+		}
+	}
+	if _, err := PingSlots(beacon, testDevAddr, 3); err == nil {
+		t.Error("Expected an error for an invalid number of ping slots")
+	}
+}
+
+func TestMatchPingSlot(t *testing.T) {
+	beacon := beaconUTC(1300000000)
+	windowStart := beacon.Add(BeaconReserved)
+	// The device opens the slots 20 + n*32 with 128 ping slots per beacon period
+	for _, tc := range []struct {
+		name  string
+		t     time.Time
+		slot  time.Time
+		match bool
+	}{
+		{name: "Slot start", t: windowStart.Add(20 * SlotLength), slot: windowStart.Add(20 * SlotLength), match: true},
+		{name: "Slot of a lower periodicity", t: windowStart.Add(308 * SlotLength), slot: windowStart.Add(308 * SlotLength), match: true},
+		{name: "Slightly late", t: windowStart.Add(52*SlotLength + 500*time.Microsecond), slot: windowStart.Add(52 * SlotLength), match: true},
+		{name: "Slightly early", t: windowStart.Add(52*SlotLength - 500*time.Microsecond), slot: windowStart.Add(52 * SlotLength), match: true},
+		{name: "Beyond the tolerance", t: windowStart.Add(52*SlotLength + 2*time.Millisecond)},
+		{name: "Slot of another device", t: windowStart.Add(21 * SlotLength)},
+		{name: "Beacon reserved time", t: beacon.Add(time.Second)},
+		{name: "After the ping window", t: windowStart.Add(4096*SlotLength + 20*SlotLength)},
+	} {
+		slot, match := MatchPingSlot(tc.t, testDevAddr, time.Millisecond)
+		if match != tc.match {
+			t.Errorf("%s: match is %t, expected %t", tc.name, match, tc.match)
+		} else if match && !slot.Equal(tc.slot) {
+			t.Errorf("%s: ping slot at %s, expected %s", tc.name, slot, tc.slot)
+		}
+	}
+}
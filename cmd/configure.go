@@ -3,71 +3,267 @@
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/pkg/errors"
 	"github.com/segmentio/go-prompt"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
 )
 
-var configureCmd = &cobra.Command{
-	Use:   "configure [config-path]",
-	Short: "Configure Packet Forwarder",
-	Long: `packet-forwarder configure creates a YAML configuration file for the packet forwarder.
+// configureFields are the configuration fields that can be set with the configure command. Integer
+// fields are stored as integers in the configuration file.
+var configureFields = []struct {
+	name    string
+	integer bool
+	usage   string
+}{
+	{name: "id", usage: "The gateway ID"},
+	{name: "key", usage: "The gateway key"},
+	{name: "key-file", usage: "File containing the gateway key, read when the packet forwarder starts"},
+	{name: "auth-server", usage: "The account server of a private network"},
+	{name: "discovery-server", usage: "The discovery server of a private network, in a <ip:port> format"},
+	{name: "router", usage: "The router to communicate with"},
+	{name: "gps-path", usage: "The file system path to the GPS interface"},
+	{name: "gps-source", usage: "The GPS source to use instead of --gps-path, such as a gpsd daemon"},
+	{name: "reset-pin", integer: true, usage: "GPIO pin associated to the reset pin of the board"},
+}
 
-The first argument is used as the storage location to the configuration file. If nothing is specified, the default configuration file path ($HOME/.pktfwd.yml) is used.`,
+// readConfigFile returns the content of the configuration file, or an empty configuration if it doesn't exist
+func readConfigFile(path string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, errors.Wrap(err, "Invalid configuration file")
+	}
+	return values, nil
+}
 
-	Run: func(cmd *cobra.Command, args []string) {
-		ctx := util.GetLogger()
+// readJSONValues reads configuration values from a JSON object, in a file or on the standard input ("-")
+func readJSONValues(path string) (map[string]interface{}, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON configuration")
+	}
+	return values, nil
+}
 
-		ctx.Info("If you haven't registered your gateway yet, you can register it either with the console, or with `ttnctl`.")
+// configureValue converts a value given in JSON, in an environment variable or in a flag to the type
+// of the field. Empty values, and JSON nulls, are returned as "" for every field, to remove the field.
+func configureValue(value interface{}, integer bool) (interface{}, error) {
+	str := strings.TrimSpace(toString(value))
+	if !integer || str == "" {
+		return str, nil
+	}
+	return strconv.Atoi(str)
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
 
-		var (
-			gatewayAuthServer      string
-			gatewayDiscoveryServer string
-		)
+// configureEnvVariable returns the environment variable of a field, with the prefix used to read the configuration
+func configureEnvVariable(name string) string {
+	return "PKTFWD_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
 
-		if !prompt.Confirm("Is this gateway going to be used on the community network?") {
-			gatewayDiscoveryServer = prompt.StringRequired("Enter the URL of the discovery server of your private network, in a <ip:port> format:")
-			if prompt.Confirm("Are you using a private account server?") {
-				gatewayAuthServer = prompt.StringRequired("Enter the URL of the account server (example: \"https://account.thethingsnetwork.org\"")
+// providedValues returns the values given with --from-json, then overridden by the environment and the flags
+func providedValues(cmd *cobra.Command) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if jsonPath, _ := cmd.Flags().GetString("from-json"); jsonPath != "" {
+		jsonValues, err := readJSONValues(jsonPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range configureFields {
+			if value, ok := jsonValues[field.name]; ok {
+				values[field.name] = value
 			}
 		}
+	}
+	for _, field := range configureFields {
+		if value, ok := os.LookupEnv(configureEnvVariable(field.name)); ok {
+			values[field.name] = value
+		}
+		if cmd.Flags().Changed(field.name) {
+			values[field.name] = cmd.Flags().Lookup(field.name).Value.String()
+		}
+	}
 
-		gatewayID := prompt.StringRequired("Enter the ID of the gateway")
-		gatewayKey := prompt.PasswordMasked("Enter the access key of the gateway")
+	for _, field := range configureFields {
+		value, ok := values[field.name]
+		if !ok {
+			continue
+		}
+		converted, err := configureValue(value, field.integer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid value for %s", field.name)
+		}
+		values[field.name] = converted
+	}
+	return values, nil
+}
 
-		type yamlConfig struct {
-			ID              string `yaml:"id"`
-			Key             string `yaml:"key"`
-			AuthServer      string `yaml:"auth-server,omitempty"`
-			DiscoveryServer string `yaml:"discovery-server,omitempty"`
+// promptValues asks the gateway identity and servers interactively
+func promptValues() map[string]interface{} {
+	values := make(map[string]interface{})
+	if !prompt.Confirm("Is this gateway going to be used on the community network?") {
+		values["discovery-server"] = prompt.StringRequired("Enter the URL of the discovery server of your private network, in a <ip:port> format:")
+		if prompt.Confirm("Are you using a private account server?") {
+			values["auth-server"] = prompt.StringRequired("Enter the URL of the account server (example: \"https://account.thethingsnetwork.org\"")
 		}
+	}
+
+	values["id"] = prompt.StringRequired("Enter the ID of the gateway")
+	values["key"] = prompt.PasswordMasked("Enter the access key of the gateway")
+	return values
+}
+
+// keyAvailable returns true if the gateway key is set in the configuration values, or is available
+// without being stored in the configuration file
+func keyAvailable(values map[string]interface{}) bool {
+	if value, ok := values["key"]; ok && value != "" {
+		return true
+	}
+	if _, ok := os.LookupEnv(configureEnvVariable("key")); ok {
+		return true
+	}
+	return false
+}
+
+// writeConfigFile replaces the configuration file atomically. As it contains the gateway key, it
+// is only readable by its owner.
+func writeConfigFile(path string, values map[string]interface{}) error {
+	output, err := yaml.Marshal(values)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate YAML")
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".pktfwd")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(output); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+var configureCmd = &cobra.Command{
+	Use:   "configure [config-path]",
+	Short: "Configure Packet Forwarder",
+	Long: `packet-forwarder configure creates or updates the YAML configuration file of the packet forwarder.
+
+The first argument is used as the storage location to the configuration file. If nothing is specified, the default configuration file path ($HOME/.pktfwd.yml) is used.
+
+The values can be given in a JSON object with --from-json, with environment variables (PKTFWD_ID, PKTFWD_KEY, PKTFWD_AUTH_SERVER...) or with flags, in increasing order of priority. They are merged with the existing configuration file, and an empty value removes the field. If no value is given, and --non-interactive isn't set, the gateway ID, key and servers are asked interactively.`,
+
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := util.GetLogger()
 
-		newConfig := &yamlConfig{
-			ID:              gatewayID,
-			Key:             gatewayKey,
-			AuthServer:      gatewayAuthServer,
-			DiscoveryServer: gatewayDiscoveryServer,
+		path := cfgFile
+		if len(args) > 0 {
+			path = args[0]
 		}
 
-		output, err := yaml.Marshal(newConfig)
+		values, err := readConfigFile(path)
 		if err != nil {
-			util.GetLogger().WithError(err).Fatal("Failed to generate YAML")
+			ctx.WithError(err).WithField("ConfigFilePath", path).Fatal("Failed to read existing configuration file")
 		}
 
-		f, err := os.Create(cfgFile)
+		newValues, err := providedValues(cmd)
 		if err != nil {
-			util.GetLogger().WithError(err).Fatal("Failed to create file")
+			ctx.WithError(err).Fatal("Invalid configuration values")
+		}
+		nonInteractive, _ := cmd.Flags().GetBool("non-interactive")
+		if len(newValues) == 0 && !nonInteractive {
+			ctx.Info("If you haven't registered your gateway yet, you can register it either with the console, or with `ttnctl`.")
+			newValues = promptValues()
+		}
+		for name, value := range newValues {
+			if value == "" {
+				delete(values, name)
+				continue
+			}
+			values[name] = value
+		}
+
+		if value, ok := values["id"]; !ok || value == "" {
+			ctx.WithField("Field", "id").Fatal("Missing configuration value")
+		}
+		if _, ok := values["key-file"]; !ok && !keyAvailable(values) {
+			ctx.WithField("Field", "key").Fatal("Missing configuration value")
+		}
+
+		if encrypt, _ := cmd.Flags().GetBool("encrypt-key"); encrypt {
+			if key, ok := values["key"].(string); ok && key != "" && !util.IsEncryptedSecret(key) {
+				encrypted, err := util.EncryptSecret(util.Secret(key))
+				if err != nil {
+					ctx.WithError(err).Fatal("Couldn't encrypt gateway key")
+				}
+				values["key"] = encrypted
+			}
 		}
-		defer f.Close()
 
-		f.Write(output)
-		ctx.WithField("ConfigFilePath", cfgFile).Info("New configuration file saved")
+		if err := writeConfigFile(path, values); err != nil {
+			ctx.WithError(err).WithField("ConfigFilePath", path).Fatal("Failed to save configuration file")
+		}
+		ctx.WithField("ConfigFilePath", path).Info("Configuration file saved")
 	},
 }
 
 func init() {
+	// Integer fields are read as strings too, so that an empty value removes them
+	for _, field := range configureFields {
+		configureCmd.Flags().String(field.name, "", field.usage)
+	}
+	configureCmd.Flags().String("from-json", "", "Read the values from a JSON object in this file, or on the standard input with -")
+	configureCmd.Flags().Bool("encrypt-key", false, "Store the gateway key obfuscated with the world-readable machine ID (not a protection against local users)")
+	configureCmd.Flags().Bool("non-interactive", false, "Never ask the values interactively")
+
 	RootCmd.AddCommand(configureCmd)
 }
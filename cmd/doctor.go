@@ -0,0 +1,80 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/TheThingsNetwork/packet_forwarder/pktfwd"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that the gateway is ready to run the packet forwarder",
+	Long: `packet-forwarder doctor checks, step by step, the configuration file, the account server, the frequency plan, the discovery server and the router, the reset pin, the concentrator, the GPS and the system clock.
+
+The packet forwarder must not be running. A report is printed, and the command exits with a non-zero status if a check failed.`,
+
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		// Logs are written to the standard error, to keep the standard output for the report
+		ctx := util.GetLoggerTo(os.Stderr)
+
+		gpsSource := config.GetString("gps-source")
+		if gpsSource == "" {
+			gpsSource = config.GetString("gps-path")
+		}
+
+		key, err := util.LoadSecret("key")
+		if err != nil {
+			ctx.WithError(err).Fatal("Couldn't load gateway key")
+		}
+
+		results := pktfwd.RunDoctor(ctx, pktfwd.DoctorConfig{
+			ConfigFile: cfgFile,
+			TTN: pktfwd.TTNConfig{
+				ID:              config.GetString("id"),
+				Key:             key,
+				AuthServer:      config.GetString("auth-server"),
+				DiscoveryServer: config.GetString("discovery-server"),
+				Router:          config.GetString("router"),
+				Version:         config.GetString("version"),
+			},
+			ResetPin:  config.GetInt("reset-pin"),
+			GPSSource: gpsSource,
+		})
+
+		failed := false
+		for _, result := range results {
+			if result.Status == pktfwd.CheckSkipped {
+				fmt.Printf("[%s] %s: %s\n", result.Status, result.Name, result.Details)
+				continue
+			}
+			fmt.Printf("[%s] %s (%v): %s\n", result.Status, result.Name, result.Duration, result.Details)
+			failed = failed || result.Status == pktfwd.CheckFailed
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	doctorCmd.Flags().String("auth-server", "https://account.thethingsnetwork.org", "The account server the packet forwarder gets the gateway configuration from")
+	doctorCmd.Flags().String("discovery-server", "discover.thethingsnetwork.org:1900", "The discovery server the packet forwarder uses to route the packets")
+	doctorCmd.Flags().String("id", "", "The gateway ID to get its configuration from the account server")
+	doctorCmd.Flags().String("key", "", "The gateway key to authenticate itself with the back-end")
+	doctorCmd.Flags().String("key-file", "", "File containing the gateway key")
+	doctorCmd.Flags().String("router", "", "The router to communicate with (example: ttn-router-eu)")
+	doctorCmd.Flags().String("gps-path", "", "The file system path to the GPS interface, if a GPS is available (example: /dev/nmea)")
+	doctorCmd.Flags().String("gps-source", "", "The GPS source to use instead of --gps-path, such as a gpsd daemon (example: gpsd://localhost:2947)")
+	doctorCmd.Flags().Int("reset-pin", 0, "GPIO pin associated to the reset pin of the board")
+
+	RootCmd.AddCommand(doctorCmd)
+}
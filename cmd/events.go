@@ -0,0 +1,115 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/TheThingsNetwork/packet_forwarder/pktfwd"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// parseEventTime parses a time given either as RFC3339, or as a duration before now
+func parseEventTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %s (should be RFC3339, or a duration such as 24h)", value)
+	}
+	return time.Now().Add(-d), nil
+}
+
+func getEventFilter() (pktfwd.EventFilter, error) {
+	var filter pktfwd.EventFilter
+	var err error
+	if filter.Since, err = parseEventTime(config.GetString("since")); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseEventTime(config.GetString("until")); err != nil {
+		return filter, err
+	}
+	for _, value := range strings.Split(config.GetString("type"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		eventType, err := pktfwd.ParseEventType(value)
+		if err != nil {
+			return filter, err
+		}
+		filter.Types = append(filter.Types, eventType)
+	}
+	return filter, nil
+}
+
+var eventsCmd = &cobra.Command{
+	Use:   "events",
+	Short: "Show the gateway events",
+	Long: `packet-forwarder events shows the events recorded by the packet forwarder in its event journal: concentrator start and stop, boot time determination, router changes, token refreshes, GPS lock and unlock, and downlink rejections.
+
+--since and --until accept either an RFC3339 time, or a duration before now (example: 24h).`,
+
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := util.GetLoggerTo(os.Stderr)
+
+		format := config.GetString("format")
+		if format != "text" && format != "json" {
+			ctx.WithField("Format", format).Fatal("Unknown output format (should be text or json)")
+		}
+		filter, err := getEventFilter()
+		if err != nil {
+			ctx.WithError(err).Fatal("Invalid event filter")
+		}
+
+		eventsFile := util.GetEventsFile()
+		events, err := pktfwd.ReadEvents(eventsFile, filter)
+		if err != nil {
+			ctx.WithError(err).WithField("EventsFile", eventsFile).Fatal("Couldn't read event journal")
+		}
+		if limit := config.GetInt("limit"); limit > 0 && len(events) > limit {
+			events = events[len(events)-limit:]
+		}
+
+		for _, event := range events {
+			if format == "json" {
+				line, err := json.Marshal(event)
+				if err != nil {
+					ctx.WithError(err).Fatal("Couldn't marshal event")
+				}
+				fmt.Println(string(line))
+				continue
+			}
+			fmt.Println(event.String())
+		}
+	},
+}
+
+func init() {
+	var types []string
+	for _, eventType := range pktfwd.EventTypes {
+		types = append(types, string(eventType))
+	}
+
+	eventsCmd.Flags().String("events-file", "", "File in which the gateway events are recorded (default \"$HOME/.pktfwd-events.jsonl\")")
+	eventsCmd.Flags().String("since", "", "Show the events since this time")
+	eventsCmd.Flags().String("until", "", "Show the events until this time")
+	eventsCmd.Flags().String("type", "", fmt.Sprintf("Comma-separated types of the events to show (%s)", strings.Join(types, ", ")))
+	eventsCmd.Flags().Int("limit", 0, "Show only the most recent events (0: no limit)")
+	eventsCmd.Flags().String("format", "text", "Output format (text or json)")
+
+	RootCmd.AddCommand(eventsCmd)
+}
@@ -33,6 +33,16 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default \"$HOME/.pktfwd.yml\")")
+
+	RootCmd.PersistentFlags().String("log-format", "text", "Format of the logs (text, json or logfmt)")
+	RootCmd.PersistentFlags().String("log-output", "stdout", "Output of the logs (stdout, file, syslog or journald)")
+	RootCmd.PersistentFlags().String("log-file", "", "File the logs are written to, with --log-output file")
+	RootCmd.PersistentFlags().Int("log-max-size", 10, "Size in MB after which the log file is rotated (0: no limit)")
+	RootCmd.PersistentFlags().Duration("log-max-age", 0, "Age after which the log file is rotated (0: no limit)")
+	RootCmd.PersistentFlags().Int("log-max-backups", 5, "Number of rotated log files kept (0: keep all)")
+	RootCmd.PersistentFlags().String("log-levels", "", fmt.Sprintf("Log levels of components, such as \"uplink=debug,gps=warn\" (components: %s)", strings.Join(util.LogComponents, ", ")))
+	RootCmd.PersistentFlags().Int("log-rate-limit", 0, "Maximal number of identical noisy log messages per minute, such as invalid CRC warnings (0: no limit)")
+	viper.BindPFlags(RootCmd.PersistentFlags())
 }
 
 func initConfig() {
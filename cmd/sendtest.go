@@ -0,0 +1,108 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"github.com/TheThingsNetwork/packet_forwarder/pktfwd"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/ttn/api/protocol/lorawan"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var sendTestCmd = &cobra.Command{
+	Use:   "send-test",
+	Short: "Transmit test frames to validate the TX chain",
+	Long: `packet-forwarder send-test transmits a burst of LoRa or FSK test frames, through the same path as the downlinks, to validate the TX chain of the gateway without a network server.
+
+The concentrator is used exclusively during the test: the packet forwarder must not be running. With --dry-run, nothing is transmitted, and the time on air and duty cycle of the burst are printed.`,
+
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := util.GetLogger()
+
+		payload, err := pktfwd.TestPayload(config.GetString("payload"), config.GetInt("payload-size"))
+		if err != nil {
+			ctx.WithError(err).Fatal("Invalid payload")
+		}
+		count := config.GetInt("count")
+		if count < 1 {
+			ctx.WithField("Count", count).Fatal("At least one frame must be transmitted")
+		}
+
+		transmission := pktfwd.TestTransmission{
+			Frequency:          uint64(config.GetInt64("frequency")),
+			RFChain:            uint32(config.GetInt("rf-chain")),
+			DataRate:           config.GetString("datarate"),
+			CodingRate:         config.GetString("coding-rate"),
+			BitRate:            uint32(config.GetInt("bitrate")),
+			FrequencyDeviation: uint32(config.GetInt("frequency-deviation")),
+			Power:              int32(config.GetInt("power")),
+			Count:              count,
+			Interval:           config.GetDuration("interval"),
+			Payload:            payload,
+		}
+		switch modulation := config.GetString("modulation"); modulation {
+		case "lora":
+			transmission.Modulation = lorawan.Modulation_LORA
+		case "fsk":
+			transmission.Modulation = lorawan.Modulation_FSK
+		default:
+			ctx.WithField("Modulation", modulation).Fatal("Unknown modulation (should be lora or fsk)")
+		}
+		if transmission.Frequency == 0 {
+			ctx.Fatal("No frequency specified")
+		}
+
+		if config.GetBool("dry-run") {
+			if err := transmission.LogDryRun(ctx); err != nil {
+				ctx.WithError(err).Fatal("Invalid test transmission")
+			}
+			return
+		}
+
+		if pin := config.GetInt("reset-pin"); pin != 0 {
+			ctx.WithField("ResetPin", pin).Info("Reset pin specified, resetting concentrator...")
+			if err := pktfwd.ResetPin(pin); err != nil {
+				ctx.WithError(err).Fatal("Couldn't reset pin")
+			}
+		}
+
+		ttnConfig := &pktfwd.TTNConfig{
+			ID:         config.GetString("id"),
+			AuthServer: config.GetString("auth-server"),
+		}
+		conf, err := pktfwd.FetchConfig(ctx, ttnConfig)
+		if err != nil {
+			ctx.WithError(err).Fatal("Couldn't read configuration")
+		}
+		transmission.FrequencyPlan = ttnConfig.FrequencyPlan
+
+		if err := pktfwd.SendTestFrames(ctx, *conf, transmission); err != nil {
+			ctx.WithError(err).Fatal("Test transmission failed")
+		}
+	},
+}
+
+func init() {
+	sendTestCmd.Flags().String("auth-server", "https://account.thethingsnetwork.org", "The account server the packet forwarder gets the gateway configuration from")
+	sendTestCmd.Flags().String("id", "", "The gateway ID to get its configuration from the account server")
+	sendTestCmd.Flags().Int("reset-pin", 0, "GPIO pin associated to the reset pin of the board")
+	sendTestCmd.Flags().Int64("frequency", 0, "Frequency of the test frames, in Hz")
+	sendTestCmd.Flags().Int("rf-chain", 0, "RF chain transmitting the test frames")
+	sendTestCmd.Flags().String("modulation", "lora", "Modulation of the test frames (lora or fsk)")
+	sendTestCmd.Flags().String("datarate", "SF7BW125", "LoRa datarate of the test frames")
+	sendTestCmd.Flags().String("coding-rate", "4/5", "LoRa coding rate of the test frames")
+	sendTestCmd.Flags().Int("bitrate", 50000, "FSK bitrate of the test frames, in bit/s")
+	sendTestCmd.Flags().Int("frequency-deviation", 25000, "FSK frequency deviation of the test frames, in Hz")
+	sendTestCmd.Flags().Int("power", 14, "EIRP of the test frames, in dBm")
+	sendTestCmd.Flags().Int("count", 1, "Number of test frames to transmit")
+	sendTestCmd.Flags().Duration("interval", 0, "Time between the start of two test frames (at least the time on air)")
+	sendTestCmd.Flags().String("payload", "counter", "Payload pattern: zeros, counter, random, or hexadecimal bytes repeated to fill the payload")
+	sendTestCmd.Flags().Int("payload-size", 16, "Size of the payload of the test frames, in bytes")
+	sendTestCmd.Flags().Bool("dry-run", false, "Print the time on air and duty cycle of the burst without transmitting")
+
+	RootCmd.AddCommand(sendTestCmd)
+}
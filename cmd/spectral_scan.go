@@ -0,0 +1,95 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/TheThingsNetwork/packet_forwarder/pktfwd"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var spectralScanCmd = &cobra.Command{
+	Use:   "spectral-scan",
+	Short: "Measure the noise floor of the band of the frequency plan",
+	Long: `packet-forwarder spectral-scan measures the RSSI across the band of the frequency plan of the gateway, and outputs an RSSI histogram for each frequency.
+
+The concentrator is used exclusively during the scan: the packet forwarder must not be running. With --interval, the command keeps running in the foreground and repeats the scan until it is stopped.
+
+Spectral scans require an SX1301 concentrator whose FPGA supports them. They aren't supported on SX1302 and SX1303 concentrators.`,
+
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlags(cmd.Flags())
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		// Logs are written to the standard error, to keep the standard output for the scans
+		ctx := util.GetLoggerTo(os.Stderr)
+
+		format := config.GetString("format")
+		if format != "json" && format != "csv" {
+			ctx.WithField("Format", format).Fatal("Unknown output format (should be json or csv)")
+		}
+
+		var output io.Writer = os.Stdout
+		if outputFilename := config.GetString("output"); outputFilename != "" {
+			f, err := os.OpenFile(outputFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				ctx.WithError(err).WithField("File", outputFilename).Fatal("Couldn't open output file")
+			}
+			defer f.Close()
+			output = f
+		}
+
+		if pin := config.GetInt("reset-pin"); pin != 0 {
+			ctx.WithField("ResetPin", pin).Info("Reset pin specified, resetting concentrator...")
+			if err := pktfwd.ResetPin(pin); err != nil {
+				ctx.WithError(err).Fatal("Couldn't reset pin")
+			}
+		}
+
+		ttnConfig := &pktfwd.TTNConfig{
+			ID:         config.GetString("id"),
+			AuthServer: config.GetString("auth-server"),
+		}
+		conf, err := pktfwd.FetchConfig(ctx, ttnConfig)
+		if err != nil {
+			ctx.WithError(err).Fatal("Couldn't read configuration")
+		}
+
+		scanConfig := pktfwd.SpectralScanConfig{
+			Step:    uint32(config.GetInt("step")),
+			Samples: uint16(config.GetInt("samples")),
+		}
+		interval := config.GetDuration("interval")
+		for header := true; ; header = false {
+			scan, err := pktfwd.RunSpectralScan(ctx, *conf, scanConfig)
+			if err != nil {
+				ctx.WithError(err).Fatal("Spectral scan failed")
+			}
+			if err := scan.Write(output, format, header); err != nil {
+				ctx.WithError(err).Fatal("Couldn't write spectral scan")
+			}
+			if interval == 0 {
+				return
+			}
+			time.Sleep(interval)
+		}
+	},
+}
+
+func init() {
+	spectralScanCmd.Flags().String("auth-server", "https://account.thethingsnetwork.org", "The account server the packet forwarder gets the gateway configuration from")
+	spectralScanCmd.Flags().String("id", "", "The gateway ID to get its frequency plan from the account server")
+	spectralScanCmd.Flags().Int("reset-pin", 0, "GPIO pin associated to the reset pin of the board")
+	spectralScanCmd.Flags().String("format", "json", "Output format (json or csv)")
+	spectralScanCmd.Flags().String("output", "", "File to which append the scans (default: standard output)")
+	spectralScanCmd.Flags().Int("step", 200000, "Frequency step of the scan, in Hz")
+	spectralScanCmd.Flags().Int("samples", 65535, "Number of RSSI samples measured at each frequency")
+	spectralScanCmd.Flags().Duration("interval", 0, "Repeat the scan at this interval, in the foreground (default: scan once)")
+
+	RootCmd.AddCommand(spectralScanCmd)
+}
@@ -3,11 +3,15 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"runtime/trace"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/gnss"
 	"github.com/TheThingsNetwork/packet_forwarder/pktfwd"
 	"github.com/TheThingsNetwork/packet_forwarder/util"
 	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
@@ -52,9 +56,10 @@ var startCmd = &cobra.Command{
 			ctx.WithField("File", traceFilename).Info("Trace writing active for this run")
 		}
 
-		if pin := config.GetInt("reset-pin"); pin != 0 {
-			ctx.WithField("ResetPin", pin).Info("Reset pin specified, resetting concentrator...")
-			if err := pktfwd.ResetPin(pin); err != nil {
+		resetPin := config.GetInt("reset-pin")
+		if resetPin != 0 {
+			ctx.WithField("ResetPin", resetPin).Info("Reset pin specified, resetting concentrator...")
+			if err := pktfwd.ResetPin(resetPin); err != nil {
 				ctx.WithError(err).Fatal("Couldn't reset pin")
 			}
 		}
@@ -64,15 +69,100 @@ var startCmd = &cobra.Command{
 			ctx.Warn("CRC check disabled, packets with invalid CRC will be sent upstream")
 		}
 
+		locationConfig, err := getLocationConfig()
+		if err != nil {
+			ctx.WithError(err).Fatal("Invalid location configuration")
+		}
+
+		statsWindows, err := getStatsWindows()
+		if err != nil {
+			ctx.WithError(err).Fatal("Invalid traffic statistics windows")
+		}
+
+		dropPolicy, err := pktfwd.ParseDropPolicy(config.GetString("uplink-drop-policy"))
+		if err != nil {
+			ctx.WithError(err).Fatal("Invalid uplink drop policy")
+		}
+		uplinkQueueSize, uplinkBatchSize := config.GetInt("uplink-queue-size"), config.GetInt("uplink-batch-size")
+		if uplinkQueueSize < 1 || uplinkBatchSize < 1 {
+			ctx.WithFields(log.Fields{
+				"UplinkQueueSize": uplinkQueueSize,
+				"UplinkBatchSize": uplinkBatchSize,
+			}).Fatal("The uplink queue and batch sizes must be positive")
+		}
+
+		pollingConfig := pktfwd.PollingConfig{
+			MinInterval:  config.GetDuration("poll-min-interval"),
+			MaxInterval:  config.GetDuration("poll-max-interval"),
+			InterruptPin: config.GetInt("interrupt-pin"),
+		}
+		if err := pollingConfig.Validate(); err != nil {
+			ctx.WithError(err).Fatal("Invalid concentrator polling configuration")
+		}
+
+		statusInterval, healthCheckInterval := config.GetDuration("status-interval"), config.GetDuration("health-check-interval")
+		if statusInterval <= 0 || healthCheckInterval <= 0 {
+			ctx.WithFields(log.Fields{
+				"StatusInterval":      statusInterval,
+				"HealthCheckInterval": healthCheckInterval,
+			}).Fatal("Invalid status or health check interval")
+		}
+
+		watchdogConfig := pktfwd.WatchdogConfig{
+			Enabled:    config.GetBool("watchdog"),
+			Interval:   config.GetDuration("watchdog-interval"),
+			MinSilence: config.GetDuration("watchdog-min-silence"),
+		}
+		if watchdogConfig.Enabled && (watchdogConfig.Interval <= 0 || watchdogConfig.MinSilence <= 0) {
+			ctx.WithFields(log.Fields{
+				"WatchdogInterval":   watchdogConfig.Interval,
+				"WatchdogMinSilence": watchdogConfig.MinSilence,
+			}).Fatal("Invalid concentrator watchdog configuration")
+		}
+		if watchdogConfig.Enabled && config.GetInt("reset-pin") == 0 {
+			ctx.Warn("Concentrator watchdog enabled without reset pin - the concentrator will only be restarted, not reset")
+		}
+
+		key, err := util.LoadSecret("key")
+		if err != nil {
+			ctx.WithError(err).Fatal("Couldn't load gateway key")
+		}
+
 		ttnConfig := &pktfwd.TTNConfig{
 			ID:                  config.GetString("id"),
-			Key:                 config.GetString("key"),
+			Key:                 key,
 			AuthServer:          config.GetString("auth-server"),
 			DiscoveryServer:     config.GetString("discovery-server"),
 			Router:              config.GetString("router"),
 			Version:             config.GetString("version"),
+			Commit:              config.GetString("gitCommit"),
 			DownlinksSendMargin: time.Duration(config.GetInt64("downlink-send-margin")) * time.Millisecond,
 			IgnoreCRC:           ignoreCRC,
+			Location:            locationConfig,
+			SystemTimeFallback:  config.GetBool("system-time-fallback"),
+			Beacon: pktfwd.BeaconConfig{
+				Enabled: config.GetBool("beacon"),
+				Power:   int8(config.GetInt("beacon-power")),
+			},
+			StatsWindows:     statsWindows,
+			UplinkQueueSize:  uplinkQueueSize,
+			UplinkBatchSize:  uplinkBatchSize,
+			UplinkDropPolicy: dropPolicy,
+			Polling:          pollingConfig,
+			EventsFile:       util.GetEventsFile(),
+			MaxEvents:        config.GetInt("max-events"),
+			ForwardEvents:    config.GetBool("forward-events"),
+			ResetPin:         resetPin,
+			Telemetry: pktfwd.TelemetryThresholds{
+				MaxSoCTemperature:          config.GetFloat64("max-soc-temperature"),
+				MaxConcentratorTemperature: config.GetFloat64("max-concentrator-temperature"),
+				MinSupplyVoltage:           config.GetFloat64("min-supply-voltage"),
+				MinDiskFree:                uint64(config.GetInt64("min-disk-free")) * 1024 * 1024,
+			},
+			MetricsAddress:      config.GetString("metrics-address"),
+			StatusInterval:      statusInterval,
+			HealthCheckInterval: healthCheckInterval,
+			Watchdog:            watchdogConfig,
 		}
 
 		conf, err := pktfwd.FetchConfig(ctx, ttnConfig)
@@ -81,24 +171,107 @@ var startCmd = &cobra.Command{
 			return
 		}
 
-		if err = pktfwd.Run(ctx, *conf, *ttnConfig, config.GetString("gps-path")); err != nil {
+		gpsSource := config.GetString("gps-source")
+		if gpsSource == "" {
+			gpsSource = config.GetString("gps-path")
+		}
+
+		if err = pktfwd.Run(ctx, *conf, *ttnConfig, gpsSource); err != nil {
 			ctx.WithError(err).Error("The program ended following a failure")
 		}
 	},
 }
 
+func getLocationConfig() (pktfwd.LocationConfig, error) {
+	var locationConfig pktfwd.LocationConfig
+
+	priority, err := pktfwd.ParseLocationPriority(config.GetString("location-priority"))
+	if err != nil {
+		return locationConfig, err
+	}
+	locationConfig.Priority = priority
+
+	minFixQuality, err := gnss.ParseFixQuality(config.GetString("gps-min-fix-quality"))
+	if err != nil {
+		return locationConfig, err
+	}
+	locationConfig.MinFixQuality = minFixQuality
+	locationConfig.MaxHorizontalAccuracy = config.GetFloat64("gps-max-accuracy")
+
+	latitude, longitude := config.GetFloat64("latitude"), config.GetFloat64("longitude")
+	if latitude != 0 || longitude != 0 {
+		locationConfig.Static = &wrapper.GPSCoordinates{
+			Latitude:  latitude,
+			Longitude: longitude,
+			Altitude:  config.GetFloat64("altitude"),
+		}
+	}
+
+	return locationConfig, nil
+}
+
+func getStatsWindows() ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, value := range strings.Split(config.GetString("stats-windows"), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("Non-positive window %s", value)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
 func init() {
 	startCmd.PersistentFlags().String("auth-server", "https://account.thethingsnetwork.org", "The account server the packet forwarder gets the gateway configuration from")
 	startCmd.PersistentFlags().String("discovery-server", "discover.thethingsnetwork.org:1900", "The discovery server the packet forwarder uses to route the packets")
 	startCmd.PersistentFlags().String("id", "", "The gateway ID to get its configuration from the account server")
-	startCmd.PersistentFlags().String("key", "", "The gateway key to authenticate itself with the back-end")
+	startCmd.PersistentFlags().String("key", "", "The gateway key to authenticate itself with the back-end - prefer --key-file, the PKTFWD_KEY environment variable or a systemd credential, as flags are visible to other users")
+	startCmd.PersistentFlags().String("key-file", "", "File containing the gateway key")
 	startCmd.PersistentFlags().String("router", "", "The router to communicate with (example: ttn-router-eu)")
 	startCmd.PersistentFlags().String("gps-path", "", "The file system path to the GPS interface, if a GPS is available (example: /dev/nmea)")
+	startCmd.PersistentFlags().String("gps-source", "", "The GPS source to use instead of --gps-path, such as a gpsd daemon (example: gpsd://localhost:2947)")
+	startCmd.PersistentFlags().Float64("latitude", 0, "Static latitude of the antenna, overriding the location set on the account server and the GPS depending on --location-priority")
+	startCmd.PersistentFlags().Float64("longitude", 0, "Static longitude of the antenna")
+	startCmd.PersistentFlags().Float64("altitude", 0, "Static altitude of the antenna, in meters")
+	startCmd.PersistentFlags().String("location-priority", "static,gps,account-server", "The location sources of the gateway, from the most to the least preferred")
+	startCmd.PersistentFlags().String("gps-min-fix-quality", "gps", "The minimal quality of a GPS fix for its position to be used (gps, dgps, pps, float-rtk, rtk)")
+	startCmd.PersistentFlags().Float64("gps-max-accuracy", 0, "The maximal estimated horizontal error, in meters, of a GPS fix for its position to be used (0 for no limit)")
+	startCmd.PersistentFlags().Bool("beacon", false, "Transmit LoRaWAN Class B beacons, when the GPS time is locked")
+	startCmd.PersistentFlags().Int("beacon-power", 14, "The EIRP of the Class B beacons, in dBm")
 	startCmd.PersistentFlags().Int64("downlink-send-margin", getDefaultDownlinkSendMargin(), "The margin, in milliseconds, between a downlink is sent to a concentrator and it is being sent by the concentrator")
 	startCmd.PersistentFlags().String("run-trace", "", "File to which write the runtime trace of the packet forwarder. Can later be read with `go tool trace <trace_file>`.")
 	startCmd.PersistentFlags().Int("reset-pin", 0, "GPIO pin associated to the reset pin of the board")
 	startCmd.PersistentFlags().BoolP("verbose", "v", false, "Show debug logs")
 	startCmd.PersistentFlags().Bool("ignore-crc", false, "Send packets upstream even if CRC validation is incorrect")
+	startCmd.PersistentFlags().String("stats-windows", "15m,1h", "Comma-separated windows over which the per-channel and per-datarate uplink statistics are computed")
+	startCmd.PersistentFlags().Int("uplink-queue-size", 32, "Number of uplinks queued per priority (join, confirmed, unconfirmed) while waiting to be sent to the network")
+	startCmd.PersistentFlags().Int("uplink-batch-size", 8, "Maximal number of uplinks sent in a batch")
+	startCmd.PersistentFlags().String("uplink-drop-policy", string(pktfwd.DropOldest), "Uplink dropped when a queue is full (drop-oldest or drop-newest)")
+	startCmd.PersistentFlags().Duration("poll-min-interval", time.Millisecond, "Interval at which the concentrator is polled for uplinks under load")
+	startCmd.PersistentFlags().Duration("poll-max-interval", 20*time.Millisecond, "Interval up to which concentrator polling backs off when no uplink is received")
+	startCmd.PersistentFlags().Int("interrupt-pin", 0, "GPIO pin connected to the interrupt line of the concentrator, to poll the concentrator only when it receives packets")
+	startCmd.PersistentFlags().String("events-file", "", "File in which the gateway events are recorded (default \"$HOME/.pktfwd-events.jsonl\")")
+	startCmd.PersistentFlags().Int("max-events", 10000, "Number of events kept in the event journal")
+	startCmd.PersistentFlags().Bool("forward-events", false, "Forward the gateway events to the network with the status messages")
+	startCmd.PersistentFlags().Float64("max-soc-temperature", 80, "SoC temperature, in °C, above which a warning is raised (0 to disable)")
+	startCmd.PersistentFlags().Float64("max-concentrator-temperature", 85, "Concentrator temperature, in °C, above which a warning is raised (0 to disable)")
+	startCmd.PersistentFlags().Float64("min-supply-voltage", 0, "Supply voltage, in volts, below which a warning is raised (0 to disable)")
+	startCmd.PersistentFlags().Int64("min-disk-free", 50, "Free disk space, in MB, below which a warning is raised (0 to disable)")
+	startCmd.PersistentFlags().Duration("status-interval", pktfwd.DefaultStatusInterval, "Interval at which status messages are sent to the router - status messages are also sent on GPS lock changes and router changes")
+	startCmd.PersistentFlags().Duration("health-check-interval", pktfwd.DefaultHealthCheckInterval, "Interval at which the connection to the router is checked")
+	startCmd.PersistentFlags().Bool("watchdog", false, "Recover the concentrator when it stops answering or receiving packets, by resetting and restarting it")
+	startCmd.PersistentFlags().Duration("watchdog-interval", pktfwd.DefaultWatchdogInterval, "Interval at which the watchdog checks the concentrator")
+	startCmd.PersistentFlags().Duration("watchdog-min-silence", pktfwd.DefaultWatchdogMinSilence, "Minimal time without packets after which the watchdog considers the concentrator stuck - longer if the usual traffic is lower")
+	startCmd.PersistentFlags().String("metrics-address", "", "Address on which the gateway metrics are served on /metrics in the Prometheus format (example: localhost:9101)")
+	startCmd.PersistentFlags().Bool("system-time-fallback", false, "Timestamp uplinks with the system time when the GPS time is unavailable - these timestamps are not sent as GPS time")
 
 	viper.BindPFlags(startCmd.PersistentFlags())
 
@@ -0,0 +1,147 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gnss
+
+import "time"
+
+const (
+	// userEquivalentRangeError is used to estimate the horizontal accuracy from the HDOP, when the
+	// receiver doesn't report an accuracy estimate
+	userEquivalentRangeError = 5.0 // meters
+
+	// clockBiasTolerance is the margin before a full second within which a navigation epoch is
+	// considered to be aligned with the PPS pulse of that second
+	clockBiasTolerance = 10 * time.Millisecond
+)
+
+// Fix aggregates the state of the GPS from the messages it sent
+type Fix struct {
+	Time               time.Time // UTC time of the last message carrying a position
+	Valid              bool      // The position is valid
+	Latitude           float64
+	Longitude          float64
+	Altitude           float64 // Above mean sea level, in meters
+	Quality            FixQuality
+	Mode               FixMode
+	SatellitesUsed     int
+	SatellitesInView   int
+	HDOP               float64
+	HorizontalAccuracy float64 // Estimated, in meters - 0 if unknown
+	VerticalAccuracy   float64 // Estimated, in meters - 0 if unknown
+
+	// Satellites in view per talker, as GSV cycles are reported per constellation
+	inView         map[string]int
+	accuracyFromRx bool
+}
+
+// Update applies the content of a message to the fix. It returns true if the message carried a
+// valid position, which is then the position of the fix.
+func (f *Fix) Update(m Message) bool {
+	switch msg := m.(type) {
+	case *RMC:
+		if !msg.Valid {
+			f.Valid = false
+			return false
+		}
+		f.Time = msg.Time
+		f.setPosition(msg.Latitude, msg.Longitude, f.Altitude)
+		return true
+	case *GGA:
+		f.Quality = msg.Quality
+		f.SatellitesUsed = msg.Satellites
+		f.setHDOP(msg.HDOP)
+		if msg.Quality == QualityInvalid {
+			f.Valid = false
+			return false
+		}
+		f.setPosition(msg.Latitude, msg.Longitude, msg.Altitude)
+		return true
+	case *GSA:
+		f.Mode = msg.Mode
+		f.setHDOP(msg.HDOP)
+		if len(msg.PRNs) > 0 {
+			f.SatellitesUsed = len(msg.PRNs)
+		}
+	case *GSV:
+		if f.inView == nil {
+			f.inView = make(map[string]int)
+		}
+		f.inView[msg.Talker] = msg.InView
+		f.SatellitesInView = 0
+		for _, inView := range f.inView {
+			f.SatellitesInView += inView
+		}
+	case *NavPVT:
+		f.Mode = msg.Mode
+		f.Quality = msg.Quality
+		f.SatellitesUsed = msg.Satellites
+		f.HorizontalAccuracy = msg.HorizontalAccuracy
+		f.VerticalAccuracy = msg.VerticalAccuracy
+		f.accuracyFromRx = true
+		if msg.Quality == QualityInvalid {
+			f.Valid = false
+			return false
+		}
+		if msg.TimeValid {
+			f.Time = msg.Time
+		}
+		f.setPosition(msg.Latitude, msg.Longitude, msg.Altitude)
+		return true
+	}
+	return false
+}
+
+func (f *Fix) setPosition(latitude, longitude, altitude float64) {
+	f.Valid = true
+	f.Latitude = latitude
+	f.Longitude = longitude
+	f.Altitude = altitude
+}
+
+func (f *Fix) setHDOP(hdop float64) {
+	if hdop == 0 {
+		return
+	}
+	f.HDOP = hdop
+	if !f.accuracyFromRx {
+		f.HorizontalAccuracy = hdop * userEquivalentRangeError
+	}
+}
+
+// PPSTime returns the UTC time of the PPS pulse that a message refers to, if the message carries a
+// valid date and time.
+func PPSTime(m Message) (time.Time, bool) {
+	var t time.Time
+	switch msg := m.(type) {
+	case *RMC:
+		if !msg.Valid {
+			return t, false
+		}
+		t = msg.Time
+	case *ZDA:
+		t = msg.Time
+	case *NavTimeGPS:
+		if !msg.Valid {
+			return t, false
+		}
+		t = msg.Time
+	case *NavPVT:
+		if !msg.TimeValid {
+			return t, false
+		}
+		t = msg.Time
+	default:
+		return t, false
+	}
+	return ppsTime(t), true
+}
+
+// ppsTime returns the start of the second t belongs to. Because of the receiver clock bias, times
+// slightly before a full second are attributed to that second.
+func ppsTime(t time.Time) time.Time {
+	rounded := t.Round(time.Second)
+	if d := rounded.Sub(t); d > 0 && d < clockBiasTolerance {
+		return rounded
+	}
+	return t.Truncate(time.Second)
+}
@@ -0,0 +1,445 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gnss
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FixQuality is the quality indicator of a GGA sentence
+type FixQuality int
+
+// Fix quality indicators
+const (
+	QualityInvalid    FixQuality = 0
+	QualityGPS        FixQuality = 1
+	QualityDGPS       FixQuality = 2
+	QualityPPS        FixQuality = 3
+	QualityRTK        FixQuality = 4
+	QualityFloatRTK   FixQuality = 5
+	QualityEstimated  FixQuality = 6
+	QualityManual     FixQuality = 7
+	QualitySimulation FixQuality = 8
+)
+
+var fixQualityString = map[FixQuality]string{
+	QualityInvalid:    "invalid",
+	QualityGPS:        "gps",
+	QualityDGPS:       "dgps",
+	QualityPPS:        "pps",
+	QualityRTK:        "rtk",
+	QualityFloatRTK:   "float-rtk",
+	QualityEstimated:  "estimated",
+	QualityManual:     "manual",
+	QualitySimulation: "simulation",
+}
+
+func (q FixQuality) String() string {
+	if val, ok := fixQualityString[q]; ok {
+		return val
+	}
+	return fmt.Sprintf("unknown(%d)", int(q))
+}
+
+// ParseFixQuality returns the fix quality designated by its string representation
+func ParseFixQuality(s string) (FixQuality, error) {
+	for quality, str := range fixQualityString {
+		if str == s {
+			return quality, nil
+		}
+	}
+	return QualityInvalid, fmt.Errorf("Unknown fix quality %s", s)
+}
+
+// fixQualityPrecision ranks the fix qualities by the precision of the position they designate.
+// Positions that don't come from satellites rank just above invalid fixes.
+var fixQualityPrecision = map[FixQuality]int{
+	QualityInvalid:    0,
+	QualityEstimated:  1,
+	QualityManual:     1,
+	QualitySimulation: 1,
+	QualityGPS:        2,
+	QualityPPS:        3,
+	QualityDGPS:       3,
+	QualityFloatRTK:   4,
+	QualityRTK:        5,
+}
+
+// AtLeast returns true if the fix quality designates a position at least as precise as min
+func (q FixQuality) AtLeast(min FixQuality) bool {
+	return fixQualityPrecision[q] >= fixQualityPrecision[min]
+}
+
+// FixMode is the fix type of a GSA sentence
+type FixMode int
+
+// Fix modes
+const (
+	ModeUnknown FixMode = 0
+	ModeNoFix   FixMode = 1
+	Mode2D      FixMode = 2
+	Mode3D      FixMode = 3
+)
+
+var fixModeString = map[FixMode]string{
+	ModeUnknown: "unknown",
+	ModeNoFix:   "no-fix",
+	Mode2D:      "2D",
+	Mode3D:      "3D",
+}
+
+func (m FixMode) String() string {
+	if val, ok := fixModeString[m]; ok {
+		return val
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+// RMC is the recommended minimum data sentence
+type RMC struct {
+	Time      time.Time
+	Valid     bool // Status A (valid) or V (warning)
+	Latitude  float64
+	Longitude float64
+}
+
+// GGA is the fix data sentence. It carries no date, only the time of day.
+type GGA struct {
+	TimeOfDay  time.Duration
+	Latitude   float64
+	Longitude  float64
+	Quality    FixQuality
+	Satellites int
+	HDOP       float64
+	Altitude   float64 // Above mean sea level, in meters
+}
+
+// GSA is the DOP and active satellites sentence
+type GSA struct {
+	Mode FixMode
+	PRNs []int
+	PDOP float64
+	HDOP float64
+	VDOP float64
+}
+
+// SatelliteInView is a satellite described in a GSV sentence
+type SatelliteInView struct {
+	PRN       int
+	Elevation int
+	Azimuth   int
+	SNR       int // 0 when not tracked
+}
+
+// GSV is one of the sentences describing the satellites in view of a constellation
+type GSV struct {
+	Talker     string // GP for GPS, GL for GLONASS, GA for Galileo...
+	Total      int    // Number of GSV sentences in this cycle
+	Number     int    // Number of this sentence in the cycle
+	InView     int    // Number of satellites in view for this talker
+	Satellites []SatelliteInView
+}
+
+// ZDA is the time and date sentence
+type ZDA struct {
+	Time time.Time
+}
+
+// nmeaChecksum returns the XOR of the characters between `$` and `*`
+func nmeaChecksum(content []byte) byte {
+	var checksum byte
+	for _, c := range content {
+		checksum ^= c
+	}
+	return checksum
+}
+
+// splitNMEA verifies the checksum of a sentence, and returns its talker, its type and its fields
+func splitNMEA(frame []byte) (string, string, []string, error) {
+	sentence := bytes.TrimRight(frame, "\r\n")
+	star := bytes.LastIndexByte(sentence, '*')
+	if star < 0 || len(sentence)-star != 3 {
+		return "", "", nil, errors.New("NMEA sentence without checksum")
+	}
+	expected, err := strconv.ParseUint(string(sentence[star+1:]), 16, 8)
+	if err != nil {
+		return "", "", nil, errors.Wrap(err, "Invalid NMEA checksum")
+	}
+	if nmeaChecksum(sentence[1:star]) != byte(expected) {
+		return "", "", nil, errors.New("NMEA checksum mismatch")
+	}
+
+	fields := strings.Split(string(sentence[1:star]), ",")
+	address := fields[0]
+	if len(address) != 5 {
+		return "", "", nil, fmt.Errorf("Unsupported NMEA address %s", address)
+	}
+	return address[:2], address[2:], fields[1:], nil
+}
+
+func parseNMEA(frame []byte) (Message, error) {
+	talker, sentenceType, fields, err := splitNMEA(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sentenceType {
+	case "RMC":
+		return parseRMC(fields)
+	case "GGA":
+		return parseGGA(fields)
+	case "GSA":
+		return parseGSA(fields)
+	case "GSV":
+		return parseGSV(talker, fields)
+	case "ZDA":
+		return parseZDA(fields)
+	}
+	return nil, nil
+}
+
+func parseRMC(fields []string) (*RMC, error) {
+	if len(fields) < 9 {
+		return nil, errors.New("RMC sentence too short")
+	}
+	rmc := &RMC{Valid: fields[1] == "A"}
+	if !rmc.Valid {
+		return rmc, nil
+	}
+
+	timeOfDay, err := parseTimeOfDay(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	date, err := parseDate(fields[8])
+	if err != nil {
+		return nil, err
+	}
+	rmc.Time = date.Add(timeOfDay)
+
+	if rmc.Latitude, err = parseCoordinate(fields[2], fields[3], "N", "S"); err != nil {
+		return nil, err
+	}
+	if rmc.Longitude, err = parseCoordinate(fields[4], fields[5], "E", "W"); err != nil {
+		return nil, err
+	}
+	return rmc, nil
+}
+
+func parseGGA(fields []string) (*GGA, error) {
+	if len(fields) < 9 {
+		return nil, errors.New("GGA sentence too short")
+	}
+	var (
+		gga = &GGA{}
+		err error
+	)
+	quality, err := parseInt(fields[5])
+	if err != nil {
+		return nil, err
+	}
+	gga.Quality = FixQuality(quality)
+	if gga.Satellites, err = parseInt(fields[6]); err != nil {
+		return nil, err
+	}
+	if gga.HDOP, err = parseFloat(fields[7]); err != nil {
+		return nil, err
+	}
+	if fields[0] != "" {
+		if gga.TimeOfDay, err = parseTimeOfDay(fields[0]); err != nil {
+			return nil, err
+		}
+	}
+	if gga.Quality == QualityInvalid {
+		return gga, nil
+	}
+
+	if gga.Latitude, err = parseCoordinate(fields[1], fields[2], "N", "S"); err != nil {
+		return nil, err
+	}
+	if gga.Longitude, err = parseCoordinate(fields[3], fields[4], "E", "W"); err != nil {
+		return nil, err
+	}
+	if gga.Altitude, err = parseFloat(fields[8]); err != nil {
+		return nil, err
+	}
+	return gga, nil
+}
+
+func parseGSA(fields []string) (*GSA, error) {
+	if len(fields) < 17 {
+		return nil, errors.New("GSA sentence too short")
+	}
+	mode, err := parseInt(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	gsa := &GSA{Mode: FixMode(mode)}
+	for _, field := range fields[2:14] {
+		if field == "" {
+			continue
+		}
+		prn, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid satellite PRN")
+		}
+		gsa.PRNs = append(gsa.PRNs, prn)
+	}
+	if gsa.PDOP, err = parseFloat(fields[14]); err != nil {
+		return nil, err
+	}
+	if gsa.HDOP, err = parseFloat(fields[15]); err != nil {
+		return nil, err
+	}
+	if gsa.VDOP, err = parseFloat(fields[16]); err != nil {
+		return nil, err
+	}
+	return gsa, nil
+}
+
+func parseGSV(talker string, fields []string) (*GSV, error) {
+	if len(fields) < 3 {
+		return nil, errors.New("GSV sentence too short")
+	}
+	var (
+		gsv = &GSV{Talker: talker}
+		err error
+	)
+	if gsv.Total, err = parseInt(fields[0]); err != nil {
+		return nil, err
+	}
+	if gsv.Number, err = parseInt(fields[1]); err != nil {
+		return nil, err
+	}
+	if gsv.InView, err = parseInt(fields[2]); err != nil {
+		return nil, err
+	}
+	// Satellites are described by groups of 4 fields, optionally followed by a signal ID (NMEA 4.1)
+	for i := 3; i+4 <= len(fields); i += 4 {
+		var satellite SatelliteInView
+		if satellite.PRN, err = parseInt(fields[i]); err != nil {
+			return nil, err
+		}
+		if satellite.Elevation, err = parseInt(fields[i+1]); err != nil {
+			return nil, err
+		}
+		if satellite.Azimuth, err = parseInt(fields[i+2]); err != nil {
+			return nil, err
+		}
+		if satellite.SNR, err = parseInt(fields[i+3]); err != nil {
+			return nil, err
+		}
+		gsv.Satellites = append(gsv.Satellites, satellite)
+	}
+	return gsv, nil
+}
+
+func parseZDA(fields []string) (*ZDA, error) {
+	if len(fields) < 4 {
+		return nil, errors.New("ZDA sentence too short")
+	}
+	timeOfDay, err := parseTimeOfDay(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	day, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid ZDA day")
+	}
+	month, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid ZDA month")
+	}
+	year, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid ZDA year")
+	}
+	return &ZDA{
+		Time: time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Add(timeOfDay),
+	}, nil
+}
+
+// parseTimeOfDay parses a hhmmss.ss field
+func parseTimeOfDay(field string) (time.Duration, error) {
+	if len(field) < 6 {
+		return 0, fmt.Errorf("Invalid NMEA time %s", field)
+	}
+	hours, errH := strconv.Atoi(field[0:2])
+	minutes, errM := strconv.Atoi(field[2:4])
+	seconds, errS := strconv.ParseFloat(field[4:], 64)
+	if errH != nil || errM != nil || errS != nil {
+		return 0, fmt.Errorf("Invalid NMEA time %s", field)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), nil
+}
+
+// parseDate parses a ddmmyy field
+func parseDate(field string) (time.Time, error) {
+	if len(field) != 6 {
+		return time.Time{}, fmt.Errorf("Invalid NMEA date %s", field)
+	}
+	day, errD := strconv.Atoi(field[0:2])
+	month, errM := strconv.Atoi(field[2:4])
+	year, errY := strconv.Atoi(field[4:6])
+	if errD != nil || errM != nil || errY != nil {
+		return time.Time{}, fmt.Errorf("Invalid NMEA date %s", field)
+	}
+	return time.Date(2000+year, time.Month(month), day, 0, 0, 0, 0, time.UTC), nil
+}
+
+// parseCoordinate parses a (d)ddmm.mmmm field and its hemisphere into decimal degrees
+func parseCoordinate(field, hemisphere, positive, negative string) (float64, error) {
+	dot := strings.IndexByte(field, '.')
+	if dot < 0 {
+		dot = len(field)
+	}
+	if dot < 3 {
+		return 0, fmt.Errorf("Invalid NMEA coordinate %s", field)
+	}
+	degrees, err := strconv.ParseFloat(field[:dot-2], 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid NMEA coordinate")
+	}
+	minutes, err := strconv.ParseFloat(field[dot-2:], 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid NMEA coordinate")
+	}
+	coordinate := degrees + minutes/60
+	switch hemisphere {
+	case positive:
+		return coordinate, nil
+	case negative:
+		return -coordinate, nil
+	}
+	return 0, fmt.Errorf("Invalid NMEA hemisphere %s", hemisphere)
+}
+
+// parseInt parses an integer field, empty fields being 0
+func parseInt(field string) (int, error) {
+	if field == "" {
+		return 0, nil
+	}
+	val, err := strconv.Atoi(field)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid NMEA integer field")
+	}
+	return val, nil
+}
+
+// parseFloat parses a decimal field, empty fields being 0
+func parseFloat(field string) (float64, error) {
+	if field == "" {
+		return 0, nil
+	}
+	val, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid NMEA decimal field")
+	}
+	return val, nil
+}
@@ -0,0 +1,185 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gnss
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// roundCoordinates rounds the coordinates of the position messages to 1e-6 degrees, so that they
+// can be compared with the expected values
+func roundCoordinates(m Message) Message {
+	round := func(f float64) float64 { return math.Floor(f*1e6+0.5) / 1e6 }
+	switch msg := m.(type) {
+	case *RMC:
+		rounded := *msg
+		rounded.Latitude, rounded.Longitude = round(msg.Latitude), round(msg.Longitude)
+		return &rounded
+	case *GGA:
+		rounded := *msg
+		rounded.Latitude, rounded.Longitude = round(msg.Latitude), round(msg.Longitude)
+		return &rounded
+	}
+	return m
+}
+
+func TestParseNMEA(t *testing.T) {
+	for _, tc := range []struct {
+		sentence string
+		expected Message
+		err      bool
+	}{
+		{
+			sentence: "$GPRMC,123519.00,A,4807.038,N,01131.000,E,022.4,084.4,230317,003.1,W*4F\r\n",
+			expected: &RMC{
+				Time:      time.Date(2017, 3, 23, 12, 35, 19, 0, time.UTC),
+				Valid:     true,
+				Latitude:  48.1173,
+				Longitude: 11.516667,
+			},
+		},
+		{
+			sentence: "$GNRMC,140212.00,V,,,,,,,200317,,,N*60\r\n",
+			expected: &RMC{Valid: false},
+		},
+		{
+			sentence: "$GPGGA,123519.00,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*69\r\n",
+			expected: &GGA{
+				TimeOfDay:  12*time.Hour + 35*time.Minute + 19*time.Second,
+				Latitude:   48.1173,
+				Longitude:  11.516667,
+				Quality:    QualityGPS,
+				Satellites: 8,
+				HDOP:       0.9,
+				Altitude:   545.4,
+			},
+		},
+		{
+			sentence: "$GNGGA,140212.00,5222.38385,N,00453.53706,E,2,12,0.94,4.3,M,46.0,M,,0000*49\r\n",
+			expected: &GGA{
+				TimeOfDay:  14*time.Hour + 2*time.Minute + 12*time.Second,
+				Latitude:   52.373064,
+				Longitude:  4.892284,
+				Quality:    QualityDGPS,
+				Satellites: 12,
+				HDOP:       0.94,
+				Altitude:   4.3,
+			},
+		},
+		{
+			// Receiver without fix
+			sentence: "$GPGGA,,,,,,0,00,99.99,,,,,,*48\r\n",
+			expected: &GGA{Quality: QualityInvalid, HDOP: 99.99},
+		},
+		{
+			sentence: "$GNGSA,A,3,02,06,12,19,24,25,,,,,,,1.62,0.94,1.32*1A\r\n",
+			expected: &GSA{Mode: Mode3D, PRNs: []int{2, 6, 12, 19, 24, 25}, PDOP: 1.62, HDOP: 0.94, VDOP: 1.32},
+		},
+		{
+			sentence: "$GPGSV,3,1,11,02,41,296,35,06,60,223,41,12,12,042,,19,33,128,29*7F\r\n",
+			expected: &GSV{Talker: "GP", Total: 3, Number: 1, InView: 11, Satellites: []SatelliteInView{
+				{PRN: 2, Elevation: 41, Azimuth: 296, SNR: 35},
+				{PRN: 6, Elevation: 60, Azimuth: 223, SNR: 41},
+				{PRN: 12, Elevation: 12, Azimuth: 42},
+				{PRN: 19, Elevation: 33, Azimuth: 128, SNR: 29},
+			}},
+		},
+		{
+			sentence: "$GLGSV,1,1,02,65,45,110,30,72,20,300,*62\r\n",
+			expected: &GSV{Talker: "GL", Total: 1, Number: 1, InView: 2, Satellites: []SatelliteInView{
+				{PRN: 65, Elevation: 45, Azimuth: 110, SNR: 30},
+				{PRN: 72, Elevation: 20, Azimuth: 300},
+			}},
+		},
+		{
+			sentence: "$GPZDA,140212.00,20,03,2017,00,00*67\r\n",
+			expected: &ZDA{Time: time.Date(2017, 3, 20, 14, 2, 12, 0, time.UTC)},
+		},
+		{
+			// Unsupported sentence
+			sentence: "$GPTXT,01,01,02,ANTSTATUS=OK*3B\r\n",
+		},
+		{sentence: "$GPZDA,140212.00,20,03,2017,00,00*68\r\n", err: true},
+		{sentence: "$GPZDA,140212.00,20,03,2017,00,00\r\n", err: true},
+		{sentence: "$GPZDA,140212.00,20*60\r\n", err: true},
+	} {
+		msg, err := parseNMEA([]byte(tc.sentence))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error parsing %q", tc.sentence)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Couldn't parse %q: %v", tc.sentence, err)
+			continue
+		}
+		if msg == nil && tc.expected == nil {
+			continue
+		}
+		if got := roundCoordinates(msg); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Parsing %q returned %+v, expected %+v", tc.sentence, got, tc.expected)
+		}
+	}
+}
+
+func TestParseCoordinate(t *testing.T) {
+	for _, tc := range []struct {
+		field      string
+		hemisphere string
+		expected   float64
+		err        bool
+	}{
+		{field: "4807.038", hemisphere: "N", expected: 48.1173},
+		{field: "4807.038", hemisphere: "S", expected: -48.1173},
+		{field: "01131.000", hemisphere: "W", expected: -11.516667},
+		{field: "0000.000", hemisphere: "E", expected: 0},
+		{field: "07.038", hemisphere: "N", err: true},
+		{field: "4807.038", hemisphere: "X", err: true},
+		{field: "48O7.038", hemisphere: "N", err: true},
+	} {
+		coordinate, err := parseCoordinate(tc.field, tc.hemisphere, "N", "S")
+		if tc.hemisphere == "E" || tc.hemisphere == "W" {
+			coordinate, err = parseCoordinate(tc.field, tc.hemisphere, "E", "W")
+		}
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error parsing %s %s", tc.field, tc.hemisphere)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Couldn't parse %s %s: %v", tc.field, tc.hemisphere, err)
+		} else if math.Abs(coordinate-tc.expected) > 1e-6 {
+			t.Errorf("Parsing %s %s returned %f, expected %f", tc.field, tc.hemisphere, coordinate, tc.expected)
+		}
+	}
+}
+
+func TestFixQuality(t *testing.T) {
+	for _, tc := range []struct {
+		quality FixQuality
+		min     FixQuality
+		atLeast bool
+	}{
+		{quality: QualityRTK, min: QualityDGPS, atLeast: true},
+		{quality: QualityDGPS, min: QualityPPS, atLeast: true},
+		{quality: QualityGPS, min: QualityDGPS, atLeast: false},
+		{quality: QualityEstimated, min: QualityGPS, atLeast: false},
+		{quality: QualityGPS, min: QualityInvalid, atLeast: true},
+	} {
+		if atLeast := tc.quality.AtLeast(tc.min); atLeast != tc.atLeast {
+			t.Errorf("%s.AtLeast(%s) = %t, expected %t", tc.quality, tc.min, atLeast, tc.atLeast)
+		}
+		parsed, err := ParseFixQuality(tc.quality.String())
+		if err != nil || parsed != tc.quality {
+			t.Errorf("ParseFixQuality(%q) = %s, %v", tc.quality.String(), parsed, err)
+		}
+	}
+	if _, err := ParseFixQuality("unknown"); err == nil {
+		t.Error("Expected an error parsing an unknown fix quality")
+	}
+}
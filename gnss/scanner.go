@@ -0,0 +1,143 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package gnss parses the data stream of a GPS receiver: NMEA sentences (RMC, GGA, GSA, GSV, ZDA)
+// and u-blox UBX frames (NAV-TIMEGPS, NAV-PVT), and aggregates them in a Fix.
+package gnss
+
+import (
+	"bytes"
+	"io"
+)
+
+const (
+	nmeaStart      = '$'
+	ubxSync1       = 0xB5
+	ubxSync2       = 0x62
+	ubxHeaderSize  = 6 // Sync chars, class, ID and length
+	ubxTrailerSize = 2 // Checksum
+
+	// maxNMEALength is larger than the 82 characters of the standard, as some receivers exceed it
+	maxNMEALength = 128
+	maxUBXLength  = 1024
+	readChunkSize = 128
+)
+
+// Message is a message received from the GPS: *RMC, *GGA, *GSA, *GSV, *ZDA, *NavTimeGPS or *NavPVT
+type Message interface{}
+
+// Scanner frames the data stream of a GPS receiver into messages. Frames split across reads are
+// reassembled, and invalid frames (bad checksum, garbage between frames) and unsupported messages
+// are skipped.
+type Scanner struct {
+	r     io.Reader
+	buf   []byte
+	chunk []byte
+	msg   Message
+	err   error
+}
+
+// NewScanner returns a scanner reading from r
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		r:     r,
+		buf:   make([]byte, 0, 2*maxUBXLength),
+		chunk: make([]byte, readChunkSize),
+	}
+}
+
+// Scan advances to the next message, available through Message. It returns false when the underlying
+// reader returns an error, which is then available through Err (nil for io.EOF). Incomplete frames
+// are kept, so that Scan can be called again once the reader has more data to deliver - which is the
+// case of serial interfaces.
+func (s *Scanner) Scan() bool {
+	s.msg = nil
+	s.err = nil
+	for {
+		for {
+			frame, consumed := nextFrame(s.buf)
+			if frame != nil {
+				msg, err := decodeFrame(frame)
+				s.buf = append(s.buf[:0], s.buf[consumed:]...)
+				if err == nil && msg != nil {
+					s.msg = msg
+					return true
+				}
+				continue
+			}
+			if consumed > 0 {
+				s.buf = append(s.buf[:0], s.buf[consumed:]...)
+				continue
+			}
+			break
+		}
+
+		n, err := s.r.Read(s.chunk)
+		s.buf = append(s.buf, s.chunk[:n]...)
+		if err != nil {
+			if n > 0 {
+				// Process what has been read first, the error will be returned by the next read
+				continue
+			}
+			if err != io.EOF {
+				s.err = err
+			}
+			return false
+		}
+	}
+}
+
+// Message returns the message found by the last call to Scan
+func (s *Scanner) Message() Message {
+	return s.msg
+}
+
+// Err returns the read error that stopped the last call to Scan, if it wasn't io.EOF
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// nextFrame looks for the first complete frame in buf. If one is found, it returns it along with
+// the number of bytes to consume up to the end of the frame. Otherwise, it returns the number of
+// bytes that can be dropped, as they can't be part of a frame.
+func nextFrame(buf []byte) ([]byte, int) {
+	for start := 0; start < len(buf); start++ {
+		switch buf[start] {
+		case nmeaStart:
+			end := bytes.IndexByte(buf[start:], '\n')
+			if end < 0 {
+				if len(buf)-start > maxNMEALength {
+					continue
+				}
+				return nil, start
+			}
+			if end > maxNMEALength {
+				continue
+			}
+			return buf[start : start+end+1], start + end + 1
+		case ubxSync1:
+			if len(buf)-start < ubxHeaderSize {
+				return nil, start
+			}
+			if buf[start+1] != ubxSync2 {
+				continue
+			}
+			length := int(buf[start+4]) | int(buf[start+5])<<8
+			if length > maxUBXLength {
+				continue
+			}
+			end := start + ubxHeaderSize + length + ubxTrailerSize
+			if len(buf) < end {
+				return nil, start
+			}
+			return buf[start:end], end
+		}
+	}
+	return nil, len(buf)
+}
+
+func decodeFrame(frame []byte) (Message, error) {
+	if frame[0] == nmeaStart {
+		return parseNMEA(frame)
+	}
+	return parseUBX(frame)
+}
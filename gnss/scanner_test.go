@@ -0,0 +1,162 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gnss
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// recordedStream returns the data stream of a u-blox receiver outputting NMEA sentences and UBX
+// frames, starting in the middle of a sentence and with noise on the line
+func recordedStream(t *testing.T) []byte {
+	var stream bytes.Buffer
+	stream.WriteString("0.94,4.3,M,46.0,M,,0000*49\r\n")
+	stream.WriteString("$GNRMC,140212.00,V,,,,,,,200317,,,N*60\r\n")
+	stream.Write(decodeHex(t, navTimeGPSFrame))
+	stream.WriteString("$GPTXT,01,01,02,ANTSTATUS=OK*3B\r\n")
+	stream.Write([]byte{0x00, 0xB5, 0x13, 0xFF})
+	stream.WriteString("$GNGGA,140212.00,5222.38385,N,00453.53706,E,2,12,0.94,4.3,M,46.0,M,,0000*49\r\n")
+	stream.WriteString("$GNGSA,A,3,02,06,12,19,24,25,,,,,,,1.62,0.94,1.32*1B\r\n") // Corrupted
+	stream.Write(decodeHex(t, cfgFrame))
+	stream.Write(decodeHex(t, navPVTFrame))
+	stream.WriteString("$GPGSV,3,1,11,02,41,296,35,06,60,223,41,12,12,042,,19,33,128,29*7F\r\n")
+	stream.WriteString("$GLGSV,1,1,02,65,45,110,30,72,20,300,*62\r\n")
+	stream.WriteString("$GPZDA,140212.00,20,03,2017,00,00*67\r\n")
+	return stream.Bytes()
+}
+
+var recordedMessageTypes = []string{"*gnss.RMC", "*gnss.NavTimeGPS", "*gnss.GGA", "*gnss.NavPVT", "*gnss.GSV", "*gnss.GSV", "*gnss.ZDA"}
+
+func scanAll(t *testing.T, r io.Reader) []Message {
+	scanner := NewScanner(r)
+	var messages []Message
+	for scanner.Scan() {
+		messages = append(messages, scanner.Message())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Unexpected scanner error: %v", err)
+	}
+	return messages
+}
+
+func messageTypes(messages []Message) []string {
+	types := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		types = append(types, reflect.TypeOf(msg).String())
+	}
+	return types
+}
+
+func TestScanner(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reader func(stream []byte) io.Reader
+	}{
+		{name: "Whole stream", reader: func(stream []byte) io.Reader { return bytes.NewReader(stream) }},
+		{name: "One byte per read", reader: func(stream []byte) io.Reader { return iotest.OneByteReader(bytes.NewReader(stream)) }},
+		{name: "Half chunks", reader: func(stream []byte) io.Reader { return iotest.HalfReader(bytes.NewReader(stream)) }},
+		{name: "Data with EOF", reader: func(stream []byte) io.Reader { return iotest.DataErrReader(bytes.NewReader(stream)) }},
+	} {
+		messages := scanAll(t, tc.reader(recordedStream(t)))
+		if types := messageTypes(messages); !reflect.DeepEqual(types, recordedMessageTypes) {
+			t.Errorf("%s: scanned %v, expected %v", tc.name, types, recordedMessageTypes)
+		}
+	}
+}
+
+// serialReader delivers the chunks of data one read at a time, returning io.EOF between them, as a
+// serial interface without data available for now
+type serialReader struct {
+	chunks [][]byte
+	eof    bool
+}
+
+func (r *serialReader) Read(p []byte) (int, error) {
+	if r.eof || len(r.chunks) == 0 {
+		r.eof = false
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+		r.eof = true
+	}
+	return n, nil
+}
+
+func TestScannerResumes(t *testing.T) {
+	stream := recordedStream(t)
+	// Frames split across the reads are reassembled once the rest of the data is available
+	reader := &serialReader{chunks: [][]byte{stream[:50], stream[50:70], stream[70:200], stream[200:]}}
+	scanner := NewScanner(reader)
+	var messages []Message
+	for attempts := 0; attempts < 10; attempts++ {
+		for scanner.Scan() {
+			messages = append(messages, scanner.Message())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("Unexpected scanner error: %v", err)
+		}
+	}
+	if types := messageTypes(messages); !reflect.DeepEqual(types, recordedMessageTypes) {
+		t.Errorf("Scanned %v, expected %v", types, recordedMessageTypes)
+	}
+}
+
+func TestScannerError(t *testing.T) {
+	readErr := errors.New("Interface closed")
+	// The messages read before the error are returned first
+	scanner := NewScanner(io.MultiReader(bytes.NewReader(recordedStream(t)), &errReader{err: readErr}))
+	var messages []Message
+	for scanner.Scan() {
+		messages = append(messages, scanner.Message())
+	}
+	if len(messages) != len(recordedMessageTypes) {
+		t.Errorf("Scanned %d messages before the error, expected %d", len(messages), len(recordedMessageTypes))
+	}
+	if scanner.Err() != readErr {
+		t.Errorf("Scanner error is %v, expected %v", scanner.Err(), readErr)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestFixUpdate(t *testing.T) {
+	var fix Fix
+	var positions int
+	for _, msg := range scanAll(t, bytes.NewReader(recordedStream(t))) {
+		if fix.Update(msg) {
+			positions++
+		}
+	}
+	if positions != 2 {
+		t.Errorf("%d messages updated the position, expected 2", positions)
+	}
+	if !fix.Valid || fix.Mode != Mode3D || fix.Quality != QualityDGPS {
+		t.Errorf("Expected a valid 3D DGPS fix, got %+v", fix)
+	}
+	if fix.SatellitesUsed != 11 || fix.SatellitesInView != 13 {
+		t.Errorf("Expected 11 satellites used and 13 in view, got %d and %d", fix.SatellitesUsed, fix.SatellitesInView)
+	}
+	// The accuracy estimated by the receiver is kept over the one derived from the HDOP
+	if fix.HDOP != 0.94 || fix.HorizontalAccuracy != 2.521 || fix.VerticalAccuracy != 8.74 {
+		t.Errorf("Unexpected HDOP and accuracy %f, %f, %f", fix.HDOP, fix.HorizontalAccuracy, fix.VerticalAccuracy)
+	}
+
+	fix.Update(&RMC{Valid: false})
+	if fix.Valid {
+		t.Error("Expected an invalid RMC sentence to invalidate the fix")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gnss
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ubxClassNAV      = 0x01
+	ubxIDNavPVT      = 0x07
+	ubxIDNavTimeGPS  = 0x20
+	navPVTMinLength  = 84 // u-blox 7 - later generations append fields
+	navTimeGPSLength = 16
+)
+
+// gpsEpoch is the start of the GPS time scale
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+// NavTimeGPS is a UBX-NAV-TIMEGPS message
+type NavTimeGPS struct {
+	Time     time.Time     // UTC time of the navigation epoch
+	Valid    bool          // Time of week, week number and leap seconds are valid
+	Accuracy time.Duration // Time accuracy estimate
+}
+
+// NavPVT is a UBX-NAV-PVT message
+type NavPVT struct {
+	Time               time.Time // UTC time of the navigation epoch
+	TimeValid          bool      // Date and time are valid, and fully resolved
+	Mode               FixMode
+	Quality            FixQuality
+	Satellites         int
+	Latitude           float64
+	Longitude          float64
+	Altitude           float64 // Above mean sea level, in meters
+	HorizontalAccuracy float64 // In meters
+	VerticalAccuracy   float64 // In meters
+	PDOP               float64
+}
+
+// ubxChecksum computes the 8-bit Fletcher checksum of the class, ID, length and payload of a frame
+func ubxChecksum(content []byte) (byte, byte) {
+	var a, b byte
+	for _, c := range content {
+		a += c
+		b += a
+	}
+	return a, b
+}
+
+func parseUBX(frame []byte) (Message, error) {
+	content := frame[2 : len(frame)-ubxTrailerSize]
+	ckA, ckB := ubxChecksum(content)
+	if ckA != frame[len(frame)-2] || ckB != frame[len(frame)-1] {
+		return nil, errors.New("UBX checksum mismatch")
+	}
+
+	class, id, payload := content[0], content[1], content[4:]
+	if class != ubxClassNAV {
+		return nil, nil
+	}
+	switch id {
+	case ubxIDNavTimeGPS:
+		return parseNavTimeGPS(payload)
+	case ubxIDNavPVT:
+		return parseNavPVT(payload)
+	}
+	return nil, nil
+}
+
+func parseNavTimeGPS(payload []byte) (*NavTimeGPS, error) {
+	if len(payload) != navTimeGPSLength {
+		return nil, errors.New("Invalid UBX-NAV-TIMEGPS length")
+	}
+	var (
+		iTOW     = binary.LittleEndian.Uint32(payload[0:4])
+		fTOW     = int32(binary.LittleEndian.Uint32(payload[4:8]))
+		week     = int16(binary.LittleEndian.Uint16(payload[8:10]))
+		leapS    = int8(payload[10])
+		valid    = payload[11]
+		accuracy = binary.LittleEndian.Uint32(payload[12:16])
+	)
+	// towValid, weekValid and leapSValid flags
+	msg := &NavTimeGPS{
+		Valid:    valid&0x07 == 0x07,
+		Accuracy: time.Duration(accuracy) * time.Nanosecond,
+	}
+	if msg.Valid {
+		msg.Time = gpsEpoch.
+			Add(time.Duration(week) * 7 * 24 * time.Hour).
+			Add(time.Duration(iTOW) * time.Millisecond).
+			Add(time.Duration(fTOW) * time.Nanosecond).
+			Add(-time.Duration(leapS) * time.Second)
+	}
+	return msg, nil
+}
+
+func parseNavPVT(payload []byte) (*NavPVT, error) {
+	if len(payload) < navPVTMinLength {
+		return nil, errors.New("Invalid UBX-NAV-PVT length")
+	}
+	var (
+		year     = int(binary.LittleEndian.Uint16(payload[4:6]))
+		valid    = payload[11]
+		nano     = int32(binary.LittleEndian.Uint32(payload[16:20]))
+		fixType  = payload[20]
+		flags    = payload[21]
+		lon      = int32(binary.LittleEndian.Uint32(payload[24:28]))
+		lat      = int32(binary.LittleEndian.Uint32(payload[28:32]))
+		hMSL     = int32(binary.LittleEndian.Uint32(payload[36:40]))
+		hAcc     = binary.LittleEndian.Uint32(payload[40:44])
+		vAcc     = binary.LittleEndian.Uint32(payload[44:48])
+		pDOP     = binary.LittleEndian.Uint16(payload[76:78])
+		gnssFix  = flags&0x01 != 0
+		diffSoln = flags&0x02 != 0
+	)
+
+	msg := &NavPVT{
+		// validDate, validTime and fullyResolved flags
+		TimeValid:          valid&0x07 == 0x07,
+		Satellites:         int(payload[23]),
+		Latitude:           float64(lat) * 1e-7,
+		Longitude:          float64(lon) * 1e-7,
+		Altitude:           float64(hMSL) / 1000,
+		HorizontalAccuracy: float64(hAcc) / 1000,
+		VerticalAccuracy:   float64(vAcc) / 1000,
+		PDOP:               float64(pDOP) / 100,
+		Mode:               ModeNoFix,
+		Quality:            QualityInvalid,
+	}
+	if msg.TimeValid {
+		msg.Time = time.Date(year, time.Month(payload[6]), int(payload[7]),
+			int(payload[8]), int(payload[9]), int(payload[10]), int(nano), time.UTC)
+	}
+
+	if !gnssFix {
+		return msg, nil
+	}
+	switch fixType {
+	case 1: // Dead reckoning only
+		msg.Mode, msg.Quality = Mode2D, QualityEstimated
+	case 2:
+		msg.Mode, msg.Quality = Mode2D, QualityGPS
+	case 3, 4: // 3D, GNSS + dead reckoning
+		msg.Mode, msg.Quality = Mode3D, QualityGPS
+	}
+	if msg.Quality == QualityGPS && diffSoln {
+		msg.Quality = QualityDGPS
+	}
+	return msg, nil
+}
@@ -0,0 +1,143 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gnss
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// UBX frames of a u-blox M8 receiver, for the navigation epoch of 2017-03-20 14:02:12 UTC
+const (
+	// NAV-TIMEGPS with valid time of week, week number and leap seconds, 1.5µs before the epoch
+	navTimeGPSFrame = "b56201201000f0b0290824faffff9507120719000000ecb1"
+	// NAV-TIMEGPS whose leap seconds are not valid yet
+	navTimeGPSNoLeapFrame = "b56201201000f0b02908000000009507120319000000cc42"
+	// NAV-PVT with a 3D differential fix, 25µs before the epoch
+	navPVTFrame = "b56201075c00f0b02908e10703140e020c0732000000589effff0303000bb596ea02d17e371fc4b80000cc100000d90900002422000000000000000000000000000000000000000000000000000000000000a20000000000000000000000000000008c12"
+	// NAV-PVT without fix nor valid time
+	navPVTNoFixFrame = "b56201075c00f0b02908e10703140e020c0032000000000000000000000bb596ea02d17e371fc4b80000cc100000d90900002422000000000000000000000000000000000000000000000000000000000000a20000000000000000000000000000008b57"
+	// CFG-PRT poll, which isn't a navigation message
+	cfgFrame = "b5620601020001020c35"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	frame, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("Invalid test frame %s: %v", s, err)
+	}
+	return frame
+}
+
+func TestParseUBX(t *testing.T) {
+	epoch := time.Date(2017, 3, 20, 14, 2, 12, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		frame    string
+		expected Message
+		err      bool
+	}{
+		{
+			name:  "NAV-TIMEGPS",
+			frame: navTimeGPSFrame,
+			expected: &NavTimeGPS{
+				Time:     epoch.Add(-1500 * time.Nanosecond),
+				Valid:    true,
+				Accuracy: 25 * time.Nanosecond,
+			},
+		},
+		{
+			name:     "NAV-TIMEGPS without leap seconds",
+			frame:    navTimeGPSNoLeapFrame,
+			expected: &NavTimeGPS{Accuracy: 25 * time.Nanosecond},
+		},
+		{
+			name:  "NAV-PVT",
+			frame: navPVTFrame,
+			expected: &NavPVT{
+				Time:               epoch.Add(-25 * time.Microsecond),
+				TimeValid:          true,
+				Mode:               Mode3D,
+				Quality:            QualityDGPS,
+				Satellites:         11,
+				Latitude:           52.3730641,
+				Longitude:          4.8928437,
+				Altitude:           4.3,
+				HorizontalAccuracy: 2.521,
+				VerticalAccuracy:   8.74,
+				PDOP:               1.62,
+			},
+		},
+		{
+			name:  "NAV-PVT without fix",
+			frame: navPVTNoFixFrame,
+			expected: &NavPVT{
+				Mode:               ModeNoFix,
+				Quality:            QualityInvalid,
+				Satellites:         11,
+				Latitude:           52.3730641,
+				Longitude:          4.8928437,
+				Altitude:           4.3,
+				HorizontalAccuracy: 2.521,
+				VerticalAccuracy:   8.74,
+				PDOP:               1.62,
+			},
+		},
+		{name: "CFG-PRT", frame: cfgFrame},
+		{name: "Checksum mismatch", frame: navTimeGPSFrame[:len(navTimeGPSFrame)-2] + "00", err: true},
+	} {
+		msg, err := parseUBX(decodeHex(t, tc.frame))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if msg == nil && tc.expected == nil {
+			continue
+		}
+		if pvt, ok := msg.(*NavPVT); ok {
+			// The coordinates are scaled from integers
+			rounded := *pvt
+			rounded.Latitude = math.Floor(pvt.Latitude*1e7+0.5) / 1e7
+			rounded.Longitude = math.Floor(pvt.Longitude*1e7+0.5) / 1e7
+			msg = &rounded
+		}
+		if !reflect.DeepEqual(msg, tc.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tc.name, msg, tc.expected)
+		}
+	}
+}
+
+func TestPPSTime(t *testing.T) {
+	epoch := time.Date(2017, 3, 20, 14, 2, 12, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		msg   Message
+		pps   time.Time
+		valid bool
+	}{
+		{name: "RMC", msg: &RMC{Valid: true, Time: epoch}, pps: epoch, valid: true},
+		{name: "Invalid RMC", msg: &RMC{Time: epoch}},
+		{name: "ZDA", msg: &ZDA{Time: epoch.Add(20 * time.Millisecond)}, pps: epoch, valid: true},
+		{name: "Early NAV-TIMEGPS", msg: &NavTimeGPS{Valid: true, Time: epoch.Add(-1500 * time.Nanosecond)}, pps: epoch, valid: true},
+		{name: "Late NAV-TIMEGPS", msg: &NavTimeGPS{Valid: true, Time: epoch.Add(-20 * time.Millisecond)}, pps: epoch.Add(-time.Second), valid: true},
+		{name: "Invalid NAV-TIMEGPS", msg: &NavTimeGPS{Time: epoch}},
+		{name: "NAV-PVT", msg: &NavPVT{TimeValid: true, Time: epoch.Add(-25 * time.Microsecond)}, pps: epoch, valid: true},
+		{name: "GGA", msg: &GGA{TimeOfDay: 14 * time.Hour}},
+	} {
+		pps, valid := PPSTime(tc.msg)
+		if valid != tc.valid {
+			t.Errorf("%s: valid is %t, expected %t", tc.name, valid, tc.valid)
+		} else if valid && !pps.Equal(tc.pps) {
+			t.Errorf("%s: PPS time is %s, expected %s", tc.name, pps, tc.pps)
+		}
+	}
+}
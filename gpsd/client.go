@@ -0,0 +1,171 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// Package gpsd implements a minimal client of the gpsd JSON protocol, used to share a GPS between
+// the packet forwarder and other consumers (NTP, chrony...) of the same board.
+package gpsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Scheme is the prefix of the GPS sources that designate a gpsd daemon (example: gpsd://localhost:2947)
+const Scheme = "gpsd://"
+
+// DefaultPort is the port gpsd listens on by default
+const DefaultPort = "2947"
+
+const watchCommand = `?WATCH={"enable":true,"json":true};`
+
+// Fix modes, as reported in the `mode` field of TPV reports
+const (
+	ModeUnknown = 0
+	ModeNoFix   = 1
+	Mode2D      = 2
+	Mode3D      = 3
+)
+
+// Fix statuses, as reported in the `status` field of TPV reports
+const (
+	StatusUnknown  = 0
+	StatusNormal   = 1
+	StatusDGPS     = 2
+	StatusRTKFixed = 3
+	StatusRTKFloat = 4
+	StatusDR       = 5
+)
+
+// IsSource returns true if the GPS source designates a gpsd daemon
+func IsSource(source string) bool {
+	return strings.HasPrefix(source, Scheme)
+}
+
+// Address returns the host:port address of the gpsd daemon designated by the GPS source
+func Address(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", errors.Wrap(err, "Invalid gpsd source")
+	}
+	if u.Scheme+"://" != Scheme || u.Hostname() == "" {
+		return "", fmt.Errorf("Invalid gpsd source %s (expected format: %s<host>:<port>)", source, Scheme)
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), DefaultPort), nil
+	}
+	return u.Host, nil
+}
+
+// TPV is a time-position-velocity report
+type TPV struct {
+	Device string  `json:"device"`
+	Mode   int     `json:"mode"`
+	Status int     `json:"status"`
+	Time   string  `json:"time"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Alt    float64 `json:"alt"`
+	Epx    float64 `json:"epx"` // Longitude error estimate in meters, 95% confidence
+	Epy    float64 `json:"epy"` // Latitude error estimate in meters, 95% confidence
+	Epv    float64 `json:"epv"` // Altitude error estimate in meters, 95% confidence
+}
+
+// UTC returns the time of the fix
+func (t TPV) UTC() (time.Time, error) {
+	if t.Time == "" {
+		return time.Time{}, errors.New("No time in TPV report")
+	}
+	return time.Parse(time.RFC3339Nano, t.Time)
+}
+
+// Satellite describes a satellite in a SKY report
+type Satellite struct {
+	PRN  int     `json:"PRN"`
+	SS   float64 `json:"ss"`
+	Used bool    `json:"used"`
+}
+
+// SKY is a sky view report
+type SKY struct {
+	Device     string      `json:"device"`
+	HDOP       float64     `json:"hdop"`
+	Satellites []Satellite `json:"satellites"`
+}
+
+// Report is a report sent by gpsd. Only one of TPV and SKY is set, depending on Class.
+type Report struct {
+	Class string
+	TPV   *TPV
+	SKY   *SKY
+}
+
+// Client is a connection to a gpsd daemon, watching its reports
+type Client struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// Dial connects to the gpsd daemon at address, and enables the JSON watch mode
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't connect to gpsd")
+	}
+
+	if _, err := conn.Write([]byte(watchCommand)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Couldn't enable gpsd watch mode")
+	}
+
+	return &Client{
+		conn:    conn,
+		scanner: bufio.NewScanner(conn),
+	}, nil
+}
+
+// Next blocks until the next report is received. Reports of other classes than TPV and SKY are
+// returned with only their Class set.
+func (c *Client) Next() (Report, error) {
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return Report{}, errors.Wrap(err, "gpsd connection error")
+		}
+		return Report{}, errors.New("gpsd connection closed")
+	}
+	return parseReport(c.scanner.Bytes())
+}
+
+// Close closes the connection to the gpsd daemon
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func parseReport(line []byte) (Report, error) {
+	var header struct {
+		Class string `json:"class"`
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return Report{}, errors.Wrap(err, "Invalid gpsd report")
+	}
+
+	report := Report{Class: header.Class}
+	switch header.Class {
+	case "TPV":
+		report.TPV = &TPV{}
+		if err := json.Unmarshal(line, report.TPV); err != nil {
+			return report, errors.Wrap(err, "Invalid gpsd TPV report")
+		}
+	case "SKY":
+		report.SKY = &SKY{}
+		if err := json.Unmarshal(line, report.SKY); err != nil {
+			return report, errors.Wrap(err, "Invalid gpsd SKY report")
+		}
+	}
+	return report, nil
+}
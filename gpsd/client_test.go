@@ -0,0 +1,219 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package gpsd
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedReports are reports of gpsd 3.16 watching a u-blox receiver, in the order it sends them
+var recordedReports = []string{
+	`{"class":"VERSION","release":"3.16","rev":"3.16-4","proto_major":3,"proto_minor":11}`,
+	`{"class":"DEVICES","devices":[{"class":"DEVICE","path":"/dev/ttyAMA0","driver":"u-blox","activated":"2017-03-20T14:02:11.082Z","flags":1,"native":1,"bps":9600,"parity":"N","stopbits":1,"cycle":1.00,"mincycle":0.25}]}`,
+	`{"class":"WATCH","enable":true,"json":true,"nmea":false,"raw":0,"scaled":false,"timing":false,"split24":false,"pps":false}`,
+	`{"class":"TPV","device":"/dev/ttyAMA0","mode":3,"status":2,"time":"2017-03-20T14:02:12.000Z","ept":0.005,"lat":52.373064167,"lon":4.892284333,"alt":4.300,"epx":2.521,"epy":3.211,"epv":8.740,"track":0.0000,"speed":0.012,"climb":0.000,"eps":6.42}`,
+	`{"class":"SKY","device":"/dev/ttyAMA0","xdop":0.58,"ydop":0.74,"vdop":1.32,"tdop":0.97,"hdop":0.94,"gdop":1.87,"pdop":1.62,"satellites":[{"PRN":2,"el":41,"az":296,"ss":35,"used":true},{"PRN":6,"el":60,"az":223,"ss":41,"used":true},{"PRN":12,"el":12,"az":42,"ss":0,"used":false}]}`,
+}
+
+func TestAddress(t *testing.T) {
+	for _, tc := range []struct {
+		source  string
+		address string
+		err     bool
+	}{
+		{source: "gpsd://localhost:2947", address: "localhost:2947"},
+		{source: "gpsd://localhost", address: "localhost:2947"},
+		{source: "gpsd://192.168.1.10:3000", address: "192.168.1.10:3000"},
+		{source: "gpsd://[::1]", address: "[::1]:2947"},
+		{source: "gpsd://", err: true},
+		{source: "tcp://localhost:2947", err: true},
+		{source: "/dev/ttyAMA0", err: true},
+	} {
+		address, err := Address(tc.source)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Address(%q) = %q, expected an error", tc.source, address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Address(%q) returned an error: %v", tc.source, err)
+		} else if address != tc.address {
+			t.Errorf("Address(%q) = %q, expected %q", tc.source, address, tc.address)
+		}
+	}
+}
+
+func TestIsSource(t *testing.T) {
+	for source, expected := range map[string]bool{
+		"gpsd://localhost": true,
+		"/dev/ttyAMA0":     false,
+		"":                 false,
+	} {
+		if IsSource(source) != expected {
+			t.Errorf("IsSource(%q) = %t, expected %t", source, !expected, expected)
+		}
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		class string
+		check func(t *testing.T, report Report)
+		err   bool
+	}{
+		{line: recordedReports[0], class: "VERSION"},
+		{line: recordedReports[2], class: "WATCH"},
+		{
+			line:  recordedReports[3],
+			class: "TPV",
+			check: func(t *testing.T, report Report) {
+				tpv := report.TPV
+				if tpv.Mode != Mode3D || tpv.Status != StatusDGPS {
+					t.Errorf("Expected a 3D DGPS fix, got mode %d and status %d", tpv.Mode, tpv.Status)
+				}
+				if tpv.Lat != 52.373064167 || tpv.Lon != 4.892284333 || tpv.Alt != 4.3 {
+					t.Errorf("Unexpected position %f, %f, %f", tpv.Lat, tpv.Lon, tpv.Alt)
+				}
+				if tpv.Epx != 2.521 || tpv.Epy != 3.211 || tpv.Epv != 8.74 {
+					t.Errorf("Unexpected error estimates %f, %f, %f", tpv.Epx, tpv.Epy, tpv.Epv)
+				}
+				utc, err := tpv.UTC()
+				if err != nil {
+					t.Fatalf("Couldn't parse the time of the fix: %v", err)
+				}
+				if expected := time.Date(2017, 3, 20, 14, 2, 12, 0, time.UTC); !utc.Equal(expected) {
+					t.Errorf("Fix time is %s, expected %s", utc, expected)
+				}
+			},
+		},
+		{
+			line:  recordedReports[4],
+			class: "SKY",
+			check: func(t *testing.T, report Report) {
+				sky := report.SKY
+				if sky.HDOP != 0.94 {
+					t.Errorf("HDOP is %f, expected 0.94", sky.HDOP)
+				}
+				if len(sky.Satellites) != 3 {
+					t.Fatalf("Expected 3 satellites, got %d", len(sky.Satellites))
+				}
+				if sky.Satellites[1].PRN != 6 || sky.Satellites[1].SS != 41 || !sky.Satellites[1].Used {
+					t.Errorf("Unexpected satellite %+v", sky.Satellites[1])
+				}
+				if sky.Satellites[2].Used {
+					t.Errorf("Satellite %d is not used", sky.Satellites[2].PRN)
+				}
+			},
+		},
+		{
+			line:  `{"class":"TPV","device":"/dev/ttyAMA0","mode":1}`,
+			class: "TPV",
+			check: func(t *testing.T, report Report) {
+				if report.TPV.Mode != ModeNoFix {
+					t.Errorf("Expected no fix, got mode %d", report.TPV.Mode)
+				}
+				if _, err := report.TPV.UTC(); err == nil {
+					t.Error("Expected an error for a TPV report without time")
+				}
+			},
+		},
+		{line: `{"class":"TPV","mode":"3"}`, class: "TPV", err: true},
+		{line: `{"class":"TPV"`, err: true},
+	} {
+		report, err := parseReport([]byte(tc.line))
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error parsing %s", tc.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", tc.line, err)
+			continue
+		}
+		if report.Class != tc.class {
+			t.Errorf("Report class is %q, expected %q", report.Class, tc.class)
+		}
+		if (report.TPV != nil) != (tc.class == "TPV") || (report.SKY != nil) != (tc.class == "SKY") {
+			t.Errorf("Unexpected reports set for a %s report: %+v", tc.class, report)
+		}
+		if tc.check != nil {
+			tc.check(t, report)
+		}
+	}
+}
+
+// fakeGPSD listens like a gpsd daemon: it waits for the watch command of a client, then sends the
+// reports and closes the connection. The received command is sent on the returned channel.
+func fakeGPSD(t *testing.T, reports []string) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	commands := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		command, err := bufio.NewReader(conn).ReadString(';')
+		if err != nil {
+			return
+		}
+		commands <- command
+		conn.Write([]byte(strings.Join(reports, "\n") + "\n"))
+	}()
+	return listener.Addr().String(), commands
+}
+
+func TestClient(t *testing.T) {
+	address, commands := fakeGPSD(t, recordedReports)
+	client, err := Dial(address, time.Second)
+	if err != nil {
+		t.Fatalf("Couldn't connect to the fake gpsd: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case command := <-commands:
+		if command != watchCommand {
+			t.Errorf("Received command %q, expected %q", command, watchCommand)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No watch command received")
+	}
+
+	for _, class := range []string{"VERSION", "DEVICES", "WATCH", "TPV", "SKY"} {
+		report, err := client.Next()
+		if err != nil {
+			t.Fatalf("Couldn't read the %s report: %v", class, err)
+		}
+		if report.Class != class {
+			t.Errorf("Report class is %q, expected %q", report.Class, class)
+		}
+	}
+	if _, err := client.Next(); err == nil {
+		t.Error("Expected an error once gpsd closed the connection")
+	}
+}
+
+func TestDialError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	if _, err := Dial(address, time.Second); err == nil {
+		t.Error("Expected an error connecting to a closed port")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/TheThingsNetwork/ttn/api/protocol/lorawan"
+	"github.com/TheThingsNetwork/ttn/api/router"
+	"github.com/pkg/errors"
+)
+
+// Frame format of the downlinks, as set up by the wrapper
+const (
+	loraPreambleSymbols = 8
+	fskPreambleBytes    = 4
+	fskSyncWordBytes    = 3
+	crcBytes            = 2
+)
+
+var codingRateDenominators = map[string]int{
+	"4/5": 5,
+	"4/6": 6,
+	"2/3": 6,
+	"4/7": 7,
+	"4/8": 8,
+	"1/2": 8,
+}
+
+// loraTimeOnAir returns the time on air of a LoRa frame, with bw in kHz
+func loraTimeOnAir(sf, bw, codingRateDenominator, payloadSize int, preambleSymbols float64, header, crc bool) time.Duration {
+	symbol := math.Pow(2, float64(sf)) / float64(bw*1000)
+	lowDatarateOptimize := 0
+	if symbol > 0.016 {
+		lowDatarateOptimize = 1
+	}
+	bits := 8*payloadSize - 4*sf + 28
+	if !header {
+		bits -= 20
+	}
+	if crc {
+		bits += 16
+	}
+	payloadSymbols := 8 + math.Max(math.Ceil(float64(bits)/float64(4*(sf-2*lowDatarateOptimize)))*float64(codingRateDenominator), 0)
+	seconds := (preambleSymbols+4.25)*symbol + payloadSymbols*symbol
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// downlinkTimeOnAir returns the time on air of a downlink
+func downlinkTimeOnAir(message *router.DownlinkMessage) (time.Duration, error) {
+	lorawanConf := message.GetProtocolConfiguration().GetLorawan()
+	switch lorawanConf.GetModulation() {
+	case lorawan.Modulation_LORA:
+		var sf, bw int
+		if n, err := fmt.Sscanf(lorawanConf.GetDataRate(), "SF%dBW%d", &sf, &bw); err != nil || n != 2 {
+			return 0, fmt.Errorf("Unparseable LoRa datarate %s", lorawanConf.GetDataRate())
+		}
+		denominator, ok := codingRateDenominators[lorawanConf.GetCodingRate()]
+		if !ok {
+			return 0, fmt.Errorf("Unsupported coding rate %s", lorawanConf.GetCodingRate())
+		}
+		// Explicit header, with CRC
+		return loraTimeOnAir(sf, bw, denominator, len(message.GetPayload()), loraPreambleSymbols, true, true), nil
+	case lorawan.Modulation_FSK:
+		if lorawanConf.GetBitRate() == 0 {
+			return 0, errors.New("No FSK bitrate")
+		}
+		bits := 8 * (fskPreambleBytes + fskSyncWordBytes + 1 + len(message.GetPayload()) + crcBytes)
+		return time.Duration(bits) * time.Second / time.Duration(lorawanConf.GetBitRate()), nil
+	}
+	return 0, errors.New("Modulation neither LoRa nor FSK")
+}
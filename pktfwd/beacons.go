@@ -0,0 +1,108 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/classb"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/TheThingsNetwork/ttn/api/router"
+)
+
+// BeaconConfig is the configuration of the Class B beacons
+type BeaconConfig struct {
+	Enabled bool
+	Power   int8 // EIRP, in dBm
+}
+
+type beaconScheduler struct {
+	ctx       log.Interface
+	downlinks DownlinkManager
+	power     int8
+	region    classb.Region
+	location  *LocationResolver
+}
+
+// scheduleBeacon places the beacon of beaconStart in the JIT queue, which sends it to the
+// concentrator on time. Beacons are only scheduled when the time reference is locked on the GPS, as
+// devices synchronise on them.
+func (b *beaconScheduler) scheduleBeacon(beaconStart time.Time) {
+	ctx := b.ctx.WithField("BeaconTime", beaconStart)
+	if state := wrapper.GetGPSTimeSync().State; state != wrapper.TimeSyncLocked {
+		ctx.WithField("TimeSyncState", state.String()).Warn("GPS time not locked, skipping beacon")
+		return
+	}
+	location, ok := b.location.Location()
+	if !ok {
+		ctx.Warn("Gateway location unavailable, skipping beacon")
+		return
+	}
+
+	beacon := classb.Beacon{
+		Time:      classb.BeaconTime(beaconStart),
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+	}
+	packet := wrapper.BeaconPacket{
+		Frequency:       b.region.Frequency(beacon.Time),
+		SpreadingFactor: b.region.SpreadingFactor,
+		Bandwidth:       b.region.Bandwidth,
+		Power:           b.power,
+		Payload:         beacon.Frame(b.region),
+	}
+	if err := b.downlinks.ScheduleBeacon(packet, beaconStart); err != nil {
+		ctx.WithError(err).Warn("Couldn't schedule beacon")
+	}
+}
+
+// run schedules a beacon every beacon period, until the context is done. Each beacon is scheduled
+// as soon as the previous one is sent, so that its guard time is reserved before the downlinks of
+// the beacon period are scheduled.
+func (b *beaconScheduler) run(bgCtx context.Context) {
+	for {
+		beaconStart := classb.NextBeacon(time.Now().Add(onGPSSendMargin))
+		b.scheduleBeacon(beaconStart)
+		select {
+		case <-bgCtx.Done():
+			return
+		case <-time.After(beaconStart.Sub(time.Now())):
+		}
+	}
+}
+
+// pingSlotTolerance is the maximal difference between the time of a timestamped downlink and the
+// start of a ping slot of its device, for the downlink to be aligned on the ping slot. The network
+// computes the timestamp of a ping slot from the GPS time of the uplinks, which drifts from the
+// current GPS time reference by up to a few hundred microseconds.
+const pingSlotTolerance = time.Millisecond
+
+// downlinkDevAddr returns the address of the device a LoRaWAN data downlink is sent to
+func downlinkDevAddr(payload []byte) (uint32, bool) {
+	// MHDR, FHDR of at least 7 bytes and MIC
+	if len(payload) < 12 {
+		return 0, false
+	}
+	switch payload[0] >> 5 {
+	case mTypeUnconfirmedDown, mTypeConfirmedDown:
+		return binary.LittleEndian.Uint32(payload[1:5]), true
+	}
+	return 0, false
+}
+
+// pingSlotTime returns the GPS time of the ping slot of a timestamped downlink, if its timestamp
+// matches a ping slot of its device
+func pingSlotTime(message *router.DownlinkMessage) (time.Time, bool) {
+	devAddr, ok := downlinkDevAddr(message.GetPayload())
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := wrapper.TimestampToGPSTime(message.GetGatewayConfiguration().GetTimestamp())
+	if err != nil {
+		return time.Time{}, false
+	}
+	return classb.MatchPingSlot(t, devAddr, pingSlotTolerance)
+}
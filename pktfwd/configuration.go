@@ -14,7 +14,8 @@ import (
 // ignore the frequency plan value of `clksrc`.
 var platform = ""
 
-func configureBoard(ctx log.Interface, conf util.Config, gpsPath string) error {
+// configureBoard applies the frequency plan to the concentrator
+func configureBoard(ctx log.Interface, conf util.Config) error {
 	if platform == "multitech" {
 		ctx.Info("Forcing clock source to 0 (Multitech concentrator)")
 		conf.Concentrator.Clksrc = 0
@@ -25,12 +26,14 @@ func configureBoard(ctx log.Interface, conf util.Config, gpsPath string) error {
 		return err
 	}
 
-	err = configureChannels(ctx, conf)
-	if err != nil {
-		return err
+	if lbt := conf.Concentrator.LbtConfig; lbt != nil && lbt.Enabled {
+		err = wrapper.SetLBTConf(ctx, *lbt)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = enableGPS(ctx, gpsPath)
+	err = configureChannels(ctx, conf)
 	if err != nil {
 		return err
 	}
@@ -100,6 +103,7 @@ func FetchConfig(ctx log.Interface, ttnConfig *TTNConfig) (*util.Config, error)
 	if gw.Attributes.Description != nil {
 		ttnConfig.GatewayDescription = *gw.Attributes.Description
 	}
+	ttnConfig.FrequencyPlan = gw.FrequencyPlan
 
 	config, err := util.FetchConfigFromURL(ctx, gw.FrequencyPlanURL)
 	if err != nil {
@@ -0,0 +1,295 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/TheThingsNetwork/go-account-lib/account"
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/gnss"
+	"github.com/TheThingsNetwork/packet_forwarder/gpsd"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/TheThingsNetwork/ttn/api/discovery"
+	"github.com/pkg/errors"
+)
+
+const (
+	doctorGPSTimeout  = 10 * time.Second
+	doctorHTTPTimeout = 10 * time.Second
+	// maxClockSkew is the maximal difference between the system clock and the account server clock
+	maxClockSkew = 10 * time.Second
+)
+
+// CheckStatus is the outcome of a doctor check
+type CheckStatus string
+
+// Check outcomes
+const (
+	CheckPassed  CheckStatus = "PASS"
+	CheckFailed  CheckStatus = "FAIL"
+	CheckSkipped CheckStatus = "SKIP"
+)
+
+// CheckResult is the result of a doctor check
+type CheckResult struct {
+	Name     string
+	Status   CheckStatus
+	Details  string
+	Duration time.Duration
+}
+
+// DoctorConfig describes what the doctor checks
+type DoctorConfig struct {
+	ConfigFile string
+	TTN        TTNConfig
+	ResetPin   int
+	GPSSource  string
+}
+
+type doctor struct {
+	ctx     log.Interface
+	conf    DoctorConfig
+	gateway *account.Gateway
+	plan    *util.Config
+	results []CheckResult
+}
+
+// check runs a check, unless skipReason is set. The check returns details on success.
+func (d *doctor) check(name string, skipReason string, check func() (string, error)) bool {
+	result := CheckResult{Name: name}
+	if skipReason != "" {
+		result.Status = CheckSkipped
+		result.Details = skipReason
+		d.results = append(d.results, result)
+		return false
+	}
+
+	start := time.Now()
+	details, err := check()
+	result.Duration = time.Now().Sub(start)
+	if err != nil {
+		result.Status = CheckFailed
+		result.Details = err.Error()
+		d.ctx.WithError(err).WithField("Check", name).Debug("Check failed")
+	} else {
+		result.Status = CheckPassed
+		result.Details = details
+	}
+	d.results = append(d.results, result)
+	return err == nil
+}
+
+func (d *doctor) checkConfigFile() (string, error) {
+	f, err := os.Open(d.conf.ConfigFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return "", err
+	}
+	return d.conf.ConfigFile, nil
+}
+
+func (d *doctor) checkAccountServer() (string, error) {
+	if d.conf.TTN.ID == "" {
+		return "", errors.New("No gateway ID configured")
+	}
+	a := account.New(d.conf.TTN.AuthServer)
+	if d.conf.TTN.Key != "" {
+		a = account.NewWithKey(d.conf.TTN.AuthServer, d.conf.TTN.Key.Value())
+	}
+	gw, err := a.FindGateway(d.conf.TTN.ID)
+	if err != nil {
+		return "", errors.Wrap(err, "Gateway not found")
+	}
+	d.gateway = &gw
+	return fmt.Sprintf("gateway %s found on %s", d.conf.TTN.ID, d.conf.TTN.AuthServer), nil
+}
+
+func (d *doctor) checkFrequencyPlan() (string, error) {
+	plan, err := util.FetchConfigFromURL(d.ctx, d.gateway.FrequencyPlanURL)
+	if err != nil {
+		return "", err
+	}
+	if len(plan.Concentrator.GetRadios()) == 0 {
+		return "", errors.New("No radio configured")
+	}
+	channels := plan.Concentrator.ChannelFrequencies()
+	if len(channels) == 0 {
+		return "", errors.New("No channel enabled")
+	}
+	if len(plan.Concentrator.GetTXLuts()) == 0 {
+		return "", errors.New("No TX gain LUT entry")
+	}
+	d.plan = &plan
+	return fmt.Sprintf("%s: %d channels", d.gateway.FrequencyPlan, len(channels)), nil
+}
+
+func (d *doctor) checkRouter() (string, error) {
+	discoveryStart := time.Now()
+	discoveryClient, err := discovery.NewClient(d.conf.TTN.DiscoveryServer, &discovery.Announcement{
+		ServiceName:    "ttn-packet-forwarder",
+		ServiceVersion: d.conf.TTN.Version,
+		Id:             d.conf.TTN.ID,
+	}, func() string { return "" })
+	if err != nil {
+		return "", errors.Wrap(err, "Discovery server unreachable")
+	}
+	defer discoveryClient.Close()
+	discoveryRTT := time.Now().Sub(discoveryStart)
+
+	routerID := d.conf.TTN.Router
+	if routerID == "" && d.gateway != nil {
+		routerID = d.gateway.Router.ID
+	}
+	if routerID == "" {
+		return "", errors.New("No router configured")
+	}
+	announcement, err := discoveryClient.Get("router", routerID)
+	if err != nil {
+		return "", errors.Wrapf(err, "Router %s not found by the discovery server", routerID)
+	}
+	conn, err := announcement.Dial()
+	if err != nil {
+		return "", errors.Wrapf(err, "Router %s unreachable", routerID)
+	}
+	defer conn.Close()
+	routerRTT, err := connectionHealthCheck(conn)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("discovery server %s (%v), router %s (RTT %v)", d.conf.TTN.DiscoveryServer, discoveryRTT, routerID, routerRTT), nil
+}
+
+func (d *doctor) checkResetPin() (string, error) {
+	if err := ResetPin(d.conf.ResetPin); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pin %d", d.conf.ResetPin), nil
+}
+
+func (d *doctor) checkConcentrator() (string, error) {
+	if err := configureBoard(d.ctx, *d.plan); err != nil {
+		return "", errors.Wrap(err, "Board configuration failure")
+	}
+	if err := wrapper.StartLoRaGateway(); err != nil {
+		return "", err
+	}
+	if err := wrapper.StopLoRaGateway(); err != nil {
+		return "", err
+	}
+	return wrapper.LoRaGatewayVersionInfo(), nil
+}
+
+func (d *doctor) checkGPS() (string, error) {
+	deadline := time.Now().Add(doctorGPSTimeout)
+	if gpsd.IsSource(d.conf.GPSSource) {
+		address, err := gpsd.Address(d.conf.GPSSource)
+		if err != nil {
+			return "", err
+		}
+		client, err := gpsd.Dial(address, gpsdDialTimeout)
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+		for time.Now().Before(deadline) {
+			report, err := client.Next()
+			if err != nil {
+				return "", err
+			}
+			if report.TPV != nil {
+				return fmt.Sprintf("gpsd %s, mode %d", address, report.TPV.Mode), nil
+			}
+		}
+		return "", errors.New("No position report received from gpsd")
+	}
+
+	if err := wrapper.LoRaGPSEnable(d.conf.GPSSource); err != nil {
+		return "", err
+	}
+	gpsInterface, err := wrapper.GPSInterface()
+	if err != nil {
+		return "", err
+	}
+	scanner := gnss.NewScanner(gpsInterface)
+	for time.Now().Before(deadline) {
+		if scanner.Scan() {
+			return fmt.Sprintf("%s, first message: %T", d.conf.GPSSource, scanner.Message()), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return "", errors.Wrap(err, "GPS interface read error")
+		}
+		time.Sleep(gpsUpdateRate)
+	}
+	return "", errors.New("No NMEA or UBX message received from the GPS")
+}
+
+// checkClock compares the system clock with the date of the account server
+func (d *doctor) checkClock() (string, error) {
+	client := http.Client{Timeout: doctorHTTPTimeout}
+	before := time.Now()
+	resp, err := client.Head(d.conf.TTN.AuthServer)
+	if err != nil {
+		return "", errors.Wrap(err, "Account server unreachable")
+	}
+	resp.Body.Close()
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return "", errors.Wrap(err, "No date in the account server response")
+	}
+	// The Date header has a precision of a second
+	skew := before.Add(time.Now().Sub(before) / 2).Sub(serverTime)
+	if math.Abs(float64(skew)) > float64(maxClockSkew+time.Second) {
+		return "", fmt.Errorf("System clock off by %v", skew)
+	}
+	return fmt.Sprintf("skew %v", skew), nil
+}
+
+// RunDoctor checks, step by step, the environment the packet forwarder needs to run
+func RunDoctor(ctx log.Interface, conf DoctorConfig) []CheckResult {
+	d := &doctor{ctx: ctx, conf: conf}
+
+	configSkip := ""
+	if conf.ConfigFile == "" {
+		configSkip = "no configuration file"
+	}
+	d.check("Configuration file", configSkip, d.checkConfigFile)
+	accountOK := d.check("Account server", "", d.checkAccountServer)
+
+	planSkip := ""
+	if !accountOK {
+		planSkip = "gateway not found"
+	}
+	planOK := d.check("Frequency plan", planSkip, d.checkFrequencyPlan)
+	d.check("Discovery server and router", "", d.checkRouter)
+
+	resetSkip := ""
+	if conf.ResetPin == 0 {
+		resetSkip = "no reset pin configured"
+	}
+	d.check("GPIO reset", resetSkip, d.checkResetPin)
+
+	concentratorSkip := ""
+	if !planOK {
+		concentratorSkip = "no valid frequency plan"
+	}
+	d.check("Concentrator start and stop", concentratorSkip, d.checkConcentrator)
+
+	gpsSkip := ""
+	if conf.GPSSource == "" {
+		gpsSkip = "no GPS configured"
+	}
+	d.check("GPS", gpsSkip, d.checkGPS)
+	d.check("System clock", "", d.checkClock)
+
+	return d.results
+}
@@ -4,17 +4,20 @@ package pktfwd
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/go-utils/queue"
+	"github.com/TheThingsNetwork/packet_forwarder/classb"
 	"github.com/TheThingsNetwork/packet_forwarder/util"
 	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
 	"github.com/TheThingsNetwork/ttn/api/router"
 )
 
 // BootTimeSetter is an interface that implements every type that needs receive boot time (mostly to
-// determine uptime afterwards)
+// determine uptime afterwards). A zero time means that the boot time is unknown, such as while the
+// concentrator restarts.
 type BootTimeSetter interface {
 	SetBootTime(t time.Time)
 }
@@ -43,20 +46,67 @@ func (b *multipleBootTimeSetter) Add(t BootTimeSetter) {
 	b.list = append(b.list, t)
 }
 
+// TXRequest is a downlink to transmit, with its transmission mode. The TTN router protocol carries
+// neither transmission mode nor absolute time: downlinks from the network are timestamped, except
+// the Class C downlinks with a timestamp of 0, transmitted immediately. Once ping slots are enabled, the timestamped
+// downlinks matching a ping slot of their device are aligned on the GPS time of the ping slot.
+type TXRequest struct {
+	Message *router.DownlinkMessage
+	Mode    wrapper.TXMode
+	// Time is the UTC time of the PPS pulse on which TXModeOnGPS downlinks are transmitted. For
+	// TXModeTimestamped downlinks, it is the GPS time of the emission if not zero, such as a ping
+	// slot, and the timestamp of the downlink is computed from it with the GPS time reference.
+	Time time.Time
+}
+
 // DownlinkManager is an interface that starts scheduling every downlink that is given to it
 type DownlinkManager interface {
 	BootTimeSetter
-	ScheduleDownlink(d *router.DownlinkMessage)
+	// Schedule schedules a downlink, or returns a *DownlinkError if it can't be transmitted
+	Schedule(request TXRequest) error
+	// ScheduleBeacon schedules a Class B beacon on the PPS pulse of its time. Beacons have priority
+	// over the downlinks scheduled within their guard time.
+	ScheduleBeacon(beacon wrapper.BeaconPacket, t time.Time) error
+	// EnablePingSlots aligns the timestamped downlinks matching a ping slot of their device on the
+	// GPS time of the ping slot. Devices only open ping slots once they receive the beacons.
+	EnablePingSlots()
+}
+
+// networkTXMode returns the transmission mode of a downlink from the network. The TTN router protocol
+// has no transmission mode: the network sends Class C downlinks, to transmit as soon as possible,
+// with a timestamp of 0. The few timestamped downlinks whose timestamp is exactly 0 are transmitted
+// immediately too.
+func networkTXMode(message *router.DownlinkMessage) wrapper.TXMode {
+	if message.GetGatewayConfiguration().GetTimestamp() == 0 {
+		return wrapper.TXModeImmediate
+	}
+	return wrapper.TXModeTimestamped
 }
 
+// onGPSSendMargin is the time before the PPS pulse at which a downlink sent on that pulse is sent
+// to the concentrator. As the concentrator transmits it on the next PPS pulse, it must be less than
+// a second - and the system clock must be synchronised within that margin.
+const onGPSSendMargin = 500 * time.Millisecond
+
 type downlinkManager struct {
 	queue              queue.JIT
 	ctx                log.Interface
 	conf               util.Config
 	bgCtx              context.Context
 	statusMgr          StatusManager
-	startupTime        time.Time
 	downlinkSendMargin time.Duration
+	// concentratorLock is held while a downlink is handed to the concentrator
+	concentratorLock sync.Locker
+	// frequencyPlan is the frequency plan of the gateway, whose payload size limits apply
+	frequencyPlan string
+	// gpsTimeSync returns the state of the GPS time reference
+	gpsTimeSync func() wrapper.GPSTimeSync
+
+	mutex       sync.Mutex
+	startupTime time.Time
+	pingSlots   bool
+	// scheduled are the downlinks whose TX window isn't over, in all transmission modes
+	scheduled []*scheduledDownlink
 }
 
 func (d *downlinkManager) getTimeMargin() time.Duration {
@@ -64,7 +114,7 @@ func (d *downlinkManager) getTimeMargin() time.Duration {
 }
 
 // NewDownlinkManager returns a new downlink manager that runs as long as the context doesn't close
-func NewDownlinkManager(bgCtx context.Context, ctx log.Interface, conf util.Config, statusMgr StatusManager, sendingTimeMargin time.Duration) DownlinkManager {
+func NewDownlinkManager(bgCtx context.Context, ctx log.Interface, conf util.Config, statusMgr StatusManager, sendingTimeMargin time.Duration, concentratorLock sync.Locker, frequencyPlan string) DownlinkManager {
 	downlinkMgr := &downlinkManager{
 		queue:              queue.NewJIT(),
 		ctx:                ctx,
@@ -72,6 +122,9 @@ func NewDownlinkManager(bgCtx context.Context, ctx log.Interface, conf util.Conf
 		bgCtx:              bgCtx,
 		statusMgr:          statusMgr,
 		downlinkSendMargin: sendingTimeMargin,
+		concentratorLock:   concentratorLock,
+		frequencyPlan:      frequencyPlan,
+		gpsTimeSync:        wrapper.GetGPSTimeSync,
 	}
 	ctx.WithField("SendingTimeMargin", sendingTimeMargin).Debug("Configured margin between downlink sent and concentrator processing")
 	go downlinkMgr.handleDownlinks()
@@ -79,7 +132,67 @@ func NewDownlinkManager(bgCtx context.Context, ctx log.Interface, conf util.Conf
 }
 
 func (d *downlinkManager) SetBootTime(t time.Time) {
+	d.mutex.Lock()
 	d.startupTime = t
+	d.mutex.Unlock()
+}
+
+func (d *downlinkManager) EnablePingSlots() {
+	d.mutex.Lock()
+	d.pingSlots = true
+	d.mutex.Unlock()
+}
+
+func (d *downlinkManager) pingSlotsEnabled() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.pingSlots
+}
+
+func (d *downlinkManager) bootTime() time.Time {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.startupTime
+}
+
+// txWindow is the time during which a downlink occupies the single TX buffer of the concentrator:
+// from the moment it is handed to the concentrator to the end of its emission
+type txWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+func (w txWindow) overlaps(other txWindow) bool {
+	return w.start.Before(other.end) && other.start.Before(w.end)
+}
+
+// Priorities of the entries of the JIT queue. When TX windows overlap, an entry with a higher
+// priority cancels the others.
+const (
+	txPriorityDownlink = iota
+	txPriorityBeacon
+)
+
+// scheduledDownlink is a downlink or a beacon waiting in the JIT queue
+type scheduledDownlink struct {
+	request TXRequest
+	// beacon is set instead of request.Message for Class B beacons
+	beacon   *wrapper.BeaconPacket
+	priority int
+	// sendTime is the system time at which the downlink is handed to the concentrator
+	sendTime time.Time
+	window   txWindow
+	// emission is the system time at which the concentrator starts the emission
+	emission time.Time
+	// cancelled is set when an entry with a higher priority took the TX window
+	cancelled bool
+}
+
+// emissionTime returns the system time at which the concentrator counter reaches a timestamp. As
+// the counter wraps around every 71 minutes, the closest occurrence of the timestamp is used.
+func emissionTime(bootTime time.Time, timestamp uint32, now time.Time) time.Time {
+	counter := uint32(now.Sub(bootTime) / time.Microsecond)
+	return now.Add(time.Duration(int32(timestamp-counter)) * time.Microsecond)
 }
 
 func (d *downlinkManager) handleDownlinks() {
@@ -87,9 +200,23 @@ func (d *downlinkManager) handleDownlinks() {
 	for {
 		select {
 		case downlink := <-downlinks:
-			d.ctx.WithField("ConcentratorUptime", time.Now().Sub(d.startupTime)).Info("Received downlink from JIT queue, transmitting to the concentrator")
-			if err := wrapper.SendDownlink(downlink, d.conf, d.ctx); err == nil {
+			if d.isCancelled(downlink) {
+				continue
+			}
+			if downlink.beacon != nil {
+				d.sendBeacon(downlink)
+				continue
+			}
+			ctx := d.ctx.WithField("TXMode", downlink.request.Mode.String())
+			ctx.WithField("ConcentratorUptime", time.Now().Sub(d.bootTime())).Info("Received downlink from JIT queue, transmitting to the concentrator")
+			d.concentratorLock.Lock()
+			err := wrapper.SendDownlink(downlink.request.Message, downlink.request.Mode, d.conf, ctx)
+			d.concentratorLock.Unlock()
+			switch err {
+			case nil:
 				d.statusMgr.SentTX()
+			case wrapper.ErrChannelBusy:
+				d.statusMgr.BlockedTX()
 			}
 		case <-d.bgCtx.Done():
 			d.ctx.Info("Stopping downlink manager")
@@ -98,8 +225,31 @@ func (d *downlinkManager) handleDownlinks() {
 	}
 }
 
-func (d *downlinkManager) nextDownlinks() chan *router.DownlinkMessage {
-	downlink := make(chan *router.DownlinkMessage)
+func (d *downlinkManager) isCancelled(downlink *scheduledDownlink) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return downlink.cancelled
+}
+
+// sendBeacon sends a beacon to the concentrator. Beacons are only sent when the time reference is
+// locked on the GPS, as devices synchronise on them.
+func (d *downlinkManager) sendBeacon(downlink *scheduledDownlink) {
+	ctx := d.ctx.WithFields(log.Fields{"BeaconTime": downlink.emission, "Frequency": downlink.beacon.Frequency})
+	d.concentratorLock.Lock()
+	defer d.concentratorLock.Unlock()
+	if state := d.gpsTimeSync().State; state != wrapper.TimeSyncLocked {
+		ctx.WithField("TimeSyncState", state.String()).Warn("GPS time not locked, skipping beacon")
+		return
+	}
+	if err := wrapper.SendBeacon(*downlink.beacon, d.conf, ctx); err != nil {
+		ctx.WithError(err).Warn("Couldn't send beacon")
+		return
+	}
+	ctx.Info("Beacon sent")
+}
+
+func (d *downlinkManager) nextDownlinks() chan *scheduledDownlink {
+	downlink := make(chan *scheduledDownlink)
 	go func() {
 		for {
 			item := d.queue.Next()
@@ -107,7 +257,7 @@ func (d *downlinkManager) nextDownlinks() chan *router.DownlinkMessage {
 				d.ctx.Warn("JIT queue closing, no more downlinks sent")
 				break
 			}
-			next := item.(*router.DownlinkMessage)
+			next := item.(*scheduledDownlink)
 			select {
 			case downlink <- next:
 			default:
@@ -119,21 +269,196 @@ func (d *downlinkManager) nextDownlinks() chan *router.DownlinkMessage {
 	return downlink
 }
 
-func (d *downlinkManager) ScheduleDownlink(message *router.DownlinkMessage) {
-	lora := message.ProtocolConfiguration.GetLorawan()
-	if lora == nil {
-		d.ctx.Warn("Received non-LORA downlink, ignoring")
-		return
+// Schedule places a downlink in the JIT queue, ordered by the time at which it must be handed to the
+// concentrator: immediate downlinks right away, timestamped downlinks sendingTimeMargin before their
+// timestamp, and downlinks on a PPS pulse onGPSSendMargin before that pulse. A downlink whose TX
+// window overlaps the window of a downlink already scheduled is refused, as it would overwrite it in
+// the TX buffer of the concentrator.
+func (d *downlinkManager) Schedule(request TXRequest) error {
+	if err := d.validate(request.Message); err != nil {
+		return err
+	}
+	timeOnAir, err := downlinkTimeOnAir(request.Message)
+	if err != nil {
+		return downlinkError(DownlinkReasonModulation, err.Error())
 	}
 
-	margin := d.getTimeMargin()
+	if request.Mode == wrapper.TXModeTimestamped {
+		if err := d.resolveGPSTime(&request); err != nil {
+			return err
+		}
+	}
 
-	schedulingTimestamp := util.TXTimestamp(message.GetGatewayConfiguration().GetTimestamp())
+	now := time.Now()
+	downlink := &scheduledDownlink{request: request}
+	switch request.Mode {
+	case wrapper.TXModeImmediate:
+		downlink.emission = now
+		downlink.sendTime = now
+	case wrapper.TXModeTimestamped:
+		bootTime := d.bootTime()
+		if bootTime.IsZero() {
+			return downlinkError(DownlinkReasonTiming, "concentrator boot time unknown")
+		}
+		downlink.emission = emissionTime(bootTime, request.Message.GetGatewayConfiguration().GetTimestamp(), now)
+		downlink.sendTime = downlink.emission.Add(-d.getTimeMargin())
+	case wrapper.TXModeOnGPS:
+		if request.Time.Nanosecond() != 0 {
+			return downlinkError(DownlinkReasonTiming, "GPS time %v isn't on a PPS pulse", request.Time)
+		}
+		if state := d.gpsTimeSync().State; state != wrapper.TimeSyncLocked && state != wrapper.TimeSyncDrifting {
+			return downlinkError(DownlinkReasonTiming, "no valid GPS time reference")
+		}
+		downlink.emission = request.Time
+		downlink.sendTime = request.Time.Add(-onGPSSendMargin)
+	default:
+		return downlinkError(DownlinkReasonTiming, "unknown transmission mode %s", request.Mode)
+	}
+	if downlink.emission.Before(now) {
+		return downlinkError(DownlinkReasonTiming, "emission time %v already passed", downlink.emission)
+	}
+	downlink.window = txWindow{start: downlink.sendTime, end: downlink.emission.Add(timeOnAir)}
+
+	if err := d.reserve(downlink, now); err != nil {
+		return err
+	}
 	d.ctx.WithFields(log.Fields{
-		"ExpectedSendingTimestamp": schedulingTimestamp.GetAsDuration(),
-		"ConcentratorBootTime":     d.startupTime,
-		"ConcentratorUptime":       time.Now().Sub(d.startupTime),
-		"SchedulingTimestamp":      d.startupTime.Add(-margin).Add(schedulingTimestamp.GetAsDuration()),
+		"TXMode":         request.Mode.String(),
+		"EmissionTime":   downlink.emission,
+		"TimeOnAir":      timeOnAir,
+		"SchedulingTime": downlink.sendTime,
 	}).Info("Scheduled downlink")
-	d.queue.Schedule(message, d.startupTime.Add(-margin).Add(schedulingTimestamp.GetAsDuration()))
+	d.queue.Schedule(downlink, downlink.sendTime)
+	return nil
+}
+
+// resolveGPSTime computes the timestamp of a timestamped downlink from its GPS time. A downlink
+// without GPS time, whose timestamp matches a ping slot of its device, is aligned on the GPS time of
+// the ping slot if ping slots are enabled.
+func (d *downlinkManager) resolveGPSTime(request *TXRequest) error {
+	if request.Time.IsZero() {
+		if !d.pingSlotsEnabled() {
+			return nil
+		}
+		slot, ok := pingSlotTime(request.Message)
+		if !ok {
+			return nil
+		}
+		request.Time = slot
+	}
+	timestamp, err := wrapper.GPSTimeToTimestamp(request.Time)
+	if err != nil {
+		return downlinkError(DownlinkReasonTiming, "no timestamp for GPS time %v: %s", request.Time, err)
+	}
+	gatewayConf := request.Message.GetGatewayConfiguration()
+	d.ctx.WithFields(log.Fields{
+		"GPSTime":            request.Time,
+		"RequestedTimestamp": gatewayConf.GetTimestamp(),
+		"Timestamp":          timestamp,
+	}).Debug("Downlink scheduled at GPS time")
+	gatewayConf.Timestamp = timestamp
+	return nil
+}
+
+// ScheduleBeacon places a beacon in the JIT queue, onGPSSendMargin before the PPS pulse of t. The
+// beacon reserves the TX window from classb.BeaconGuard before t to classb.BeaconReserved after t:
+// the downlinks already scheduled in this window are cancelled, and the next ones refused.
+func (d *downlinkManager) ScheduleBeacon(beacon wrapper.BeaconPacket, t time.Time) error {
+	if t.Nanosecond() != 0 {
+		return downlinkError(DownlinkReasonTiming, "beacon time %v isn't on a PPS pulse", t)
+	}
+	now := time.Now()
+	downlink := &scheduledDownlink{
+		request:  TXRequest{Mode: wrapper.TXModeOnGPS, Time: t},
+		beacon:   &beacon,
+		priority: txPriorityBeacon,
+		sendTime: t.Add(-onGPSSendMargin),
+		window:   txWindow{start: t.Add(-classb.BeaconGuard), end: t.Add(classb.BeaconReserved)},
+		emission: t,
+	}
+	if downlink.sendTime.Before(now) {
+		return downlinkError(DownlinkReasonTiming, "beacon time %v already passed", t)
+	}
+	requestedPower := beacon.Power
+	adjustments, err := validateBeacon(d.conf.Concentrator, &beacon)
+	if err != nil {
+		return err
+	}
+	if adjustments.powerLowered {
+		d.ctx.WithFields(log.Fields{"RequestedPower": requestedPower, "Power": beacon.Power}).Warn("Beacon power not in the TX gain LUT, lowered to the closest entry")
+	}
+	if err := d.reserve(downlink, now); err != nil {
+		return err
+	}
+	d.ctx.WithFields(log.Fields{"BeaconTime": t, "Frequency": beacon.Frequency, "RFChain": beacon.RFChain}).Debug("Scheduled beacon")
+	d.queue.Schedule(downlink, downlink.sendTime)
+	return nil
+}
+
+// reserve adds the downlink to the scheduled downlinks, unless its TX window overlaps the window of
+// a downlink already scheduled with the same or a higher priority. The overlapping downlinks with a
+// lower priority are cancelled.
+func (d *downlinkManager) reserve(downlink *scheduledDownlink, now time.Time) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pending := d.scheduled[:0]
+	for _, scheduled := range d.scheduled {
+		if scheduled.window.end.After(now) {
+			pending = append(pending, scheduled)
+		}
+	}
+	d.scheduled = pending
+
+	for _, scheduled := range d.scheduled {
+		if !scheduled.window.overlaps(downlink.window) || scheduled.priority < downlink.priority {
+			continue
+		}
+		if scheduled.beacon != nil {
+			return downlinkError(DownlinkReasonCollision, "within the guard time of the beacon transmitted at %v", scheduled.emission)
+		}
+		return downlinkError(DownlinkReasonCollision, "overlaps the %s downlink transmitted at %v", scheduled.request.Mode, scheduled.emission)
+	}
+
+	kept := d.scheduled[:0]
+	for _, scheduled := range d.scheduled {
+		if scheduled.window.overlaps(downlink.window) {
+			scheduled.cancelled = true
+			d.ctx.WithFields(log.Fields{
+				"TXMode":       scheduled.request.Mode.String(),
+				"EmissionTime": scheduled.emission,
+			}).Warn("Downlink cancelled, within the guard time of a beacon")
+			continue
+		}
+		kept = append(kept, scheduled)
+	}
+	d.scheduled = append(kept, downlink)
+	return nil
+}
+
+// validate checks that the downlink can be transmitted, before it waits in the JIT queue
+func (d *downlinkManager) validate(message *router.DownlinkMessage) error {
+	requestedRFChain := message.GetGatewayConfiguration().GetRfChain()
+	requestedPower := message.GetGatewayConfiguration().GetPower()
+	adjustments, err := validateDownlink(d.conf.Concentrator, d.frequencyPlan, message)
+	if err != nil {
+		return err
+	}
+	d.logAdjustments(message, adjustments, requestedRFChain, requestedPower)
+	return nil
+}
+
+func (d *downlinkManager) logAdjustments(message *router.DownlinkMessage, adjustments downlinkAdjustments, requestedRFChain uint32, requestedPower int32) {
+	if adjustments.rfChainChanged {
+		d.ctx.WithFields(log.Fields{
+			"RequestedRFChain": requestedRFChain,
+			"RFChain":          message.GetGatewayConfiguration().GetRfChain(),
+			"Frequency":        message.GetGatewayConfiguration().GetFrequency(),
+		}).Info("Requested RF chain can't transmit on this frequency, using another RF chain")
+	}
+	if adjustments.powerLowered {
+		d.ctx.WithFields(log.Fields{
+			"RequestedPower": requestedPower,
+			"Power":          message.GetGatewayConfiguration().GetPower(),
+		}).Warn("Requested power not in the TX gain LUT, lowered to the closest entry")
+	}
 }
@@ -0,0 +1,219 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/go-utils/queue"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/TheThingsNetwork/ttn/api/gateway"
+	"github.com/TheThingsNetwork/ttn/api/protocol"
+	"github.com/TheThingsNetwork/ttn/api/protocol/lorawan"
+	"github.com/TheThingsNetwork/ttn/api/router"
+)
+
+const testSendMargin = 100 * time.Millisecond
+
+// recordingQueue is a JIT queue that only records the scheduled downlinks
+type recordingQueue struct {
+	queue.JIT
+	scheduled []*scheduledDownlink
+}
+
+func (q *recordingQueue) Schedule(item interface{}, t time.Time) {
+	q.scheduled = append(q.scheduled, item.(*scheduledDownlink))
+}
+
+// testDownlinkManager returns a downlink manager whose concentrator booted 10 seconds ago, without
+// the routine sending the downlinks to the concentrator
+func testDownlinkManager(timeSync wrapper.TimeSyncState) (*downlinkManager, *recordingQueue) {
+	q := &recordingQueue{}
+	minFreq, maxFreq := 863000000, 870000000
+	conf := util.Config{Concentrator: util.SX1301Conf{
+		Radio0: &util.RadioConf{Enabled: true, TxEnabled: true, TxMinFreq: &minFreq, TxMaxFreq: &maxFreq},
+		TxLut0: &util.GainTableConf{RfPower: 14},
+	}}
+	d := &downlinkManager{
+		queue:              q,
+		ctx:                log.Get(),
+		conf:               conf,
+		downlinkSendMargin: testSendMargin,
+		frequencyPlan:      "EU_863_870",
+		gpsTimeSync:        func() wrapper.GPSTimeSync { return wrapper.GPSTimeSync{State: timeSync} },
+		startupTime:        time.Now().Add(-10 * time.Second),
+	}
+	return d, q
+}
+
+// testDownlink returns a SF7BW125 downlink, on the air for about 41ms
+func testDownlink(timestamp uint32) *router.DownlinkMessage {
+	return &router.DownlinkMessage{
+		Payload: make([]byte, 12),
+		GatewayConfiguration: &gateway.TxConfiguration{
+			Timestamp: timestamp,
+			Frequency: 869525000,
+			Power:     14,
+		},
+		ProtocolConfiguration: &protocol.TxConfiguration{Protocol: &protocol.TxConfiguration_Lorawan{Lorawan: &lorawan.TxConfiguration{
+			Modulation: lorawan.Modulation_LORA,
+			DataRate:   "SF7BW125",
+			CodingRate: "4/5",
+		}}},
+	}
+}
+
+// timestampIn returns the counter value of the concentrator in d from now
+func timestampIn(m *downlinkManager, d time.Duration) uint32 {
+	return uint32(time.Now().Add(d).Sub(m.bootTime()) / time.Microsecond)
+}
+
+func checkDownlinkError(t *testing.T, name string, err error, reason DownlinkErrorReason) {
+	if reason == "" {
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		return
+	}
+	downlinkErr, ok := err.(*DownlinkError)
+	if !ok {
+		t.Errorf("%s: expected a %s error, got %v", name, reason, err)
+		return
+	}
+	if downlinkErr.Reason != reason {
+		t.Errorf("%s: expected a %s error, got %s (%v)", name, reason, downlinkErr.Reason, err)
+	}
+}
+
+func TestEmissionTime(t *testing.T) {
+	boot := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+	wrap := time.Duration(1<<32) * time.Microsecond
+	for _, tc := range []struct {
+		name      string
+		now       time.Time
+		timestamp uint32
+		expected  time.Duration
+	}{
+		{"Future timestamp", boot.Add(10 * time.Second), 11000000, time.Second},
+		{"Past timestamp", boot.Add(10 * time.Second), 9000000, -time.Second},
+		{"Timestamp after the counter wraps around", boot.Add(wrap - 500*time.Millisecond), 500000, time.Second},
+		{"Timestamp before the counter wrapped around", boot.Add(wrap + 500*time.Millisecond), 1<<32 - 500000, -time.Second},
+		{"Timestamp after the second wrap around", boot.Add(2*wrap - 500*time.Millisecond), 500000, time.Second},
+	} {
+		if actual := emissionTime(boot, tc.timestamp, tc.now).Sub(tc.now); actual != tc.expected {
+			t.Errorf("%s: expected emission in %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestNetworkTXMode(t *testing.T) {
+	if mode := networkTXMode(testDownlink(0)); mode != wrapper.TXModeImmediate {
+		t.Errorf("Expected Class C downlink to be immediate, got %s", mode)
+	}
+	if mode := networkTXMode(testDownlink(1)); mode != wrapper.TXModeTimestamped {
+		t.Errorf("Expected downlink to be timestamped, got %s", mode)
+	}
+}
+
+func TestScheduleModes(t *testing.T) {
+	d, q := testDownlinkManager(wrapper.TimeSyncLocked)
+	pps := time.Now().Truncate(time.Second).Add(3 * time.Second)
+
+	for _, tc := range []struct {
+		name    string
+		request TXRequest
+		reason  DownlinkErrorReason
+	}{
+		{"Immediate", TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeImmediate}, ""},
+		{"Immediate during the previous one", TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeImmediate}, DownlinkReasonCollision},
+		{"Timestamped", TXRequest{Message: testDownlink(timestampIn(d, time.Second)), Mode: wrapper.TXModeTimestamped}, ""},
+		{"Timestamped during the previous one", TXRequest{Message: testDownlink(timestampIn(d, time.Second+20*time.Millisecond)), Mode: wrapper.TXModeTimestamped}, DownlinkReasonCollision},
+		{"Timestamped within the send margin of the previous one", TXRequest{Message: testDownlink(timestampIn(d, time.Second-50*time.Millisecond)), Mode: wrapper.TXModeTimestamped}, DownlinkReasonCollision},
+		{"Timestamped after the previous one", TXRequest{Message: testDownlink(timestampIn(d, time.Second+200*time.Millisecond)), Mode: wrapper.TXModeTimestamped}, ""},
+		{"Timestamped in the past", TXRequest{Message: testDownlink(timestampIn(d, -time.Second)), Mode: wrapper.TXModeTimestamped}, DownlinkReasonTiming},
+		{"On GPS", TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeOnGPS, Time: pps}, ""},
+		{"On GPS outside of a PPS pulse", TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeOnGPS, Time: pps.Add(time.Second + time.Millisecond)}, DownlinkReasonTiming},
+		{"Timestamped within the send margin of the GPS downlink", TXRequest{Message: testDownlink(timestampIn(d, pps.Sub(time.Now())-300*time.Millisecond)), Mode: wrapper.TXModeTimestamped}, DownlinkReasonCollision},
+		{"Timestamped after the GPS downlink", TXRequest{Message: testDownlink(timestampIn(d, pps.Sub(time.Now())+200*time.Millisecond)), Mode: wrapper.TXModeTimestamped}, ""},
+	} {
+		checkDownlinkError(t, tc.name, d.Schedule(tc.request), tc.reason)
+	}
+	if len(q.scheduled) != 5 {
+		t.Fatalf("Expected 5 scheduled downlinks, got %d", len(q.scheduled))
+	}
+
+	immediate := q.scheduled[0]
+	if immediate.sendTime != immediate.emission || time.Now().Sub(immediate.emission) > time.Second {
+		t.Errorf("Expected immediate downlink to be sent now, got %v", immediate.sendTime)
+	}
+	timestamped := q.scheduled[1]
+	if margin := timestamped.emission.Sub(timestamped.sendTime); margin != testSendMargin {
+		t.Errorf("Expected timestamped downlink to be sent %v before its emission, got %v", testSendMargin, margin)
+	}
+	onGPS := q.scheduled[3]
+	if onGPS.emission != pps || onGPS.sendTime != pps.Add(-onGPSSendMargin) {
+		t.Errorf("Expected GPS downlink to be emitted at %v and sent %v before, got %v and %v", pps, onGPSSendMargin, onGPS.emission, onGPS.sendTime)
+	}
+}
+
+func TestScheduleOnGPSWithoutTimeReference(t *testing.T) {
+	for _, state := range []wrapper.TimeSyncState{wrapper.TimeSyncUnavailable, wrapper.TimeSyncLost} {
+		d, _ := testDownlinkManager(state)
+		pps := time.Now().Truncate(time.Second).Add(2 * time.Second)
+		err := d.Schedule(TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeOnGPS, Time: pps})
+		checkDownlinkError(t, state.String(), err, DownlinkReasonTiming)
+	}
+}
+
+func TestScheduleWithoutBootTime(t *testing.T) {
+	d, _ := testDownlinkManager(wrapper.TimeSyncLocked)
+	d.SetBootTime(time.Time{})
+	err := d.Schedule(TXRequest{Message: testDownlink(1000), Mode: wrapper.TXModeTimestamped})
+	checkDownlinkError(t, "Timestamped without boot time", err, DownlinkReasonTiming)
+	err = d.Schedule(TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeImmediate})
+	checkDownlinkError(t, "Immediate without boot time", err, "")
+}
+
+func TestReserveBeacon(t *testing.T) {
+	d, q := testDownlinkManager(wrapper.TimeSyncLocked)
+	beaconTime := time.Now().Truncate(time.Second).Add(5 * time.Second)
+	beacon := wrapper.BeaconPacket{Frequency: 869525000, SpreadingFactor: 9, Bandwidth: 125000, Power: 27, Payload: make([]byte, 17)}
+
+	guarded := TXRequest{Message: testDownlink(timestampIn(d, beaconTime.Sub(time.Now())-time.Second)), Mode: wrapper.TXModeTimestamped}
+	checkDownlinkError(t, "Downlink in the guard time before the beacon", d.Schedule(guarded), "")
+	checkDownlinkError(t, "Beacon", d.ScheduleBeacon(beacon, beaconTime), "")
+	checkDownlinkError(t, "Second beacon", d.ScheduleBeacon(beacon, beaconTime), DownlinkReasonCollision)
+	checkDownlinkError(t, "Beacon outside of a PPS pulse", d.ScheduleBeacon(beacon, beaconTime.Add(128*time.Second+time.Millisecond)), DownlinkReasonTiming)
+
+	reserved := TXRequest{Message: testDownlink(timestampIn(d, beaconTime.Sub(time.Now())+time.Second)), Mode: wrapper.TXModeTimestamped}
+	checkDownlinkError(t, "Downlink in the reserved time after the beacon", d.Schedule(reserved), DownlinkReasonCollision)
+	onGPS := TXRequest{Message: testDownlink(0), Mode: wrapper.TXModeOnGPS, Time: beaconTime.Add(-2 * time.Second)}
+	checkDownlinkError(t, "GPS downlink in the guard time before the beacon", d.Schedule(onGPS), DownlinkReasonCollision)
+	after := TXRequest{Message: testDownlink(timestampIn(d, beaconTime.Sub(time.Now())+3*time.Second)), Mode: wrapper.TXModeTimestamped}
+	checkDownlinkError(t, "Downlink after the beacon", d.Schedule(after), "")
+
+	if len(q.scheduled) != 3 {
+		t.Fatalf("Expected 3 scheduled entries, got %d", len(q.scheduled))
+	}
+	if !d.isCancelled(q.scheduled[0]) {
+		t.Error("Expected downlink in the guard time to be cancelled by the beacon")
+	}
+	if d.isCancelled(q.scheduled[1]) || d.isCancelled(q.scheduled[2]) {
+		t.Error("Expected beacon and downlink after the beacon not to be cancelled")
+	}
+	if sent := q.scheduled[1].beacon; sent == nil || sent.Power != 14 || sent.RFChain != 0 {
+		t.Errorf("Expected beacon on RF chain 0 lowered to 14 dBm, got %+v", sent)
+	}
+
+	// Once their TX window is over, the entries don't reserve the concentrator anymore
+	later := &scheduledDownlink{window: txWindow{start: beaconTime, end: beaconTime.Add(time.Second)}}
+	if err := d.reserve(later, beaconTime.Add(time.Hour)); err != nil {
+		t.Errorf("Expected expired entries to be dropped, got %v", err)
+	}
+	if len(d.scheduled) != 1 {
+		t.Errorf("Expected only the new entry to be reserved, got %d entries", len(d.scheduled))
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+// maxForwardedEvents is the maximal number of events forwarded with a status message. Older
+// events not forwarded yet are dropped.
+const maxForwardedEvents = 20
+
+// EventType is the type of a gateway event
+type EventType string
+
+// Gateway events
+const (
+	EventConcentratorStart    EventType = "concentrator-start"
+	EventConcentratorStop     EventType = "concentrator-stop"
+	EventBootTime             EventType = "boot-time"
+	EventRouterChange         EventType = "router-change"
+	EventTokenRefresh         EventType = "token-refresh"
+	EventGPSLock              EventType = "gps-lock"
+	EventGPSUnlock            EventType = "gps-unlock"
+	EventDownlinkRejected     EventType = "downlink-rejected"
+	EventTelemetryWarning     EventType = "telemetry-warning"
+	EventConcentratorRecovery EventType = "concentrator-recovery"
+)
+
+// EventTypes are all the types of gateway events
+var EventTypes = []EventType{
+	EventConcentratorStart,
+	EventConcentratorStop,
+	EventBootTime,
+	EventRouterChange,
+	EventTokenRefresh,
+	EventGPSLock,
+	EventGPSUnlock,
+	EventDownlinkRejected,
+	EventTelemetryWarning,
+	EventConcentratorRecovery,
+}
+
+// ParseEventType returns the event type named s
+func ParseEventType(s string) (EventType, error) {
+	for _, eventType := range EventTypes {
+		if string(eventType) == s {
+			return eventType, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown event type %s", s)
+}
+
+// Event is an entry of the event journal
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Type    EventType         `json:"type"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s %s", e.Time.Format(time.RFC3339), e.Type, e.Message)
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s += fmt.Sprintf(" %s=%s", name, e.Fields[name])
+	}
+	return s
+}
+
+// EventFilter selects events by time and type. Zero values don't filter.
+type EventFilter struct {
+	Since time.Time
+	Until time.Time
+	Types []EventType
+}
+
+// Match returns true if the event is selected by the filter
+func (f EventFilter) Match(e Event) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, eventType := range f.Types {
+		if e.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// EventJournal records the gateway events in a local file, one JSON object per line. When the
+// file holds twice the maximal number of events, it is compacted to keep the most recent ones. A
+// nil journal records nothing.
+type EventJournal struct {
+	ctx       log.Interface
+	mutex     sync.Mutex
+	path      string
+	maxEvents int
+	nbEvents  int
+	forward   bool
+	pending   []Event
+	// subscribers are notified of the events of their types
+	subscribers []eventSubscriber
+}
+
+type eventSubscriber struct {
+	filter EventFilter
+	events chan Event
+}
+
+// NewEventJournal opens the event journal stored at path. If path is empty, events are not
+// persisted. If forward is set, the events are kept until they are forwarded with a status message.
+func NewEventJournal(ctx log.Interface, path string, maxEvents int, forward bool) (*EventJournal, error) {
+	j := &EventJournal{
+		ctx:       ctx,
+		path:      path,
+		maxEvents: maxEvents,
+		forward:   forward,
+	}
+	if path == "" {
+		return j, nil
+	}
+	events, err := readEventFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't read event journal")
+	}
+	if err := terminateLastLine(path); err != nil {
+		return nil, errors.Wrap(err, "Couldn't repair event journal")
+	}
+	j.nbEvents = len(events)
+	return j, nil
+}
+
+// terminateLastLine ends the journal with a newline if its last line was interrupted, such as by a
+// power failure, so that the next events aren't appended to the interrupted line
+func terminateLastLine(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = f.Write([]byte{'\n'})
+	return err
+}
+
+// Subscribe returns a channel on which the events of the types are notified. If the subscriber
+// isn't ready, the events are dropped.
+func (j *EventJournal) Subscribe(types ...EventType) <-chan Event {
+	events := make(chan Event, 1)
+	if j == nil {
+		return events
+	}
+	j.mutex.Lock()
+	j.subscribers = append(j.subscribers, eventSubscriber{
+		filter: EventFilter{Types: types},
+		events: events,
+	})
+	j.mutex.Unlock()
+	return events
+}
+
+// Record adds an event to the journal. The fields are stored as strings.
+func (j *EventJournal) Record(eventType EventType, message string, fields log.Fields) {
+	if j == nil {
+		return
+	}
+	event := Event{
+		Time:    time.Now().UTC(),
+		Type:    eventType,
+		Message: message,
+	}
+	if len(fields) > 0 {
+		event.Fields = make(map[string]string, len(fields))
+		for name, value := range fields {
+			event.Fields[name] = fmt.Sprint(value)
+		}
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, subscriber := range j.subscribers {
+		if !subscriber.filter.Match(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default: // Subscriber not ready, the event is dropped
+		}
+	}
+	if j.forward {
+		j.pending = append(j.pending, event)
+		if len(j.pending) > maxForwardedEvents {
+			j.pending = j.pending[len(j.pending)-maxForwardedEvents:]
+		}
+	}
+	if j.path == "" {
+		return
+	}
+	if err := j.append(event); err != nil {
+		j.ctx.WithError(err).WithField("EventType", eventType).Warn("Couldn't record event in the event journal")
+	}
+}
+
+func (j *EventJournal) append(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	j.nbEvents++
+	if j.maxEvents > 0 && j.nbEvents >= 2*j.maxEvents {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact rewrites the journal with its most recent events
+func (j *EventJournal) compact() error {
+	events, err := readEventFile(j.path)
+	if err != nil {
+		return err
+	}
+	if len(events) > j.maxEvents {
+		events = events[len(events)-j.maxEvents:]
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(j.path), ".pktfwd-events")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	encoder := json.NewEncoder(f)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), j.path); err != nil {
+		return err
+	}
+	j.nbEvents = len(events)
+	return nil
+}
+
+// ForwardedMessages returns the events recorded since the last call, formatted to be forwarded
+// with a status message
+func (j *EventJournal) ForwardedMessages() []string {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if len(j.pending) == 0 {
+		return nil
+	}
+	messages := make([]string, len(j.pending))
+	for i, event := range j.pending {
+		messages[i] = event.String()
+	}
+	j.pending = nil
+	return messages
+}
+
+// readEventFile reads the events of a journal file. Invalid lines, such as a line interrupted by
+// a power failure, are ignored.
+func readEventFile(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// ReadEvents returns the events of the journal stored at path selected by the filter, in chronological order
+func ReadEvents(path string, filter EventFilter) ([]Event, error) {
+	events, err := readEventFile(path)
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]Event, 0, len(events))
+	for _, event := range events {
+		if filter.Match(event) {
+			selected = append(selected, event)
+		}
+	}
+	return selected, nil
+}
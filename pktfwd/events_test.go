@@ -0,0 +1,166 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+)
+
+func tempEventFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pktfwd-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "events.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func eventMessages(events []Event) []string {
+	messages := make([]string, len(events))
+	for i, event := range events {
+		messages[i] = event.Message
+	}
+	return messages
+}
+
+func TestEventFilterMatch(t *testing.T) {
+	start := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+	event := Event{Time: start, Type: EventGPSLock}
+	for _, tc := range []struct {
+		name     string
+		filter   EventFilter
+		expected bool
+	}{
+		{"No filter", EventFilter{}, true},
+		{"Since before", EventFilter{Since: start.Add(-time.Hour)}, true},
+		{"Since the event time", EventFilter{Since: start}, true},
+		{"Since after", EventFilter{Since: start.Add(time.Second)}, false},
+		{"Until after", EventFilter{Until: start.Add(time.Hour)}, true},
+		{"Until the event time", EventFilter{Until: start}, true},
+		{"Until before", EventFilter{Until: start.Add(-time.Second)}, false},
+		{"Matching type", EventFilter{Types: []EventType{EventGPSUnlock, EventGPSLock}}, true},
+		{"Other type", EventFilter{Types: []EventType{EventGPSUnlock}}, false},
+		{"Matching time and other type", EventFilter{Since: start.Add(-time.Hour), Types: []EventType{EventRouterChange}}, false},
+	} {
+		if actual := tc.filter.Match(event); actual != tc.expected {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestReadEventFileRecovery(t *testing.T) {
+	path, cleanup := tempEventFile(t)
+	defer cleanup()
+	content := `{"time":"2017-06-01T12:00:00Z","type":"gps-lock","message":"first"}
+
+not json
+{"time":"2017-06-01T12:01:00Z","type":"router-change","message":"second","fields":{"Router":"eu"}}
+{"time":"2017-06-01T12:02:00Z","type":"gps-unl`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	events, err := readEventFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := eventMessages(events); !reflect.DeepEqual(messages, []string{"first", "second"}) {
+		t.Fatalf("Expected the valid events to be read, got %v", messages)
+	}
+	if events[1].Type != EventRouterChange || events[1].Fields["Router"] != "eu" {
+		t.Errorf("Unexpected event %+v", events[1])
+	}
+
+	// Events recorded after a truncated line are read
+	j, err := NewEventJournal(log.Get(), path, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.nbEvents != 2 {
+		t.Errorf("Expected 2 events in the journal, got %d", j.nbEvents)
+	}
+	j.Record(EventGPSLock, "third", nil)
+	events, err = ReadEvents(path, EventFilter{Types: []EventType{EventGPSLock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := eventMessages(events); !reflect.DeepEqual(messages, []string{"first", "third"}) {
+		t.Errorf("Expected the GPS lock events, got %v", messages)
+	}
+}
+
+func TestEventJournalCompaction(t *testing.T) {
+	path, cleanup := tempEventFile(t)
+	defer cleanup()
+	j, err := NewEventJournal(log.Get(), path, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"1", "2", "3", "4", "5"} {
+		j.Record(EventRouterChange, message, log.Fields{"Index": message})
+	}
+	events, err := readEventFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 5 {
+		t.Fatalf("Expected no compaction under twice the maximal number of events, got %d events", len(events))
+	}
+
+	j.Record(EventRouterChange, "6", nil)
+	events, err = readEventFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := eventMessages(events); !reflect.DeepEqual(messages, []string{"4", "5", "6"}) {
+		t.Errorf("Expected the journal to be compacted to the most recent events, got %v", messages)
+	}
+	if j.nbEvents != 3 {
+		t.Errorf("Expected 3 events in the journal after compaction, got %d", j.nbEvents)
+	}
+	if events[0].Fields["Index"] != "4" {
+		t.Errorf("Expected the fields to be kept by the compaction, got %v", events[0].Fields)
+	}
+	if temp, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".pktfwd-events*")); len(temp) != 0 {
+		t.Errorf("Expected no temporary file left, got %v", temp)
+	}
+}
+
+func TestEventJournalForwarding(t *testing.T) {
+	j, err := NewEventJournal(log.Get(), "", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := j.Subscribe(EventGPSLock)
+	for i := 0; i < maxForwardedEvents+5; i++ {
+		j.Record(EventTelemetryWarning, "warning", nil)
+	}
+	j.Record(EventGPSLock, "lock", nil)
+
+	messages := j.ForwardedMessages()
+	if len(messages) != maxForwardedEvents {
+		t.Errorf("Expected %d forwarded events, got %d", maxForwardedEvents, len(messages))
+	}
+	if messages := j.ForwardedMessages(); len(messages) != 0 {
+		t.Errorf("Expected events to be forwarded once, got %v", messages)
+	}
+	select {
+	case event := <-locks:
+		if event.Type != EventGPSLock {
+			t.Errorf("Expected a GPS lock event, got %s", event.Type)
+		}
+	default:
+		t.Error("Expected the subscriber to be notified")
+	}
+
+	var nilJournal *EventJournal
+	nilJournal.Record(EventGPSLock, "lock", nil)
+	if messages := nilJournal.ForwardedMessages(); messages != nil {
+		t.Errorf("Expected no event from a nil journal, got %v", messages)
+	}
+}
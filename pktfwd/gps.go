@@ -3,7 +3,15 @@
 package pktfwd
 
 import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+
 	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/gnss"
+	"github.com/TheThingsNetwork/packet_forwarder/gpsd"
 	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
 	"github.com/pkg/errors"
 )
@@ -14,19 +22,254 @@ import (
 	- if nothing available or set, get the coordinates from account server and use that in the status message
 */
 
+const (
+	gpsdDialTimeout       = 5 * time.Second
+	gpsdReconnectionDelay = 5 * time.Second
+)
+
+// GPSState holds the last fix of the GPS, shared between the GPS routine and the status manager
+type GPSState struct {
+	mutex  sync.Mutex
+	fix    gnss.Fix
+	events *EventJournal
+}
+
+// Fix returns the last fix of the GPS
+func (g *GPSState) Fix() gnss.Fix {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.fix
+}
+
+// apply updates the fix with a message from the GPS, and returns true if it carried a valid position
+func (g *GPSState) apply(m gnss.Message) (gnss.Fix, bool) {
+	g.mutex.Lock()
+	wasValid := g.fix.Valid
+	ok := g.fix.Update(m)
+	fix := g.fix
+	g.mutex.Unlock()
+	g.recordLockChange(wasValid, fix)
+	return fix, ok
+}
+
+func (g *GPSState) set(update func(fix *gnss.Fix)) {
+	g.mutex.Lock()
+	wasValid := g.fix.Valid
+	update(&g.fix)
+	fix := g.fix
+	g.mutex.Unlock()
+	g.recordLockChange(wasValid, fix)
+}
+
+// recordLockChange records an event when the GPS gets or loses a valid fix
+func (g *GPSState) recordLockChange(wasValid bool, fix gnss.Fix) {
+	switch {
+	case fix.Valid && !wasValid:
+		g.events.Record(EventGPSLock, "GPS fix acquired", log.Fields{"Quality": fix.Quality, "SatellitesUsed": fix.SatellitesUsed})
+	case !fix.Valid && wasValid:
+		g.events.Record(EventGPSUnlock, "GPS fix lost", nil)
+	}
+}
+
 // enableGPS checks if there is an available GPS for this build - if yes,
-// tries to activate it.
-func enableGPS(ctx log.Interface, gpsPath string) (err error) {
-	if gpsPath == "" {
+// tries to activate it. The GPS source is either the TTY path of the GPS,
+// or the address of a gpsd daemon (gpsd://host:port).
+func enableGPS(ctx log.Interface, gpsSource string) (err error) {
+	if gpsSource == "" {
 		ctx.Warn("No GPS chip configured, ignoring")
 		return nil
 	}
 
-	ctx.WithField("GPSPath", gpsPath).Info("GPS path found, activating")
-	err = wrapper.LoRaGPSEnable(gpsPath)
+	if gpsd.IsSource(gpsSource) {
+		if _, err := gpsd.Address(gpsSource); err != nil {
+			return errors.Wrap(err, "GPS activation failed")
+		}
+		ctx.WithField("GPSSource", gpsSource).Info("gpsd source found, activating")
+		wrapper.EnableExternalGPS()
+		return nil
+	}
+
+	ctx.WithField("GPSPath", gpsSource).Info("GPS path found, activating")
+	err = wrapper.LoRaGPSEnable(gpsSource)
 	if err != nil {
 		return errors.Wrap(err, "GPS activation failed")
 	}
 
 	return nil
 }
+
+// syncGPSTime synchronises the concentrator time reference on a PPS time, unless it was already
+// done for that PPS pulse. It returns the time of the last synchronisation. concentratorLock is held
+// while the concentrator counter is read, so that the synchronisation waits for the end of a
+// concentrator recovery.
+func syncGPSTime(ctx log.Interface, concentratorLock sync.Locker, pps, lastSync time.Time) time.Time {
+	if pps.Equal(lastSync) {
+		return lastSync
+	}
+	concentratorLock.Lock()
+	err := wrapper.SyncGPSTime(ctx, pps)
+	concentratorLock.Unlock()
+	if err != nil {
+		return lastSync
+	}
+	return pps
+}
+
+func updateGPSCoordinates(ctx log.Interface, fix gnss.Fix) {
+	wrapper.SetGPSCoordinates(wrapper.GPSCoordinates{
+		Latitude:  fix.Latitude,
+		Longitude: fix.Longitude,
+		Altitude:  fix.Altitude,
+	})
+	ctx.WithFields(log.Fields{"Altitude": fix.Altitude, "Latitude": fix.Latitude, "Longitude": fix.Longitude}).Debug("GPS coordinates updated")
+}
+
+// watchGPSInterface parses the data stream of the GPS interface until a read error occurs or the
+// context is done. The GPS interface is closed when the context is done, if it can be.
+func watchGPSInterface(bgCtx context.Context, ctx log.Interface, gpsInterface io.Reader, state *GPSState, concentratorLock sync.Locker) error {
+	if closer, ok := gpsInterface.(io.Closer); ok {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-bgCtx.Done():
+				// Unblocks the pending read, if any
+				closer.Close()
+			case <-done:
+			}
+		}()
+	}
+
+	scanner := gnss.NewScanner(gpsInterface)
+	var lastSync time.Time
+	for {
+		select {
+		case <-bgCtx.Done():
+			return nil
+		default:
+		}
+
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				if bgCtx.Err() != nil {
+					return nil
+				}
+				return errors.Wrap(err, "GPS interface read error")
+			}
+			// No data available on the interface for now
+			time.Sleep(gpsUpdateRate)
+			continue
+		}
+
+		msg := scanner.Message()
+		if pps, ok := gnss.PPSTime(msg); ok {
+			lastSync = syncGPSTime(ctx, concentratorLock, pps, lastSync)
+		}
+		if fix, ok := state.apply(msg); ok {
+			updateGPSCoordinates(ctx, fix)
+		}
+	}
+}
+
+var gpsdQuality = map[int]gnss.FixQuality{
+	gpsd.StatusUnknown:  gnss.QualityGPS,
+	gpsd.StatusNormal:   gnss.QualityGPS,
+	gpsd.StatusDGPS:     gnss.QualityDGPS,
+	gpsd.StatusRTKFixed: gnss.QualityRTK,
+	gpsd.StatusRTKFloat: gnss.QualityFloatRTK,
+	gpsd.StatusDR:       gnss.QualityEstimated,
+}
+
+// handleGPSDReport feeds the wrapper and the GPS state with the time and position of a gpsd report.
+// lastSync is the time of the last time synchronisation, and is returned updated.
+func handleGPSDReport(ctx log.Interface, report gpsd.Report, state *GPSState, concentratorLock sync.Locker, lastSync time.Time) time.Time {
+	if sky := report.SKY; sky != nil {
+		state.set(func(fix *gnss.Fix) {
+			fix.SatellitesInView = len(sky.Satellites)
+			fix.SatellitesUsed = 0
+			for _, satellite := range sky.Satellites {
+				if satellite.Used {
+					fix.SatellitesUsed++
+				}
+			}
+			if sky.HDOP != 0 {
+				fix.HDOP = sky.HDOP
+			}
+		})
+		return lastSync
+	}
+
+	tpv := report.TPV
+	if tpv == nil {
+		return lastSync
+	}
+	if tpv.Mode < gpsd.Mode2D {
+		state.set(func(fix *gnss.Fix) {
+			fix.Mode = gnss.FixMode(tpv.Mode)
+			fix.Quality = gnss.QualityInvalid
+			fix.Valid = false
+		})
+		return lastSync
+	}
+
+	utc, err := tpv.UTC()
+	if err != nil {
+		ctx.WithError(err).Debug("Couldn't get UTC time from gpsd report")
+	} else {
+		// The concentrator counter is latched on the PPS pulse, at the start of the second of the fix
+		lastSync = syncGPSTime(ctx, concentratorLock, utc.Truncate(time.Second), lastSync)
+	}
+
+	var fix gnss.Fix
+	state.set(func(f *gnss.Fix) {
+		f.Time = utc
+		f.Valid = true
+		f.Mode = gnss.FixMode(tpv.Mode)
+		f.Quality = gnss.QualityGPS
+		if quality, ok := gpsdQuality[tpv.Status]; ok {
+			f.Quality = quality
+		}
+		f.Latitude = tpv.Lat
+		f.Longitude = tpv.Lon
+		if tpv.Mode == gpsd.Mode3D {
+			f.Altitude = tpv.Alt
+		}
+		f.HorizontalAccuracy = math.Max(tpv.Epx, tpv.Epy)
+		f.VerticalAccuracy = tpv.Epv
+		fix = *f
+	})
+	updateGPSCoordinates(ctx, fix)
+	return lastSync
+}
+
+// watchGPSD reads the reports of the gpsd daemon until the connection fails or the context is done
+func watchGPSD(bgCtx context.Context, ctx log.Interface, address string, state *GPSState, concentratorLock sync.Locker) error {
+	client, err := gpsd.Dial(address, gpsdDialTimeout)
+	if err != nil {
+		return err
+	}
+	ctx.WithField("Address", address).Info("Connected to gpsd")
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-bgCtx.Done():
+		case <-done:
+		}
+		// Unblocks the pending read, if any
+		client.Close()
+	}()
+
+	var lastSync time.Time
+	for {
+		report, err := client.Next()
+		if err != nil {
+			if bgCtx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		lastSync = handleGPSDReport(ctx, report, state, concentratorLock, lastSync)
+	}
+}
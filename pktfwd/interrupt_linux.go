@@ -0,0 +1,98 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sysfsGPIO = "/sys/class/gpio"
+	// interruptWaitTimeout is the maximal time the interrupt routine waits before checking the context
+	interruptWaitTimeout = 100 * time.Millisecond
+	// gpioExportDelay leaves the time to udev to set the permissions of an exported pin
+	gpioExportDelay = 100 * time.Millisecond
+)
+
+// watchInterruptPin configures the pin as an input raising an interrupt on a rising edge, and
+// signals the interrupts on the returned channel until the context is done
+func watchInterruptPin(bgCtx context.Context, pin int) (<-chan struct{}, error) {
+	pinDir := filepath.Join(sysfsGPIO, fmt.Sprintf("gpio%d", pin))
+	if _, err := os.Stat(pinDir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(filepath.Join(sysfsGPIO, "export"), []byte(strconv.Itoa(pin)), 0200); err != nil {
+			return nil, errors.Wrap(err, "Couldn't export GPIO pin")
+		}
+		time.Sleep(gpioExportDelay)
+	}
+	if err := ioutil.WriteFile(filepath.Join(pinDir, "direction"), []byte("in"), 0644); err != nil {
+		return nil, errors.Wrap(err, "Couldn't set GPIO pin as input")
+	}
+	if err := ioutil.WriteFile(filepath.Join(pinDir, "edge"), []byte("rising"), 0644); err != nil {
+		return nil, errors.Wrap(err, "Couldn't enable GPIO pin interrupts")
+	}
+
+	value, err := os.Open(filepath.Join(pinDir, "value"))
+	if err != nil {
+		return nil, err
+	}
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		value.Close()
+		return nil, err
+	}
+	// sysfs signals the edges with POLLPRI
+	event := syscall.EpollEvent{Events: syscall.EPOLLPRI | syscall.EPOLLERR, Fd: int32(value.Fd())}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, int(value.Fd()), &event); err != nil {
+		syscall.Close(epfd)
+		value.Close()
+		return nil, err
+	}
+
+	interrupts := make(chan struct{}, 1)
+	go func() {
+		defer value.Close()
+		defer syscall.Close(epfd)
+		events := make([]syscall.EpollEvent, 1)
+		buf := make([]byte, 2)
+		for {
+			select {
+			case <-bgCtx.Done():
+				return
+			default:
+			}
+			n, err := syscall.EpollWait(epfd, events, int(interruptWaitTimeout/time.Millisecond))
+			if err != nil && err != syscall.EINTR {
+				return
+			}
+			if n <= 0 {
+				continue
+			}
+			// Reading the value acknowledges the interrupt
+			value.Seek(0, 0)
+			value.Read(buf)
+			select {
+			case interrupts <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return interrupts, nil
+}
+
+// processCPUTime returns the user and system CPU time consumed by the process
+func processCPUTime() (time.Duration, error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, err
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), nil
+}
@@ -0,0 +1,20 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// +build !linux
+
+package pktfwd
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func watchInterruptPin(bgCtx context.Context, pin int) (<-chan struct{}, error) {
+	return nil, errors.New("GPIO interrupts are only supported on Linux")
+}
+
+func processCPUTime() (time.Duration, error) {
+	return 0, errors.New("CPU time measurement is only supported on Linux")
+}
@@ -0,0 +1,209 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/TheThingsNetwork/go-account-lib/account"
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/gnss"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/TheThingsNetwork/ttn/api/gateway"
+)
+
+// LocationSource designates where the location of the gateway comes from
+type LocationSource string
+
+// Location sources
+const (
+	LocationSourceStatic        LocationSource = "static"
+	LocationSourceGPS           LocationSource = "gps"
+	LocationSourceAccountServer LocationSource = "account-server"
+)
+
+// DefaultLocationPriority is the order in which the location sources are used, if none is specified
+var DefaultLocationPriority = []LocationSource{LocationSourceStatic, LocationSourceGPS, LocationSourceAccountServer}
+
+// ParseLocationPriority parses a comma-separated list of location sources, from the most to the
+// least preferred (example: static,gps,account-server)
+func ParseLocationPriority(s string) ([]LocationSource, error) {
+	var priority []LocationSource
+	for _, field := range strings.Split(s, ",") {
+		source := LocationSource(strings.TrimSpace(field))
+		switch source {
+		case LocationSourceStatic, LocationSourceGPS, LocationSourceAccountServer:
+		default:
+			return nil, fmt.Errorf("Unknown location source %s", field)
+		}
+		for _, existing := range priority {
+			if existing == source {
+				return nil, fmt.Errorf("Location source %s specified twice", source)
+			}
+		}
+		priority = append(priority, source)
+	}
+	return priority, nil
+}
+
+// LocationConfig is the configuration of the location of the gateway
+type LocationConfig struct {
+	// Static location of the antenna - nil if not configured
+	Static *wrapper.GPSCoordinates
+	// Minimal quality of a GPS fix for its position to be used
+	MinFixQuality gnss.FixQuality
+	// Maximal estimated horizontal error of a GPS fix for its position to be used, in meters - 0 for no limit
+	MaxHorizontalAccuracy float64
+	// Location sources, from the most to the least preferred - DefaultLocationPriority if empty
+	Priority []LocationSource
+}
+
+// Location is the location of the gateway, as given by one of the location sources
+type Location struct {
+	Source    LocationSource
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+	Accuracy  float64 // Estimated horizontal error, in meters - 0 if unknown
+}
+
+// Metadata returns the location in the format of the TTN back-end, with the given time
+func (l Location) Metadata(time int64) *gateway.GPSMetadata {
+	return &gateway.GPSMetadata{
+		Time:      time,
+		Latitude:  float32(l.Latitude),
+		Longitude: float32(l.Longitude),
+		Altitude:  int32(l.Altitude),
+	}
+}
+
+// Message returns the source and the accuracy of the location, formatted as a status message, as
+// the GPS metadata has no field for them
+func (l Location) Message() string {
+	message := fmt.Sprintf("location source=%s", l.Source)
+	if l.Accuracy > 0 {
+		message += fmt.Sprintf(" accuracy=%.1f", l.Accuracy)
+	}
+	return message
+}
+
+// LocationResolver selects the location of the gateway among the available location sources
+type LocationResolver struct {
+	ctx             log.Interface
+	conf            LocationConfig
+	gps             *GPSState
+	antennaLocation *account.AntennaLocation
+
+	mutex      sync.Mutex
+	lastSource LocationSource
+}
+
+// NewLocationResolver returns a LocationResolver. gps and antennaLocation are nil if these
+// sources are unavailable.
+func NewLocationResolver(ctx log.Interface, conf LocationConfig, gps *GPSState, antennaLocation *account.AntennaLocation) *LocationResolver {
+	if len(conf.Priority) == 0 {
+		conf.Priority = DefaultLocationPriority
+	}
+	if antennaLocation == nil {
+		ctx.Warn("Antenna location unavailable from the account server")
+	}
+	if conf.Static != nil {
+		ctx.WithFields(log.Fields{
+			"Latitude":  conf.Static.Latitude,
+			"Longitude": conf.Static.Longitude,
+			"Altitude":  conf.Static.Altitude,
+		}).Info("Static location configured")
+	}
+	return &LocationResolver{
+		ctx:             ctx,
+		conf:            conf,
+		gps:             gps,
+		antennaLocation: antennaLocation,
+	}
+}
+
+// Location returns the location given by the most preferred source available, and false if no
+// source is available
+func (r *LocationResolver) Location() (Location, bool) {
+	for _, source := range r.conf.Priority {
+		var location Location
+		var ok bool
+		switch source {
+		case LocationSourceStatic:
+			location, ok = r.staticLocation()
+		case LocationSourceGPS:
+			location, ok = r.gpsLocation()
+		case LocationSourceAccountServer:
+			location, ok = r.accountServerLocation()
+		}
+		if ok {
+			location.Source = source
+			r.sourceUsed(source)
+			return location, true
+		}
+	}
+	r.sourceUsed("")
+	return Location{}, false
+}
+
+// sourceUsed logs the changes of location source
+func (r *LocationResolver) sourceUsed(source LocationSource) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if source == r.lastSource {
+		return
+	}
+	if source == "" {
+		r.ctx.WithField("PreviousSource", r.lastSource).Warn("No location source available")
+	} else {
+		r.ctx.WithFields(log.Fields{"Source": source, "PreviousSource": r.lastSource}).Info("Location source changed")
+	}
+	r.lastSource = source
+}
+
+func (r *LocationResolver) staticLocation() (Location, bool) {
+	if r.conf.Static == nil {
+		return Location{}, false
+	}
+	return Location{
+		Latitude:  r.conf.Static.Latitude,
+		Longitude: r.conf.Static.Longitude,
+		Altitude:  r.conf.Static.Altitude,
+	}, true
+}
+
+func (r *LocationResolver) gpsLocation() (Location, bool) {
+	if r.gps == nil {
+		return Location{}, false
+	}
+	fix := r.gps.Fix()
+	if !fix.Valid || !fix.Quality.AtLeast(r.conf.MinFixQuality) {
+		return Location{}, false
+	}
+	if r.conf.MaxHorizontalAccuracy > 0 && (fix.HorizontalAccuracy == 0 || fix.HorizontalAccuracy > r.conf.MaxHorizontalAccuracy) {
+		// Unknown accuracy can't be checked against the threshold
+		return Location{}, false
+	}
+	return Location{
+		Latitude:  fix.Latitude,
+		Longitude: fix.Longitude,
+		Altitude:  fix.Altitude,
+		Accuracy:  fix.HorizontalAccuracy,
+	}, true
+}
+
+func (r *LocationResolver) accountServerLocation() (Location, bool) {
+	if r.antennaLocation == nil || r.antennaLocation.Latitude == nil || r.antennaLocation.Longitude == nil {
+		return Location{}, false
+	}
+	location := Location{
+		Latitude:  *r.antennaLocation.Latitude,
+		Longitude: *r.antennaLocation.Longitude,
+	}
+	if r.antennaLocation.Altitude != nil {
+		location.Altitude = float64(*r.antennaLocation.Altitude)
+	}
+	return location, true
+}
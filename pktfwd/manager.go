@@ -6,57 +6,136 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/classb"
+	"github.com/TheThingsNetwork/packet_forwarder/gpsd"
 	"github.com/TheThingsNetwork/packet_forwarder/util"
 	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
 	"github.com/pkg/errors"
 )
 
 const (
-	initUplinkPollingRate   = 100 * time.Microsecond
-	stableUplinkPollingRate = 5 * time.Millisecond
-	statusRoutineSleepRate  = 15 * time.Second
-	gpsUpdateRate           = 5 * time.Millisecond
+	gpsUpdateRate = 5 * time.Millisecond
+	// minStatusSpacing is the minimal time between two status messages sent after gateway events
+	minStatusSpacing = time.Second
 )
 
+// Default intervals of the status messages and of the router health checks
+const (
+	DefaultStatusInterval      = 15 * time.Second
+	DefaultHealthCheckInterval = 15 * time.Second
+)
+
+// statusTriggerEvents are the gateway events after which a status message is sent immediately
+var statusTriggerEvents = []EventType{EventGPSLock, EventGPSUnlock, EventRouterChange, EventConcentratorRecovery}
+
 /* Manager struct manages the routines during runtime, once the gateways and network
 configuration have been set up. It startes a routine, that it only stopped when the
 users wants to close the program or that an error occurs. */
 type Manager struct {
-	ctx               log.Interface
-	conf              util.Config
-	netClient         NetworkClient
-	statusMgr         StatusManager
-	uplinkPollingRate time.Duration
+	ctx       log.Interface
+	conf      util.Config
+	resetPin  int
+	netClient NetworkClient
+	statusMgr StatusManager
+	stats     *TrafficStats
+	telemetry *Telemetry
+	poller    *uplinkPoller
+	// watchdog is only accessed by the uplink routine - nil if disabled
+	watchdog *watchdog
+	// concentratorLock is held for writing during a concentrator recovery, and for reading by the
+	// other routines using the concentrator
+	concentratorLock *sync.RWMutex
 	// Concentrator boot time
 	bootTimeSetters     multipleBootTimeSetter
 	foundBootTime       bool
 	isGPS               bool
+	gpsSource           string
+	gps                 *GPSState
+	location            *LocationResolver
 	ignoreCRC           bool
+	systemTimeFallback  bool
+	beacon              BeaconConfig
 	downlinksSendMargin time.Duration
+	events              *EventJournal
+	metricsAddress      string
+	statusInterval      time.Duration
+	healthCheckInterval time.Duration
+	// rtt is the round-trip time to the router measured by the last health check, in nanoseconds
+	rtt int64
 }
 
-func NewManager(ctx log.Interface, conf util.Config, netClient NetworkClient, gpsPath string, runConfig TTNConfig) Manager {
-	isGPS := gpsPath != ""
-	statusMgr := NewStatusManager(ctx, netClient.FrequencyPlan(), runConfig.GatewayDescription, isGPS, netClient.DefaultLocation())
+func NewManager(ctx log.Interface, conf util.Config, netClient NetworkClient, gpsSource string, runConfig TTNConfig, events *EventJournal) Manager {
+	isGPS := gpsSource != ""
+	var gps *GPSState
+	if isGPS {
+		gps = &GPSState{events: events}
+	}
+	location := NewLocationResolver(ctx, runConfig.Location, gps, netClient.DefaultLocation())
+	lbtEnabled := conf.Concentrator.LbtConfig != nil && conf.Concentrator.LbtConfig.Enabled
+	stats := NewTrafficStats(runConfig.StatsWindows, conf.Concentrator.ChannelFrequencies())
+	statusCtx := util.WithComponent(ctx, util.StatusComponent)
+	concentratorLock := &sync.RWMutex{}
+	telemetry := NewTelemetry(statusCtx, DefaultTelemetrySources(concentratorLock.RLocker()), runConfig.Telemetry, events)
+	info := GatewayInfo{
+		Description:       runConfig.GatewayDescription,
+		FrequencyPlan:     netClient.FrequencyPlan(),
+		FrequencyPlanHash: frequencyPlanHash(conf),
+		HALVersion:        wrapper.LoRaGatewayVersionInfo(),
+		Version:           runConfig.Version,
+		Commit:            runConfig.Commit,
+	}
+	statusMgr := NewStatusManager(statusCtx, info, gps, location, lbtEnabled, stats, telemetry)
+
+	// At the beginning, until we get our first uplinks, we keep a high polling rate to the concentrator
+	poller := newUplinkPoller(runConfig.Polling)
+	poller.setLowLatency(true)
 
 	bootTimeSetters := NewMultipleBootTimeSetter()
 	bootTimeSetters.Add(statusMgr)
 
+	var concentratorWatchdog *watchdog
+	if runConfig.Watchdog.Enabled {
+		concentratorWatchdog = newWatchdog(runConfig.Watchdog, time.Now())
+	}
+
+	statusInterval, healthCheckInterval := runConfig.StatusInterval, runConfig.HealthCheckInterval
+	if statusInterval <= 0 {
+		statusInterval = DefaultStatusInterval
+	}
+	if healthCheckInterval <= 0 {
+		healthCheckInterval = DefaultHealthCheckInterval
+	}
+
 	return Manager{
-		ctx:             ctx,
-		conf:            conf,
-		netClient:       netClient,
-		statusMgr:       statusMgr,
-		bootTimeSetters: bootTimeSetters,
-		isGPS:           isGPS,
-		// At the beginning, until we get our first uplinks, we keep a high polling rate to the concentrator
-		uplinkPollingRate:   initUplinkPollingRate,
+		ctx:                 ctx,
+		conf:                conf,
+		resetPin:            runConfig.ResetPin,
+		netClient:           netClient,
+		statusMgr:           statusMgr,
+		stats:               stats,
+		telemetry:           telemetry,
+		bootTimeSetters:     bootTimeSetters,
+		isGPS:               isGPS,
+		gpsSource:           gpsSource,
+		gps:                 gps,
+		location:            location,
+		poller:              poller,
+		watchdog:            concentratorWatchdog,
+		concentratorLock:    concentratorLock,
 		downlinksSendMargin: runConfig.DownlinksSendMargin,
 		ignoreCRC:           runConfig.IgnoreCRC,
+		systemTimeFallback:  runConfig.SystemTimeFallback,
+		beacon:              runConfig.Beacon,
+		events:              events,
+		metricsAddress:      runConfig.MetricsAddress,
+		statusInterval:      statusInterval,
+		healthCheckInterval: healthCheckInterval,
 	}
 }
 
@@ -67,8 +146,10 @@ func (m *Manager) run() error {
 	if err != nil {
 		return err
 	}
+	m.readBootTime(m.ctx)
 
 	m.ctx.WithField("DateTime", time.Now()).Info("Concentrator started, packets can now be received and sent")
+	m.events.Record(EventConcentratorStart, "Concentrator started", nil)
 	err = m.handler(runStart)
 	if shutdownErr := m.shutdown(); shutdownErr != nil {
 		m.ctx.WithError(shutdownErr).Error("Couldn't stop concentrator gracefully")
@@ -99,6 +180,19 @@ func (m *Manager) handler(runStart time.Time) (err error) {
 	return err
 }
 
+// readBootTime sets the boot time of the concentrator if its counter can be read from the HAL.
+// Otherwise, the boot time is estimated from the first packets received.
+func (m *Manager) readBootTime(ctx log.Interface) {
+	counter, err := wrapper.GetInstantCounter()
+	if err != nil {
+		return
+	}
+	bootTime := time.Now().Add(-time.Duration(counter) * time.Microsecond)
+	ctx.WithField("BootTime", bootTime).Info("Read concentrator boot time")
+	m.events.Record(EventBootTime, "Read concentrator boot time", log.Fields{"BootTime": bootTime})
+	m.setBootTime(bootTime)
+}
+
 func (m *Manager) findConcentratorBootTime(packets []wrapper.Packet, runStart time.Time) error {
 	currentTime := time.Now()
 	highestTimestamp := uint32(0)
@@ -119,6 +213,7 @@ func (m *Manager) findConcentratorBootTime(packets []wrapper.Packet, runStart ti
 		return errors.New("Absurd uptime received by concentrator")
 	}
 	m.ctx.WithField("BootTime", bootTime).Info("Determined concentrator boot time")
+	m.events.Record(EventBootTime, "Determined concentrator boot time", log.Fields{"BootTime": bootTime})
 	m.setBootTime(bootTime)
 	return nil
 }
@@ -126,52 +221,77 @@ func (m *Manager) findConcentratorBootTime(packets []wrapper.Packet, runStart ti
 func (m *Manager) setBootTime(bootTime time.Time) {
 	m.bootTimeSetters.SetBootTime(bootTime)
 	m.foundBootTime = true
-	m.uplinkPollingRate = stableUplinkPollingRate
+	m.poller.setLowLatency(false)
 }
 
 func (m *Manager) uplinkRoutine(bgCtx context.Context, runStart time.Time) chan error {
 	errC := make(chan error)
+	ctx := util.WithComponent(m.ctx, util.UplinkComponent)
+	m.poller.watchInterrupt(bgCtx, ctx)
 	go func() {
-		m.ctx.Info("Waiting for uplink packets")
+		ctx.Info("Waiting for uplink packets")
 		defer close(errC)
 		for {
-			packets, err := wrapper.Receive()
+			if err := m.watchConcentrator(ctx); err != nil {
+				errC <- errors.Wrap(err, "Concentrator watchdog error")
+				return
+			}
+			packets, err := m.poller.receive()
 			if err != nil {
 				errC <- errors.Wrap(err, "Uplink packets retrieval error")
 				return
 			}
-			if len(packets) == 0 { // Empty payload => we sleep, then reiterate.
-				time.Sleep(m.uplinkPollingRate)
+			if m.watchdog != nil {
+				m.watchdog.received(packets, time.Now())
+			}
+			if len(packets) == 0 { // Empty payload => we wait, then reiterate.
+				if !m.poller.wait(bgCtx) {
+					errC <- nil
+					return
+				}
 				continue
 			}
+			if m.systemTimeFallback {
+				setSystemTime(packets, time.Now())
+			}
 
-			m.ctx.WithField("NbPackets", len(packets)).Info("Received uplink packets")
+			ctx.WithField("NbPackets", len(packets)).Info("Received uplink packets")
 			if !m.foundBootTime {
 				// First packets received => find concentrator boot time
 				err = m.findConcentratorBootTime(packets, runStart)
 				if err != nil {
-					m.ctx.WithError(err).Warn("Error when computing concentrator boot time - using packet forwarder run start time")
+					ctx.WithError(err).Warn("Error when computing concentrator boot time - using packet forwarder run start time")
 					m.setBootTime(runStart)
 				}
 			}
 
-			validPackets := wrapUplinkPayload(m.ctx, packets, m.ignoreCRC, m.netClient.GatewayID())
-			m.statusMgr.HandledRXBatch(len(validPackets), len(packets))
+			var location *Location
+			if l, ok := m.location.Location(); ok {
+				location = &l
+			}
+			validPackets := wrapUplinkPayload(ctx, packets, m.ignoreCRC, m.netClient.GatewayID(), location)
+			m.statusMgr.HandledRXBatch(len(packets), len(validPackets))
+			m.statusMgr.RecordUplinks(packets)
 			if len(validPackets) == 0 {
 				// Packets received, but with invalid CRC - ignoring
-				time.Sleep(m.uplinkPollingRate)
+				if !m.poller.wait(bgCtx) {
+					errC <- nil
+					return
+				}
 				continue
 			}
 
-			m.ctx.WithField("NbValidPackets", len(validPackets)).Info("Sending valid uplink packets")
-			m.netClient.SendUplinks(validPackets)
+			ctx.WithField("NbValidPackets", len(validPackets)).Info("Sending valid uplink packets")
+			// Queuing never blocks, so that the concentrator keeps being polled when the network is slow
+			if backpressure := m.netClient.SendUplinks(validPackets); backpressure.Dropped > 0 {
+				ctx.WithField("NbDropped", backpressure.Dropped).Warn("Uplink queues full, uplinks dropped")
+			} else if backpressure.Congested {
+				ctx.Warn("Uplink queues congested, the network connection is too slow")
+			}
 
-			select {
-			case <-bgCtx.Done():
+			if !m.poller.wait(bgCtx) {
 				errC <- nil
 				return
-			default:
-				continue
 			}
 		}
 	}()
@@ -179,68 +299,176 @@ func (m *Manager) uplinkRoutine(bgCtx context.Context, runStart time.Time) chan
 }
 
 func (m *Manager) gpsRoutine(bgCtx context.Context) chan error {
+	if gpsd.IsSource(m.gpsSource) {
+		return m.gpsdRoutine(bgCtx)
+	}
+
 	errC := make(chan error)
+	ctx := util.WithComponent(m.ctx, util.GPSComponent)
 	go func() {
-		m.ctx.Info("Starting GPS update routine")
+		ctx.Info("Starting GPS update routine")
 		defer close(errC)
+		gpsInterface, err := wrapper.GPSInterface()
+		if err != nil {
+			errC <- err
+			return
+		}
+		// The GPS time reference and coordinates are updated as soon as the GPS sends them
+		if err := watchGPSInterface(bgCtx, ctx, gpsInterface, m.gps, m.concentratorLock.RLocker()); err != nil {
+			errC <- errors.Wrap(err, "GPS update error")
+		}
+	}()
+	return errC
+}
+
+func (m *Manager) gpsdRoutine(bgCtx context.Context) chan error {
+	errC := make(chan error)
+	ctx := util.WithComponent(m.ctx, util.GPSComponent)
+	go func() {
+		defer close(errC)
+		address, err := gpsd.Address(m.gpsSource)
+		if err != nil {
+			errC <- err
+			return
+		}
+		ctx.WithField("Address", address).Info("Starting gpsd update routine")
 		for {
+			// The gpsd connection is shared with other programs, and can be restarted independently
+			// of the packet forwarder: connection failures are not fatal
+			if err := watchGPSD(bgCtx, ctx, address, m.gps, m.concentratorLock.RLocker()); err != nil {
+				ctx.WithError(err).Warn("gpsd connection lost, reconnecting")
+			}
 			select {
 			case <-bgCtx.Done():
 				return
-			default:
-				// The GPS time reference and coordinates are updated at `gpsUpdateRate`
-				err := wrapper.UpdateGPSData(m.ctx)
-				if err != nil {
-					errC <- errors.Wrap(err, "GPS update error")
-				}
+			case <-time.After(gpsdReconnectionDelay):
 			}
 		}
 	}()
 	return errC
 }
 
-func (m *Manager) downlinkRoutine(bgCtx context.Context) {
-	m.ctx.Info("Waiting for downlink messages")
+func (m *Manager) beaconRoutine(bgCtx context.Context, downlinks DownlinkManager) {
+	if !m.isGPS {
+		m.ctx.Error("Class B beacons require a GPS, no beacon will be sent")
+		return
+	}
+	region, err := classb.GetRegion(m.netClient.FrequencyPlan())
+	if err != nil {
+		m.ctx.WithError(err).Error("No beacon will be sent")
+		return
+	}
+	m.ctx.WithField("Power", m.beacon.Power).Info("Starting Class B beacon routine")
+	downlinks.EnablePingSlots()
+	scheduler := &beaconScheduler{
+		ctx:       m.ctx,
+		downlinks: downlinks,
+		power:     m.beacon.Power,
+		region:    region,
+		location:  m.location,
+	}
+	scheduler.run(bgCtx)
+}
+
+func (m *Manager) downlinkRoutine(bgCtx context.Context, dManager DownlinkManager) {
+	ctx := util.WithComponent(m.ctx, util.DownlinkComponent)
+	ctx.Info("Waiting for downlink messages")
 	downlinkQueue := m.netClient.Downlinks()
-	dManager := NewDownlinkManager(bgCtx, m.ctx, m.conf, m.statusMgr, m.downlinksSendMargin)
-	m.bootTimeSetters.Add(dManager)
 	for {
 		select {
 		case downlink := <-downlinkQueue:
-			m.ctx.Info("Scheduling newly-received downlink packet")
+			ctx.Info("Scheduling newly-received downlink packet")
 			m.statusMgr.ReceivedTX()
-			dManager.ScheduleDownlink(downlink)
+			if err := dManager.Schedule(TXRequest{Message: downlink, Mode: networkTXMode(downlink)}); err != nil {
+				refusalCtx := ctx.WithError(err)
+				eventFields := log.Fields{"Error": err}
+				if downlinkErr, ok := err.(*DownlinkError); ok {
+					refusalCtx = refusalCtx.WithField("Reason", downlinkErr.Reason)
+					eventFields["Reason"] = downlinkErr.Reason
+				}
+				refusalCtx.Warn("Downlink refused")
+				m.events.Record(EventDownlinkRejected, "Downlink refused", eventFields)
+			}
 		case <-bgCtx.Done():
 			return
 		}
 	}
 }
 
+// statusRoutine sends a status message at every status interval, and after the gateway events that
+// change the status. A status following an event too closely the previous one is delayed.
 func (m *Manager) statusRoutine(bgCtx context.Context) chan error {
 	errC := make(chan error)
+	triggers := m.events.Subscribe(statusTriggerEvents...)
 	go func() {
 		defer close(errC)
+		ticker := time.NewTicker(m.statusInterval)
+		defer ticker.Stop()
+		var lastStatus time.Time
+		// delayed fires when the delayed status is due - nil if no status is delayed
+		var delayed <-chan time.Time
 		for {
 			select {
-			case <-time.After(statusRoutineSleepRate):
-				rtt, err := m.netClient.Ping()
-				m.ctx.WithField("RTT", rtt).Debug("Ping to the router successful")
-				if err != nil {
-					errC <- errors.Wrap(err, "Network server health check error")
-					return
+			case <-ticker.C:
+			case event := <-triggers:
+				if wait := minStatusSpacing - time.Since(lastStatus); wait > 0 {
+					if delayed == nil {
+						m.ctx.WithFields(log.Fields{"EventType": event.Type, "Delay": wait}).Debug("Delaying status after gateway event")
+						delayed = time.After(wait)
+					}
+					continue
 				}
+				m.ctx.WithField("EventType", event.Type).Debug("Sending status after gateway event")
+			case <-delayed:
+				m.ctx.Debug("Sending delayed status after gateway event")
+			case <-bgCtx.Done():
+				return
+			}
+			delayed = nil
+			lastStatus = time.Now()
+			if err := m.sendStatus(); err != nil {
+				errC <- err
+				return
+			}
+		}
+	}()
+	return errC
+}
 
-				status, err := m.statusMgr.GenerateStatus(rtt)
-				if err != nil {
-					errC <- errors.Wrap(err, "Gateway status computation error")
-					return
-				}
+func (m *Manager) sendStatus() error {
+	m.poller.logStats(util.WithComponent(m.ctx, util.UplinkComponent))
+	status, err := m.statusMgr.GenerateStatus(time.Duration(atomic.LoadInt64(&m.rtt)))
+	if err != nil {
+		return errors.Wrap(err, "Gateway status computation error")
+	}
 
-				err = m.netClient.SendStatus(*status)
-				if err != nil {
-					errC <- errors.Wrap(err, "Gateway status transmission error")
-					return
-				}
+	status.Router = m.netClient.RouterID()
+	status.Messages = append(status.Messages, m.events.ForwardedMessages()...)
+	if err := m.netClient.SendStatus(*status); err != nil {
+		return errors.Wrap(err, "Gateway status transmission error")
+	}
+	return nil
+}
+
+// healthCheckRoutine pings the router when it starts, and then at every health check interval. The
+// round-trip time is reported in the next status message.
+func (m *Manager) healthCheckRoutine(bgCtx context.Context) chan error {
+	errC := make(chan error)
+	go func() {
+		defer close(errC)
+		ticker := time.NewTicker(m.healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			rtt, err := m.netClient.Ping()
+			if err != nil {
+				errC <- errors.Wrap(err, "Network server health check error")
+				return
+			}
+			m.ctx.WithField("RTT", rtt).Debug("Ping to the router successful")
+			atomic.StoreInt64(&m.rtt, int64(rtt))
+
+			select {
+			case <-ticker.C:
 			case <-bgCtx.Done():
 				return
 			}
@@ -266,26 +494,44 @@ func (m *Manager) startRoutines(bgCtx context.Context, runTime time.Time) chan e
 		upCtx, upCancel := context.WithCancel(bgCtx)
 		downCtx, downCancel := context.WithCancel(bgCtx)
 		statusCtx, statusCancel := context.WithCancel(bgCtx)
+		healthCtx, healthCancel := context.WithCancel(bgCtx)
 		gpsCtx, gpsCancel := context.WithCancel(bgCtx)
 		networkCtx, networkCancel := context.WithCancel(bgCtx)
-
-		go m.downlinkRoutine(downCtx)
+		beaconCtx, beaconCancel := context.WithCancel(bgCtx)
+		metricsCtx, metricsCancel := context.WithCancel(bgCtx)
+
+		// Downlinks and beacons share the JIT queue of the downlink manager
+		dManager := NewDownlinkManager(downCtx, util.WithComponent(m.ctx, util.DownlinkComponent), m.conf, m.statusMgr, m.downlinksSendMargin, m.concentratorLock.RLocker(), m.netClient.FrequencyPlan())
+		m.bootTimeSetters.Add(dManager)
+		go m.downlinkRoutine(downCtx, dManager)
+		if m.beacon.Enabled {
+			go m.beaconRoutine(beaconCtx, dManager)
+		}
 		uplinkErrors := m.uplinkRoutine(upCtx, runTime)
 		statusErrors := m.statusRoutine(statusCtx)
+		healthErrors := m.healthCheckRoutine(healthCtx)
 		networkErrors := m.networkRoutine(networkCtx)
 		var gpsErrors chan error
 		if m.isGPS {
 			gpsErrors = m.gpsRoutine(gpsCtx)
 		}
+		var metricsErrors chan error
+		if m.metricsAddress != "" {
+			metricsErrors = m.metricsRoutine(metricsCtx)
+		}
 		select {
 		case uplinkError := <-uplinkErrors:
 			err <- errors.Wrap(uplinkError, "Uplink routine error")
 		case statusError := <-statusErrors:
 			err <- errors.Wrap(statusError, "Status routine error")
+		case healthError := <-healthErrors:
+			err <- errors.Wrap(healthError, "Health check routine error")
 		case networkError := <-networkErrors:
 			err <- errors.Wrap(networkError, "Network routine error")
 		case gpsError := <-gpsErrors:
 			err <- errors.Wrap(gpsError, "GPS routine error")
+		case metricsError := <-metricsErrors:
+			err <- errors.Wrap(metricsError, "Metrics routine error")
 		case <-bgCtx.Done():
 			err <- nil
 		}
@@ -293,14 +539,21 @@ func (m *Manager) startRoutines(bgCtx context.Context, runTime time.Time) chan e
 		gpsCancel()
 		downCancel()
 		statusCancel()
+		healthCancel()
 		networkCancel()
+		beaconCancel()
+		metricsCancel()
 	}()
 	return err
 }
 
 func (m *Manager) shutdown() error {
 	m.netClient.Stop()
-	return stopGateway(m.ctx)
+	if err := stopGateway(m.ctx); err != nil {
+		return err
+	}
+	m.events.Record(EventConcentratorStop, "Concentrator stopped", nil)
+	return nil
 }
 
 func stopGateway(ctx log.Interface) error {
@@ -0,0 +1,148 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/pkg/errors"
+)
+
+// metricsPrefix is the prefix of the names of the metrics
+const metricsPrefix = "pktfwd_"
+
+// metricsRoutine serves the telemetry, OS metrics, packet counters and traffic statistics of the
+// gateway on /metrics, in the Prometheus text format, until the context is done
+func (m *Manager) metricsRoutine(bgCtx context.Context) chan error {
+	errC := make(chan error)
+	ctx := util.WithComponent(m.ctx, util.StatusComponent)
+	go func() {
+		defer close(errC)
+		listener, err := net.Listen("tcp", m.metricsAddress)
+		if err != nil {
+			errC <- errors.Wrap(err, "Couldn't listen on the metrics address")
+			return
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write(m.metrics())
+		})
+		server := &http.Server{Handler: mux}
+		go func() {
+			<-bgCtx.Done()
+			server.Close()
+		}()
+
+		ctx.WithField("Address", listener.Addr().String()).Info("Serving metrics")
+		if err := server.Serve(listener); err != nil && bgCtx.Err() == nil {
+			errC <- errors.Wrap(err, "Metrics server error")
+		}
+	}()
+	return errC
+}
+
+// metrics returns the current metrics of the gateway in the Prometheus text format
+func (m *Manager) metrics() []byte {
+	var buf bytes.Buffer
+	writeMetric := func(name, metricType string, value float64) {
+		fmt.Fprintf(&buf, "# TYPE %s%s %s\n%s%s %g\n", metricsPrefix, name, metricType, metricsPrefix, name, value)
+	}
+
+	writeReadings := func(readings []TelemetryReading) {
+		sort.SliceStable(readings, func(i, j int) bool { return readings[i].Name < readings[j].Name })
+		for i, reading := range readings {
+			if i == 0 || readings[i-1].Name != reading.Name {
+				fmt.Fprintf(&buf, "# TYPE %s%s gauge\n", metricsPrefix, reading.Name)
+			}
+			fmt.Fprintf(&buf, "%s%s %g\n", metricsPrefix, reading.String(), reading.Value)
+		}
+	}
+
+	writeReadings(m.telemetry.Read())
+
+	osInfo := getOSInfo()
+	writeMetric("cpu_percentage", "gauge", float64(osInfo.CpuPercentage))
+	writeMetric("memory_percentage", "gauge", float64(osInfo.MemoryPercentage))
+	writeMetric("load_1", "gauge", float64(osInfo.Load_1))
+	writeMetric("load_5", "gauge", float64(osInfo.Load_5))
+	writeMetric("load_15", "gauge", float64(osInfo.Load_15))
+
+	counters := m.statusMgr.Counters()
+	writeMetric("rx_in_total", "counter", float64(counters.RxIn))
+	writeMetric("rx_ok_total", "counter", float64(counters.RxOk))
+	writeMetric("tx_in_total", "counter", float64(counters.TxIn))
+	writeMetric("tx_ok_total", "counter", float64(counters.TxOk))
+	writeMetric("tx_blocked_total", "counter", float64(counters.TxBlocked))
+
+	queueStats := m.netClient.UplinkQueueStats()
+	// writePriorityMetric writes a metric of the uplink queues, labelled with their priority
+	writePriorityMetric := func(name, metricType string, value func(stats UplinkQueueStats) float64) {
+		fmt.Fprintf(&buf, "# TYPE %s%s %s\n", metricsPrefix, name, metricType)
+		for priority, stats := range queueStats {
+			fmt.Fprintf(&buf, "%s%s{priority=%q} %g\n", metricsPrefix, name, UplinkPriority(priority).String(), value(stats))
+		}
+	}
+	writePriorityMetric("uplink_queue_depth", "gauge", func(s UplinkQueueStats) float64 { return float64(s.Pending) })
+	writePriorityMetric("uplink_queued_total", "counter", func(s UplinkQueueStats) float64 { return float64(s.Queued) })
+	writePriorityMetric("uplink_dropped_total", "counter", func(s UplinkQueueStats) float64 { return float64(s.Dropped) })
+	writePriorityMetric("uplink_sent_total", "counter", func(s UplinkQueueStats) float64 { return float64(s.Sent) })
+	writePriorityMetric("uplink_failed_total", "counter", func(s UplinkQueueStats) float64 { return float64(s.Failed) })
+
+	var traffic []TelemetryReading
+	for _, window := range m.stats.Windows() {
+		traffic = append(traffic, trafficReadings(m.stats.Window(window))...)
+	}
+	writeReadings(traffic)
+	return buf.Bytes()
+}
+
+// trafficReadings returns the traffic statistics of a window as readings, labelled with the window
+// and the channel or the datarate
+func trafficReadings(stats WindowStats) []TelemetryReading {
+	var readings []TelemetryReading
+	// add adds a reading with the labels, the window label and the extra key and value pairs
+	add := func(name string, value float64, labels map[string]string, extra ...string) {
+		readingLabels := map[string]string{"window": stats.Window.String()}
+		for key, label := range labels {
+			readingLabels[key] = label
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			readingLabels[extra[i]] = extra[i+1]
+		}
+		readings = append(readings, TelemetryReading{Name: name, Value: value, Labels: readingLabels})
+	}
+	addPackets := func(name string, crc CRCStats, labels map[string]string) {
+		add(name, float64(crc.CRCOK), labels, "crc", "ok")
+		add(name, float64(crc.CRCBad), labels, "crc", "bad")
+		add(name, float64(crc.NoCRC), labels, "crc", "none")
+	}
+	addDistribution := func(name string, distribution Distribution, labels map[string]string) {
+		add(name, distribution.Min, labels, "quantile", "0")
+		add(name, distribution.Median, labels, "quantile", "0.5")
+		add(name, distribution.Max, labels, "quantile", "1")
+	}
+
+	for _, channel := range stats.Channels {
+		labels := map[string]string{
+			"frequency": strconv.FormatUint(uint64(channel.Frequency), 10),
+			"channel":   strconv.Itoa(int(channel.IFChain)),
+		}
+		addPackets("channel_packets", channel.CRCStats, labels)
+		addDistribution("channel_rssi_dbm", channel.RSSI, labels)
+		addDistribution("channel_snr_db", channel.SNR, labels)
+		add("channel_noise_floor_dbm", channel.NoiseFloor, labels)
+	}
+	for _, datarate := range stats.Datarates {
+		addPackets("datarate_packets", datarate.CRCStats, map[string]string{"datarate": datarate.Datarate})
+	}
+	return readings
+}
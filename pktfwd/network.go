@@ -11,6 +11,7 @@ import (
 
 	"github.com/TheThingsNetwork/go-account-lib/account"
 	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
 	"github.com/TheThingsNetwork/ttn/api/discovery"
 	"github.com/TheThingsNetwork/ttn/api/fields"
 	"github.com/TheThingsNetwork/ttn/api/gateway"
@@ -22,55 +23,79 @@ import (
 
 const (
 	tokenRefreshMargin = -2 * time.Minute
-	uplinksBufferSize  = 32
 )
 
 type TTNConfig struct {
 	ID                  string
-	Key                 string
+	Key                 util.Secret
 	AuthServer          string
 	DiscoveryServer     string
 	Router              string
 	Version             string
+	Commit              string
 	GatewayDescription  string
+	FrequencyPlan       string
 	DownlinksSendMargin time.Duration
 	IgnoreCRC           bool
+	Location            LocationConfig
+	SystemTimeFallback  bool
+	Beacon              BeaconConfig
+	StatsWindows        []time.Duration
+	UplinkQueueSize     int // Per priority
+	UplinkBatchSize     int
+	UplinkDropPolicy    DropPolicy
+	Polling             PollingConfig
+	EventsFile          string
+	MaxEvents           int
+	ForwardEvents       bool
+	ResetPin            int
+	Telemetry           TelemetryThresholds
+	MetricsAddress      string
+	StatusInterval      time.Duration
+	HealthCheckInterval time.Duration
+	Watchdog            WatchdogConfig
 }
 
 type TTNClient struct {
 	antennaLocation *account.AntennaLocation
 	routerConn      *grpc.ClientConn
+	routerID        string
 	ctx             log.Interface
-	uplinkStream    router.UplinkStream
-	uplinkMutex     sync.Mutex
-	downlinkStream  router.DownlinkStream
-	statusStream    router.GatewayStatusStream
-	account         *account.Account
-	runConfig       TTNConfig
-	connected       bool
-	networkMutex    *sync.Mutex
-	streamsMutex    *sync.Mutex
-	token           string
-	tokenExpiry     time.Time
-	frequencyPlan   string
+	// One uplink stream per priority, so that join requests are never buffered behind other uplinks
+	uplinkStreams  [nbUplinkPriorities]router.UplinkStream
+	uplinks        *uplinkPipeline
+	downlinkStream router.DownlinkStream
+	statusStream   router.GatewayStatusStream
+	account        *account.Account
+	runConfig      TTNConfig
+	connected      bool
+	networkMutex   *sync.Mutex
+	streamsMutex   *sync.Mutex
+	token          string
+	tokenExpiry    time.Time
+	frequencyPlan  string
+	events         *EventJournal
 	// Communication between internal goroutines
 	stopDownlinkQueue          chan bool
 	stopUplinkQueue            chan bool
 	stopMainRouterReconnection chan bool
 	downlinkStreamChange       chan bool
 	downlinkQueue              chan *router.DownlinkMessage
-	uplinkQueue                chan *router.UplinkMessage
 	routerChanges              chan func(c *TTNClient) error
 }
 
 type NetworkClient interface {
 	SendStatus(status gateway.Status) error
-	SendUplinks(messages []router.UplinkMessage)
+	SendUplinks(messages []router.UplinkMessage) UplinkBackpressure
 	FrequencyPlan() string
+	// RouterID returns the ID of the router the gateway is connected to
+	RouterID() string
 	Downlinks() <-chan *router.DownlinkMessage
 	GatewayID() string
 	Ping() (time.Duration, error)
 	DefaultLocation() *account.AntennaLocation
+	// UplinkQueueStats returns the statistics of the uplink queues, indexed by priority
+	UplinkQueueStats() [nbUplinkPriorities]UplinkQueueStats
 	Stop()
 	RefreshRoutine(ctx context.Context) error
 }
@@ -80,6 +105,7 @@ func (c *TTNClient) GatewayID() string {
 }
 
 type RouterHealthCheck struct {
+	ID       string
 	Conn     *grpc.ClientConn
 	Duration time.Duration
 	Err      error
@@ -114,6 +140,12 @@ func (c *TTNClient) FrequencyPlan() string {
 	return c.frequencyPlan
 }
 
+func (c *TTNClient) RouterID() string {
+	c.networkMutex.Lock()
+	defer c.networkMutex.Unlock()
+	return c.routerID
+}
+
 func reconnectionDelay(tries uint) time.Duration {
 	return time.Duration(math.Exp(float64(tries)/2.0)) * time.Second
 }
@@ -137,9 +169,11 @@ func (c *TTNClient) tryMainRouterReconnection(gw account.Gateway, discoveryClien
 
 		c.routerChanges <- func(t *TTNClient) error {
 			t.routerConn = routerConn
+			t.routerID = gw.Router.ID
 			return nil
 		}
 		c.ctx.Info("Connection to main router successful")
+		c.events.Record(EventRouterChange, "Reconnected to main router", log.Fields{"RouterID": gw.Router.ID})
 		break
 	}
 }
@@ -151,7 +185,7 @@ func (c *TTNClient) Ping() (time.Duration, error) {
 	return t, err
 }
 
-func (c *TTNClient) getLowestLatencyRouter(discoveryClient discovery.Client, fallbackRouters []account.GatewayRouter) (*grpc.ClientConn, error) {
+func (c *TTNClient) getLowestLatencyRouter(discoveryClient discovery.Client, fallbackRouters []account.GatewayRouter) (*grpc.ClientConn, string, error) {
 	routerAnnouncements := make([]*discovery.Announcement, 0)
 	for _, router := range fallbackRouters {
 		routerAnnouncement, err := discoveryClient.Get("router", router.ID)
@@ -163,19 +197,23 @@ func (c *TTNClient) getLowestLatencyRouter(discoveryClient discovery.Client, fal
 	return c.getLowestLatencyRouterFromAnnouncements(discoveryClient, routerAnnouncements)
 }
 
-func (c *TTNClient) getLowestLatencyRouterFromAnnouncements(discoveryClient discovery.Client, routerAnnouncements []*discovery.Announcement) (*grpc.ClientConn, error) {
+// getLowestLatencyRouterFromAnnouncements returns the connection to the router with the lowest
+// latency, and its ID
+func (c *TTNClient) getLowestLatencyRouterFromAnnouncements(discoveryClient discovery.Client, routerAnnouncements []*discovery.Announcement) (*grpc.ClientConn, string, error) {
 	var routerConn *grpc.ClientConn
+	var routerID string
 	routerHealthChannel := make(chan RouterHealthCheck)
 	for _, routerAnnouncement := range routerAnnouncements {
 		announcement := routerAnnouncement
 		go func() {
 			conn, err := announcement.Dial()
 			if err != nil {
-				routerHealthChannel <- RouterHealthCheck{Err: err}
+				routerHealthChannel <- RouterHealthCheck{ID: announcement.Id, Err: err}
 				return
 			}
 			duration, err := connectionHealthCheck(conn)
 			routerHealthChannel <- RouterHealthCheck{
+				ID:       announcement.Id,
 				Err:      err,
 				Duration: duration,
 				Conn:     conn,
@@ -191,6 +229,10 @@ func (c *TTNClient) getLowestLatencyRouterFromAnnouncements(discoveryClient disc
 				routerConn.Close()
 			}
 			routerConn = routerHealth.Conn
+			routerID = routerHealth.ID
+			lowestPing = routerHealth.Duration
+		} else if routerHealth.Conn != nil {
+			routerHealth.Conn.Close()
 		}
 		routersChecked++
 		if routersChecked == len(routerAnnouncements) {
@@ -198,10 +240,10 @@ func (c *TTNClient) getLowestLatencyRouterFromAnnouncements(discoveryClient disc
 		}
 	}
 	if routerConn == nil {
-		return nil, errors.New("Packet forwarder couldn't establish a healthy connection with any router")
+		return nil, "", errors.New("Packet forwarder couldn't establish a healthy connection with any router")
 	}
-	c.ctx.Info("Identified the lowest latency router")
-	return routerConn, nil
+	c.ctx.WithField("RouterID", routerID).Info("Identified the lowest latency router")
+	return routerConn, routerID, nil
 }
 
 func (c *TTNClient) getRouterClient(ctx log.Interface) error {
@@ -219,12 +261,14 @@ func (c *TTNClient) getRouterClient(ctx log.Interface) error {
 	defer discoveryClient.Close()
 
 	var routerConn *grpc.ClientConn
+	routerID := c.runConfig.Router
 	if c.runConfig.Router == "" {
 		gw, err := c.account.FindGateway(c.GatewayID())
 		if err != nil {
 			return errors.Wrap(err, "Couldn't fetch the gateway information from the account server")
 		}
 
+		routerID = gw.Router.ID
 		if gw.Router.ID != "" {
 			routerConn, err = connectToRouter(c.ctx.WithField("RouterID", gw.Router.ID), discoveryClient, gw.Router.ID)
 		}
@@ -240,12 +284,12 @@ func (c *TTNClient) getRouterClient(ctx log.Interface) error {
 					ctx.WithError(err).Error("Couldn't retrieve routers")
 					return err
 				}
-				routerConn, err = c.getLowestLatencyRouterFromAnnouncements(discoveryClient, routers)
+				routerConn, routerID, err = c.getLowestLatencyRouterFromAnnouncements(discoveryClient, routers)
 				if err != nil {
 					return errors.Wrap(err, "Couldn't figure out the lowest latency router")
 				}
 			} else {
-				routerConn, err = c.getLowestLatencyRouter(discoveryClient, fallbackRouters)
+				routerConn, routerID, err = c.getLowestLatencyRouter(discoveryClient, fallbackRouters)
 				if err != nil {
 					return errors.Wrap(err, "Couldn't figure out the lowest latency router")
 				}
@@ -264,6 +308,8 @@ func (c *TTNClient) getRouterClient(ctx log.Interface) error {
 	}
 
 	c.routerConn = routerConn
+	c.routerID = routerID
+	c.events.Record(EventRouterChange, "Connected to router", log.Fields{"RouterID": routerID})
 	return nil
 }
 
@@ -271,20 +317,39 @@ func (c *TTNClient) Downlinks() <-chan *router.DownlinkMessage {
 	return c.downlinkQueue
 }
 
+// queueUplinks sends the queued uplinks in batches, in priority order, each on the stream of its
+// priority. A single sender drains the queues, so that a batch of a lower priority is only sent
+// when no uplink of a higher priority is waiting.
 func (c *TTNClient) queueUplinks() {
 	for {
 		select {
 		case <-c.stopUplinkQueue:
 			c.ctx.Info("Closing uplinks queue")
-			close(c.uplinkQueue)
 			return
-		case uplink := <-c.uplinkQueue:
-			ctx := c.ctx.WithFields(fields.Get(uplink))
-			if err := c.uplinkStream.Send(uplink); err != nil {
-				ctx.WithError(err).Warn("Uplink message transmission to the back-end failed.")
-			} else {
-				ctx.Info("Uplink message transmission successful.")
+		case <-c.uplinks.notify:
+		}
+
+		for priority, batch := c.uplinks.next(); len(batch) > 0; priority, batch = c.uplinks.next() {
+			queue := c.uplinks.queues[priority]
+			ctx := c.ctx.WithField("Priority", priority)
+			c.streamsMutex.Lock()
+			stream := c.uplinkStreams[priority]
+			c.streamsMutex.Unlock()
+
+			var failed int
+			for _, uplink := range batch {
+				if err := stream.Send(uplink); err != nil {
+					failed++
+					ctx.WithFields(fields.Get(uplink)).WithError(err).Warn("Uplink message transmission to the back-end failed.")
+					continue
+				}
+				ctx.WithFields(fields.Get(uplink)).Debug("Uplink message transmission successful.")
 			}
+			queue.sent(len(batch)-failed, failed)
+			ctx.WithFields(log.Fields{
+				"NbMessages": len(batch),
+				"NbFailed":   failed,
+			}).Info("Uplink messages transmitted")
 		}
 	}
 }
@@ -312,7 +377,7 @@ func (c *TTNClient) queueDownlinks() {
 }
 
 func (c *TTNClient) fetchAccountServerInfo() error {
-	c.account = account.NewWithKey(c.runConfig.AuthServer, c.runConfig.Key)
+	c.account = account.NewWithKey(c.runConfig.AuthServer, c.runConfig.Key.Value())
 	gw, err := c.account.FindGateway(c.runConfig.ID)
 	if err != nil {
 		return errors.Wrap(err, "Account server error")
@@ -322,6 +387,7 @@ func (c *TTNClient) fetchAccountServerInfo() error {
 	c.tokenExpiry = gw.Token.Expiry
 	c.frequencyPlan = gw.FrequencyPlan
 	c.ctx.WithField("TokenExpiry", c.tokenExpiry).Info("Refreshed account server information")
+	c.events.Record(EventTokenRefresh, "Refreshed account server token", log.Fields{"TokenExpiry": c.tokenExpiry})
 	return nil
 }
 
@@ -344,12 +410,13 @@ func (c *TTNClient) RefreshRoutine(ctx context.Context) error {
 	}
 }
 
-func CreateNetworkClient(ctx log.Interface, ttnConfig TTNConfig) (NetworkClient, error) {
+func CreateNetworkClient(ctx log.Interface, ttnConfig TTNConfig, events *EventJournal) (NetworkClient, error) {
 	var client = &TTNClient{
 		ctx:                  ctx,
+		events:               events,
 		runConfig:            ttnConfig,
 		downlinkQueue:        make(chan *router.DownlinkMessage),
-		uplinkQueue:          make(chan *router.UplinkMessage, uplinksBufferSize),
+		uplinks:              newUplinkPipeline(ttnConfig.UplinkQueueSize, ttnConfig.UplinkBatchSize, ttnConfig.UplinkDropPolicy),
 		networkMutex:         &sync.Mutex{},
 		streamsMutex:         &sync.Mutex{},
 		stopDownlinkQueue:    make(chan bool),
@@ -408,23 +475,30 @@ func (c *TTNClient) connectToStreams(routerClient router.RouterClientForGateway)
 	if c.connected {
 		c.disconnectOfStreams()
 	}
-	c.uplinkStream = router.NewMonitoredUplinkStream(routerClient)
+	for i := range c.uplinkStreams {
+		c.uplinkStreams[i] = router.NewMonitoredUplinkStream(routerClient)
+	}
 	c.downlinkStream = router.NewMonitoredDownlinkStream(routerClient)
 	c.statusStream = router.NewMonitoredGatewayStatusStream(routerClient)
 	c.connected = true
 }
 
 func (c *TTNClient) disconnectOfStreams() {
-	c.uplinkStream.Close()
+	for _, stream := range c.uplinkStreams {
+		stream.Close()
+	}
 	c.downlinkStream.Close()
 	c.statusStream.Close()
 	c.connected = false
 }
 
-func (c *TTNClient) SendUplinks(messages []router.UplinkMessage) {
-	for _, message := range messages {
-		c.uplinkQueue <- &message
-	}
+func (c *TTNClient) UplinkQueueStats() [nbUplinkPriorities]UplinkQueueStats {
+	return c.uplinks.stats()
+}
+
+// SendUplinks queues the uplinks without blocking, and reports whether the queues are full
+func (c *TTNClient) SendUplinks(messages []router.UplinkMessage) UplinkBackpressure {
+	return c.uplinks.push(messages)
 }
 
 func (c *TTNClient) SendStatus(status gateway.Status) error {
@@ -453,6 +527,7 @@ func (c *TTNClient) SendStatus(status gateway.Status) error {
 		"Altitude":          status.GetGps().GetAltitude(),
 		"RTT":               status.GetRtt(),
 	}).Info("Sending status to the network server")
+	c.uplinks.logStats(c.ctx)
 	err = c.statusStream.Send(&status)
 	if err != nil {
 		return errors.Wrap(err, "Status stream error")
@@ -463,7 +538,8 @@ func (c *TTNClient) SendStatus(status gateway.Status) error {
 // Stop a running network client
 func (c *TTNClient) Stop() {
 	c.stopDownlinkQueue <- true
-	c.stopUplinkQueue <- true
+	// Stopping the uplink routine
+	close(c.stopUplinkQueue)
 	select {
 	case c.stopMainRouterReconnection <- true:
 		break
@@ -0,0 +1,161 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+)
+
+// pollingBackoff is the factor by which the polling interval increases after an empty poll
+const pollingBackoff = 1.5
+
+// PollingConfig describes how the concentrator is polled for uplinks. The polling interval
+// increases from MinInterval to MaxInterval while no packet is received, and goes back to
+// MinInterval under load.
+type PollingConfig struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// InterruptPin is the GPIO pin of the concentrator interrupt line, 0 if none. When the
+	// interrupt is available, the concentrator is polled when it raises the line, or at MaxInterval.
+	InterruptPin int
+}
+
+// Validate checks that the intervals are consistent
+func (c PollingConfig) Validate() error {
+	if c.MinInterval <= 0 || c.MaxInterval < c.MinInterval {
+		return fmt.Errorf("Invalid polling intervals %v - %v", c.MinInterval, c.MaxInterval)
+	}
+	return nil
+}
+
+// uplinkPoller decides when the concentrator is polled, and measures the cost of the polling
+type uplinkPoller struct {
+	conf      PollingConfig
+	interrupt <-chan struct{}
+
+	mutex    sync.Mutex
+	interval time.Duration
+	full     bool
+	// lowLatency keeps the polling interval at its minimum
+	lowLatency  bool
+	polls       uint64
+	emptyPolls  uint64
+	receiveTime time.Duration
+	// Process CPU time at the last report
+	lastReport     time.Time
+	lastReportCPU  time.Duration
+	lastReportPoll uint64
+}
+
+func newUplinkPoller(conf PollingConfig) *uplinkPoller {
+	p := &uplinkPoller{
+		conf:       conf,
+		interval:   conf.MinInterval,
+		lastReport: time.Now(),
+	}
+	p.lastReportCPU, _ = processCPUTime()
+	return p
+}
+
+// watchInterrupt waits on the concentrator interrupt line if it is configured and available. It
+// must be called before the polling starts.
+func (p *uplinkPoller) watchInterrupt(bgCtx context.Context, ctx log.Interface) {
+	if p.conf.InterruptPin == 0 {
+		return
+	}
+	interrupt, err := watchInterruptPin(bgCtx, p.conf.InterruptPin)
+	if err != nil {
+		ctx.WithError(err).WithField("InterruptPin", p.conf.InterruptPin).Warn("Couldn't watch concentrator interrupt line, polling the concentrator")
+		return
+	}
+	ctx.WithField("InterruptPin", p.conf.InterruptPin).Info("Waiting for the concentrator interrupt line to poll the concentrator")
+	p.interrupt = interrupt
+}
+
+// receive polls the concentrator, and adapts the polling interval to the number of packets received
+func (p *uplinkPoller) receive() ([]wrapper.Packet, error) {
+	start := time.Now()
+	packets, err := wrapper.Receive()
+	duration := time.Now().Sub(start)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.polls++
+	p.receiveTime += duration
+	// When the concentrator returned as many packets as possible, more are probably waiting
+	p.full = len(packets) >= wrapper.NbMaxPackets
+	if len(packets) > 0 || p.lowLatency {
+		p.interval = p.conf.MinInterval
+	} else {
+		p.interval = time.Duration(float64(p.interval) * pollingBackoff)
+		if p.interval > p.conf.MaxInterval {
+			p.interval = p.conf.MaxInterval
+		}
+	}
+	if len(packets) == 0 {
+		p.emptyPolls++
+	}
+	return packets, err
+}
+
+// setLowLatency keeps the polling interval at its minimum, for example while the concentrator
+// boot time is being determined from the reception time of the first packets
+func (p *uplinkPoller) setLowLatency(lowLatency bool) {
+	p.mutex.Lock()
+	p.lowLatency = lowLatency
+	p.mutex.Unlock()
+}
+
+// wait waits until the next poll, and returns false if the context was cancelled meanwhile
+func (p *uplinkPoller) wait(bgCtx context.Context) bool {
+	p.mutex.Lock()
+	interval, full := p.interval, p.full
+	if p.interrupt != nil && !p.lowLatency {
+		// The interrupt signals the packets, polling is only a fallback
+		interval = p.conf.MaxInterval
+	}
+	p.mutex.Unlock()
+	if full {
+		interval = 0
+	}
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-bgCtx.Done():
+		return false
+	case <-timer.C:
+	case <-p.interrupt:
+	}
+	return true
+}
+
+// logStats logs the polling statistics and the CPU usage of the process since the last report
+func (p *uplinkPoller) logStats(ctx log.Interface) {
+	now := time.Now()
+	cpu, cpuErr := processCPUTime()
+
+	p.mutex.Lock()
+	fields := log.Fields{
+		"Polls":           p.polls,
+		"EmptyPolls":      p.emptyPolls,
+		"ReceiveTime":     p.receiveTime,
+		"PollingInterval": p.interval,
+		"PollingRate":     fmt.Sprintf("%.1f/s", float64(p.polls-p.lastReportPoll)/now.Sub(p.lastReport).Seconds()),
+	}
+	if cpuErr == nil {
+		fields["ProcessCPU"] = fmt.Sprintf("%.2f%%", 100*float64(cpu-p.lastReportCPU)/float64(now.Sub(p.lastReport)))
+		p.lastReportCPU = cpu
+	}
+	p.lastReport = now
+	p.lastReportPoll = p.polls
+	p.mutex.Unlock()
+
+	ctx.WithFields(fields).Info("Concentrator polling statistics")
+}
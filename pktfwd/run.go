@@ -9,18 +9,27 @@ import (
 )
 
 // Init initiates the configuration, the network connection, and handles the manager
-func Run(ctx log.Interface, conf util.Config, ttnConfig TTNConfig, gpsPath string) error {
-	networkCli, err := CreateNetworkClient(ctx, ttnConfig)
+func Run(ctx log.Interface, conf util.Config, ttnConfig TTNConfig, gpsSource string) error {
+	events, err := NewEventJournal(ctx, ttnConfig.EventsFile, ttnConfig.MaxEvents, ttnConfig.ForwardEvents)
+	if err != nil {
+		ctx.WithError(err).WithField("EventsFile", ttnConfig.EventsFile).Warn("Couldn't open event journal - events will not be persisted")
+		events, _ = NewEventJournal(ctx, "", ttnConfig.MaxEvents, ttnConfig.ForwardEvents)
+	}
+
+	networkCli, err := CreateNetworkClient(util.WithComponent(ctx, util.NetworkComponent), ttnConfig, events)
 	if err != nil {
 		return errors.Wrap(err, "Network configuration failure")
 	}
 
 	// applying configuration to the board
-	if err := configureBoard(ctx, conf, gpsPath); err != nil {
+	if err := configureBoard(ctx, conf); err != nil {
+		return errors.Wrap(err, "Board configuration failure")
+	}
+	if err := enableGPS(ctx, gpsSource); err != nil {
 		return errors.Wrap(err, "Board configuration failure")
 	}
 
 	// Creating manager
-	var mgr = NewManager(ctx, conf, networkCli, gpsPath, ttnConfig)
+	var mgr = NewManager(ctx, conf, networkCli, gpsSource, ttnConfig, events)
 	return mgr.run()
 }
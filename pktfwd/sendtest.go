@@ -0,0 +1,174 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/TheThingsNetwork/ttn/api/gateway"
+	"github.com/TheThingsNetwork/ttn/api/protocol"
+	"github.com/TheThingsNetwork/ttn/api/protocol/lorawan"
+	"github.com/TheThingsNetwork/ttn/api/router"
+	"github.com/pkg/errors"
+)
+
+// testTXMargin is added to the time on air between two test frames, so that a frame is never sent
+// while the previous one is still being emitted
+const testTXMargin = 50 * time.Millisecond
+
+// TestTransmission describes a burst of test frames
+type TestTransmission struct {
+	Frequency          uint64 // In Hz
+	RFChain            uint32
+	Modulation         lorawan.Modulation
+	DataRate           string // LoRa datarate, such as SF7BW125
+	CodingRate         string
+	BitRate            uint32 // FSK bitrate, in bit/s
+	FrequencyDeviation uint32 // FSK frequency deviation, in Hz
+	Power              int32  // EIRP, in dBm
+	Count              int
+	Interval           time.Duration
+	Payload            []byte
+	FrequencyPlan      string // Frequency plan of the gateway, whose payload size limits apply
+}
+
+// TestPayload generates a payload of the given size from a pattern: "zeros", "counter" for
+// incrementing bytes, "random", or hexadecimal bytes repeated to fill the payload
+func TestPayload(pattern string, size int) ([]byte, error) {
+	if size <= 0 || size > maxPayloadSize {
+		return nil, fmt.Errorf("Invalid payload size %d (should be between 1 and %d)", size, maxPayloadSize)
+	}
+	payload := make([]byte, size)
+	switch pattern {
+	case "zeros":
+	case "counter":
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+	case "random":
+		rand.Read(payload)
+	default:
+		bytes, err := hex.DecodeString(pattern)
+		if err != nil || len(bytes) == 0 {
+			return nil, fmt.Errorf("Invalid payload pattern %s (should be zeros, counter, random or hexadecimal bytes)", pattern)
+		}
+		for i := range payload {
+			payload[i] = bytes[i%len(bytes)]
+		}
+	}
+	return payload, nil
+}
+
+// TimeOnAir returns the time on air of a frame of the test transmission
+func (t TestTransmission) TimeOnAir() (time.Duration, error) {
+	return downlinkTimeOnAir(t.DownlinkMessage())
+}
+
+// DownlinkMessage returns a downlink transmitting a test frame immediately
+func (t TestTransmission) DownlinkMessage() *router.DownlinkMessage {
+	return &router.DownlinkMessage{
+		Payload: t.Payload,
+		GatewayConfiguration: &gateway.TxConfiguration{
+			RfChain:            t.RFChain,
+			Frequency:          t.Frequency,
+			Power:              t.Power,
+			FrequencyDeviation: t.FrequencyDeviation,
+		},
+		ProtocolConfiguration: &protocol.TxConfiguration{Protocol: &protocol.TxConfiguration_Lorawan{Lorawan: &lorawan.TxConfiguration{
+			Modulation: t.Modulation,
+			DataRate:   t.DataRate,
+			BitRate:    t.BitRate,
+			CodingRate: t.CodingRate,
+		}}},
+	}
+}
+
+// frameInterval returns the time between the start of two test frames
+func (t TestTransmission) frameInterval(timeOnAir time.Duration) time.Duration {
+	if min := timeOnAir + testTXMargin; t.Interval < min {
+		return min
+	}
+	return t.Interval
+}
+
+// LogDryRun logs the time on air of the test transmission, and its impact on the duty cycle
+func (t TestTransmission) LogDryRun(ctx log.Interface) error {
+	timeOnAir, err := t.TimeOnAir()
+	if err != nil {
+		return err
+	}
+	interval := t.frameInterval(timeOnAir)
+	totalTimeOnAir := time.Duration(t.Count) * timeOnAir
+	ctx.WithFields(log.Fields{
+		"Frequency":         t.Frequency,
+		"Count":             t.Count,
+		"PayloadSize":       len(t.Payload),
+		"TimeOnAir":         timeOnAir,
+		"TotalTimeOnAir":    totalTimeOnAir,
+		"BurstDuration":     time.Duration(t.Count-1)*interval + timeOnAir,
+		"BurstDutyCycle":    fmt.Sprintf("%.2f%%", 100*float64(timeOnAir)/float64(interval)),
+		"HourlyDutyCycle":   fmt.Sprintf("%.2f%%", 100*float64(totalTimeOnAir)/float64(time.Hour)),
+		"EffectiveInterval": interval,
+	}).Info("Dry run - no frame transmitted")
+	return nil
+}
+
+// SendTestFrames starts the concentrator and transmits the burst of test frames
+func SendTestFrames(ctx log.Interface, conf util.Config, t TestTransmission) error {
+	timeOnAir, err := t.TimeOnAir()
+	if err != nil {
+		return err
+	}
+	interval := t.frameInterval(timeOnAir)
+
+	if err := configureBoard(ctx, conf); err != nil {
+		return errors.Wrap(err, "Board configuration failure")
+	}
+	if err := wrapper.StartLoRaGateway(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := wrapper.StopLoRaGateway(); err != nil {
+			ctx.WithError(err).Error("Couldn't stop concentrator gracefully")
+		}
+	}()
+
+	var sent int
+	for i := 0; i < t.Count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		message := t.DownlinkMessage()
+		frameCtx := ctx.WithField("Frame", i+1)
+		adjustments, err := validateDownlink(conf.Concentrator, t.FrequencyPlan, message)
+		if err != nil {
+			return err
+		}
+		if adjustments.rfChainChanged {
+			frameCtx.WithField("RFChain", message.GatewayConfiguration.RfChain).Warn("RF chain unable to transmit on this frequency, using another RF chain")
+		}
+		if adjustments.powerLowered {
+			frameCtx.WithField("Power", message.GatewayConfiguration.Power).Warn("Power not supported by the TX gain LUT, using a lower power")
+		}
+		if err := wrapper.SendDownlink(message, wrapper.TXModeImmediate, conf, frameCtx); err != nil {
+			frameCtx.WithError(err).Warn("Couldn't transmit test frame")
+			continue
+		}
+		sent++
+		frameCtx.WithField("TimeOnAir", timeOnAir).Info("Test frame transmitted")
+	}
+	// Waiting for the last frame to be emitted before stopping the concentrator
+	time.Sleep(timeOnAir + testTXMargin)
+
+	ctx.WithFields(log.Fields{
+		"Sent":  sent,
+		"Count": t.Count,
+	}).Info("Test transmission done")
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+)
+
+// spectralScanMargin is scanned below the lowest and above the highest channel frequency, to cover
+// the bandwidth of the channels
+const spectralScanMargin = 100000
+
+// SpectralScanConfig is the configuration of a spectral scan
+type SpectralScanConfig struct {
+	Step    uint32 // Frequency step, in Hz
+	Samples uint16 // RSSI samples measured at each frequency
+}
+
+// RSSIBin is a bin of the RSSI histogram of a frequency
+type RSSIBin struct {
+	RSSI  float64 `json:"rssi"`
+	Count uint16  `json:"count"`
+}
+
+// FrequencyScan is the result of the spectral scan of a frequency
+type FrequencyScan struct {
+	Frequency  uint32    `json:"frequency"`
+	NoiseFloor float64   `json:"noise_floor"` // Median RSSI, in dBm
+	Histogram  []RSSIBin `json:"histogram"`   // Non-empty bins only, from the highest to the lowest RSSI
+}
+
+// SpectralScan is the result of a spectral scan of the band of the frequency plan
+type SpectralScan struct {
+	Time        time.Time       `json:"time"`
+	Frequencies []FrequencyScan `json:"frequencies"`
+}
+
+// SpectralScanFrequencies returns the frequencies to scan to cover the channels of the frequency plan
+func SpectralScanFrequencies(conf util.SX1301Conf, step uint32) ([]uint32, error) {
+	if step == 0 {
+		return nil, errors.New("Spectral scan step can't be 0")
+	}
+	channels := conf.ChannelFrequencies()
+	if len(channels) == 0 {
+		return nil, errors.New("No channel enabled in the frequency plan")
+	}
+	min, max := channels[0], channels[0]
+	for _, frequency := range channels {
+		if frequency < min {
+			min = frequency
+		}
+		if frequency > max {
+			max = frequency
+		}
+	}
+
+	var frequencies []uint32
+	for frequency := uint32(min - spectralScanMargin); frequency <= uint32(max+spectralScanMargin); frequency += step {
+		frequencies = append(frequencies, frequency)
+	}
+	return frequencies, nil
+}
+
+func newFrequencyScan(histogram wrapper.RSSIHistogram, rssiOffset int) FrequencyScan {
+	scan := FrequencyScan{Frequency: histogram.Frequency}
+	var total int
+	for _, count := range histogram.Counts {
+		total += int(count)
+	}
+
+	var cumulated int
+	medianFound := false
+	for i, count := range histogram.Counts {
+		if count == 0 {
+			continue
+		}
+		rssi := wrapper.RSSIBin(i, rssiOffset)
+		scan.Histogram = append(scan.Histogram, RSSIBin{RSSI: rssi, Count: count})
+		cumulated += int(count)
+		if !medianFound && 2*cumulated >= total {
+			scan.NoiseFloor = rssi
+			medianFound = true
+		}
+	}
+	return scan
+}
+
+// RunSpectralScan scans the band of the frequency plan. The concentrator must not be started.
+func RunSpectralScan(ctx log.Interface, conf util.Config, scanConfig SpectralScanConfig) (*SpectralScan, error) {
+	frequencies, err := SpectralScanFrequencies(conf.Concentrator, scanConfig.Step)
+	if err != nil {
+		return nil, err
+	}
+	ctx.WithFields(log.Fields{
+		"From":    frequencies[0],
+		"To":      frequencies[len(frequencies)-1],
+		"Step":    scanConfig.Step,
+		"Samples": scanConfig.Samples,
+	}).Info("Starting spectral scan")
+
+	scan := &SpectralScan{Time: time.Now()}
+	histograms, err := wrapper.SpectralScan(ctx, conf, frequencies, scanConfig.Samples)
+	if err != nil {
+		return nil, err
+	}
+
+	var rssiOffset int
+	if lbt := conf.Concentrator.LbtConfig; lbt != nil {
+		rssiOffset = lbt.RssiOffset
+	}
+	for _, histogram := range histograms {
+		scan.Frequencies = append(scan.Frequencies, newFrequencyScan(histogram, rssiOffset))
+	}
+	return scan, nil
+}
+
+// WriteJSON writes the spectral scan as a JSON object on a single line
+func (s *SpectralScan) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(s)
+}
+
+// WriteCSV writes one line per histogram bin: time, frequency, noise floor, RSSI and count
+func (s *SpectralScan) WriteCSV(w io.Writer, header bool) error {
+	writer := csv.NewWriter(w)
+	if header {
+		writer.Write([]string{"time", "frequency", "noise_floor", "rssi", "count"})
+	}
+	scanTime := s.Time.UTC().Format(time.RFC3339)
+	for _, frequency := range s.Frequencies {
+		for _, bin := range frequency.Histogram {
+			writer.Write([]string{
+				scanTime,
+				strconv.FormatUint(uint64(frequency.Frequency), 10),
+				strconv.FormatFloat(frequency.NoiseFloor, 'f', 1, 64),
+				strconv.FormatFloat(bin.RSSI, 'f', 1, 64),
+				strconv.FormatUint(uint64(bin.Count), 10),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Write writes the spectral scan in the given format, json or csv
+func (s *SpectralScan) Write(w io.Writer, format string, header bool) error {
+	switch format {
+	case "json":
+		return s.WriteJSON(w)
+	case "csv":
+		return s.WriteCSV(w, header)
+	}
+	return fmt.Errorf("Unknown spectral scan output format %s (should be json or csv)", format)
+}
@@ -0,0 +1,245 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+)
+
+// DefaultStatsWindows are the windows over which the traffic statistics are computed, if none is specified
+var DefaultStatsWindows = []time.Duration{15 * time.Minute, time.Hour}
+
+// uplinkSample is the reception information of an uplink kept for the statistics
+type uplinkSample struct {
+	time      time.Time
+	frequency uint32
+	ifChain   uint8
+	datarate  string
+	status    uint8
+	rssi      float64
+	snr       float64
+}
+
+// Distribution summarises a set of values
+type Distribution struct {
+	Min    float64
+	Median float64
+	Max    float64
+}
+
+func newDistribution(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sort.Float64s(values)
+	return Distribution{
+		Min:    values[0],
+		Median: values[len(values)/2],
+		Max:    values[len(values)-1],
+	}
+}
+
+// CRCStats counts packets by CRC status
+type CRCStats struct {
+	Packets int
+	CRCOK   int
+	CRCBad  int
+	NoCRC   int
+}
+
+func (c *CRCStats) add(status uint8) {
+	c.Packets++
+	switch status {
+	case wrapper.StatusCRCOK:
+		c.CRCOK++
+	case wrapper.StatusCRCBAD:
+		c.CRCBad++
+	case wrapper.StatusNOCRC:
+		c.NoCRC++
+	}
+}
+
+// ChannelStats are the statistics of a reception channel
+type ChannelStats struct {
+	CRCStats
+	Frequency uint32
+	IFChain   uint8
+	RSSI      Distribution
+	SNR       Distribution
+	// NoiseFloor is the median of the noise power estimated from the RSSI and SNR of the packets, in dBm
+	NoiseFloor float64
+}
+
+// DatarateStats are the statistics of a datarate
+type DatarateStats struct {
+	CRCStats
+	Datarate string
+}
+
+// WindowStats are the traffic statistics over a window of time
+type WindowStats struct {
+	CRCStats
+	Window    time.Duration
+	Channels  []ChannelStats
+	Datarates []DatarateStats
+	// DeafChannels are the configured channel frequencies on which no packet was received
+	DeafChannels []int
+}
+
+// TrafficStats keeps the reception information of the uplinks received over the longest window
+type TrafficStats struct {
+	mutex    sync.Mutex
+	windows  []time.Duration
+	channels []int
+	samples  []uplinkSample // In reception order
+}
+
+// NewTrafficStats returns a TrafficStats computing statistics over the given windows. channels are
+// the configured channel frequencies, used to detect the channels on which nothing is received.
+func NewTrafficStats(windows []time.Duration, channels []int) *TrafficStats {
+	if len(windows) == 0 {
+		windows = DefaultStatsWindows
+	}
+	sorted := append([]time.Duration{}, windows...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &TrafficStats{
+		windows:  sorted,
+		channels: channels,
+	}
+}
+
+// Windows returns the windows over which the statistics are computed, from the shortest to the longest
+func (t *TrafficStats) Windows() []time.Duration {
+	return t.windows
+}
+
+func packetDatarate(packet wrapper.Packet) string {
+	if packet.Modulation == wrapper.ModulationFSK {
+		return fmt.Sprintf("FSK%d", packet.Datarate)
+	}
+	datarate, err := packet.DatarateString()
+	if err != nil {
+		return "unknown"
+	}
+	bandwidth, err := packet.BandwidthString()
+	if err != nil {
+		return "unknown"
+	}
+	return datarate + bandwidth
+}
+
+// Record adds the packets to the statistics, and drops the packets older than the longest window
+func (t *TrafficStats) Record(packets []wrapper.Packet) {
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, packet := range packets {
+		t.samples = append(t.samples, uplinkSample{
+			time:      now,
+			frequency: packet.Freq,
+			ifChain:   packet.IFChain,
+			datarate:  packetDatarate(packet),
+			status:    packet.Status,
+			rssi:      float64(packet.RSSI),
+			snr:       float64(packet.SNR),
+		})
+	}
+
+	cutoff := now.Add(-t.windows[len(t.windows)-1])
+	expired := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].time.After(cutoff) })
+	if expired > 0 {
+		t.samples = append(t.samples[:0], t.samples[expired:]...)
+	}
+}
+
+// noisePower estimates the noise power in the channel from the RSSI, which measures the signal and
+// noise power, and the SNR
+func noisePower(rssi, snr float64) float64 {
+	return rssi - 10*math.Log10(1+math.Pow(10, snr/10))
+}
+
+type channelKey struct {
+	frequency uint32
+	ifChain   uint8
+}
+
+type channelValues struct {
+	stats ChannelStats
+	rssi  []float64
+	snr   []float64
+	noise []float64
+}
+
+// Window computes the statistics of the packets received over the window
+func (t *TrafficStats) Window(window time.Duration) WindowStats {
+	stats := WindowStats{Window: window}
+	channels := make(map[channelKey]*channelValues)
+	datarates := make(map[string]*DatarateStats)
+
+	cutoff := time.Now().Add(-window)
+	t.mutex.Lock()
+	start := sort.Search(len(t.samples), func(i int) bool { return t.samples[i].time.After(cutoff) })
+	for _, sample := range t.samples[start:] {
+		stats.add(sample.status)
+
+		key := channelKey{frequency: sample.frequency, ifChain: sample.ifChain}
+		channel, ok := channels[key]
+		if !ok {
+			channel = &channelValues{stats: ChannelStats{Frequency: sample.frequency, IFChain: sample.ifChain}}
+			channels[key] = channel
+		}
+		channel.stats.add(sample.status)
+		channel.rssi = append(channel.rssi, sample.rssi)
+		channel.snr = append(channel.snr, sample.snr)
+		channel.noise = append(channel.noise, noisePower(sample.rssi, sample.snr))
+
+		datarate, ok := datarates[sample.datarate]
+		if !ok {
+			datarate = &DatarateStats{Datarate: sample.datarate}
+			datarates[sample.datarate] = datarate
+		}
+		datarate.add(sample.status)
+	}
+	t.mutex.Unlock()
+
+	for _, channel := range channels {
+		channel.stats.RSSI = newDistribution(channel.rssi)
+		channel.stats.SNR = newDistribution(channel.snr)
+		channel.stats.NoiseFloor = newDistribution(channel.noise).Median
+		stats.Channels = append(stats.Channels, channel.stats)
+	}
+	sort.Slice(stats.Channels, func(i, j int) bool {
+		if stats.Channels[i].Frequency != stats.Channels[j].Frequency {
+			return stats.Channels[i].Frequency < stats.Channels[j].Frequency
+		}
+		return stats.Channels[i].IFChain < stats.Channels[j].IFChain
+	})
+
+	for _, datarate := range datarates {
+		stats.Datarates = append(stats.Datarates, *datarate)
+	}
+	sort.Slice(stats.Datarates, func(i, j int) bool { return stats.Datarates[i].Datarate < stats.Datarates[j].Datarate })
+
+	if stats.Packets > 0 {
+		for _, frequency := range t.channels {
+			deaf := true
+			for _, channel := range stats.Channels {
+				if int(channel.Frequency) == frequency {
+					deaf = false
+					break
+				}
+			}
+			if deaf {
+				stats.DeafChannels = append(stats.DeafChannels, frequency)
+			}
+		}
+	}
+
+	return stats
+}
@@ -3,12 +3,16 @@
 package pktfwd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/TheThingsNetwork/go-account-lib/account"
 	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/packet_forwarder/util"
 	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
@@ -24,41 +28,101 @@ type StatusManager interface {
 	HandledRXBatch(received, valid int)
 	ReceivedTX()
 	SentTX()
+	BlockedTX()
+	RecordUplinks(packets []wrapper.Packet)
+	Counters() StatusCounters
 	GenerateStatus(rtt time.Duration) (*gateway.Status, error)
 }
 
-func NewStatusManager(ctx log.Interface, frequencyPlan string, gatewayDescription string, isGPSChip bool, antennaLocation *account.AntennaLocation) StatusManager {
-	if antennaLocation == nil {
-		ctx.Warn("Antenna location unavailable from the account server")
+// StatusCounters are the packet counters of the gateway since the packet forwarder started
+type StatusCounters struct {
+	RxIn      uint32
+	RxOk      uint32
+	TxIn      uint32
+	TxOk      uint32
+	TxBlocked uint32
+}
+
+// GatewayInfo is the information on the gateway and its software sent with the status messages
+type GatewayInfo struct {
+	Description   string
+	FrequencyPlan string
+	// FrequencyPlanHash identifies the frequency plan applied to the concentrator
+	FrequencyPlanHash string
+	HALVersion        string
+	Version           string
+	Commit            string
+}
+
+// frequencyPlanHash returns the SHA-256 hash of a frequency plan, to tell whether gateways run the
+// same frequency plan
+func frequencyPlanHash(conf util.Config) string {
+	content, err := json.Marshal(conf)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// platformDescription describes the packet forwarder build, and the platform it runs on
+func (i GatewayInfo) platformDescription() string {
+	description := fmt.Sprintf("TTN Packet Forwarder %s (%s)", i.Version, i.Commit)
+	if platform != "" {
+		description = fmt.Sprintf("%s - %s", description, platform)
 	}
+	return fmt.Sprintf("%s - %s/%s", description, runtime.GOOS, runtime.GOARCH)
+}
+
+func NewStatusManager(ctx log.Interface, info GatewayInfo, gps *GPSState, location *LocationResolver, lbtEnabled bool, stats *TrafficStats, telemetry *Telemetry) StatusManager {
 	return &statusManager{
-		antennaLocation:    antennaLocation,
-		ctx:                ctx,
-		isGPSChip:          isGPSChip,
-		rxIn:               0,
-		rxOk:               0,
-		txIn:               0,
-		txOk:               0,
-		frequencyPlan:      frequencyPlan,
-		gatewayDescription: gatewayDescription,
+		stats:      stats,
+		telemetry:  telemetry,
+		lbtEnabled: lbtEnabled,
+		location:   location,
+		ctx:        ctx,
+		gps:        gps,
+		rxIn:       0,
+		rxOk:       0,
+		txIn:       0,
+		txOk:       0,
+		info:       info,
 	}
 }
 
 type statusManager struct {
-	antennaLocation    *account.AntennaLocation
-	ctx                log.Interface
-	isGPSChip          bool
-	rxIn               uint32
-	rxOk               uint32
-	txIn               uint32
-	txOk               uint32
-	frequencyPlan      string
-	gatewayDescription string
-	bootTime           *time.Time
+	location   *LocationResolver
+	ctx        log.Interface
+	gps        *GPSState
+	rxIn       uint32
+	rxOk       uint32
+	txIn       uint32
+	txOk       uint32
+	lbtEnabled bool
+	txBlocked  uint32 // Downlinks not transmitted because of listen-before-talk
+	stats      *TrafficStats
+	telemetry  *Telemetry
+	info       GatewayInfo
+
+	// bootTimeMutex guards bootTime, set by the uplink routine and read by the status routine
+	bootTimeMutex sync.Mutex
+	bootTime      time.Time
 }
 
 func (s *statusManager) SetBootTime(t time.Time) {
-	s.bootTime = &t
+	s.bootTimeMutex.Lock()
+	s.bootTime = t
+	s.bootTimeMutex.Unlock()
+}
+
+// uptime returns the time since the concentrator booted, or 0 if its boot time is unknown
+func (s *statusManager) uptime() time.Duration {
+	s.bootTimeMutex.Lock()
+	defer s.bootTimeMutex.Unlock()
+	if s.bootTime.IsZero() {
+		return 0
+	}
+	return time.Now().Sub(s.bootTime)
 }
 
 func (s *statusManager) ReceivedTX() {
@@ -69,16 +133,91 @@ func (s *statusManager) SentTX() {
 	atomic.AddUint32(&s.txOk, 1)
 }
 
+func (s *statusManager) BlockedTX() {
+	atomic.AddUint32(&s.txBlocked, 1)
+}
+
 func (s *statusManager) HandledRXBatch(received, valid int) {
 	atomic.AddUint32(&s.rxIn, uint32(received))
 	atomic.AddUint32(&s.rxOk, uint32(valid))
 }
 
+func (s *statusManager) RecordUplinks(packets []wrapper.Packet) {
+	s.stats.Record(packets)
+}
+
+func (s *statusManager) Counters() StatusCounters {
+	return StatusCounters{
+		RxIn:      atomic.LoadUint32(&s.rxIn),
+		RxOk:      atomic.LoadUint32(&s.rxOk),
+		TxIn:      atomic.LoadUint32(&s.txIn),
+		TxOk:      atomic.LoadUint32(&s.txOk),
+		TxBlocked: atomic.LoadUint32(&s.txBlocked),
+	}
+}
+
+// readTelemetry reads the telemetry of the gateway, warns about the values beyond their thresholds
+// and reports the temperature of the gateway in the OS metrics
+func (s *statusManager) readTelemetry(osInfo *gateway.Status_OSMetrics) {
+	readings := s.telemetry.Read()
+	s.telemetry.Check(readings)
+	if temperature, ok := gatewayTemperature(readings); ok {
+		osInfo.Temperature = float32(temperature)
+	}
+	fields := log.Fields{}
+	for _, reading := range readings {
+		fields[reading.String()] = reading.Value
+	}
+	s.ctx.WithFields(fields).Debug("Gateway telemetry")
+}
+
+// logTrafficStats logs the traffic statistics of each window, and warns about the configured channels
+// on which nothing was received while the other channels had traffic
+func (s *statusManager) logTrafficStats() {
+	for _, window := range s.stats.Windows() {
+		stats := s.stats.Window(window)
+		ctx := s.ctx.WithField("Window", window)
+		ctx.WithFields(log.Fields{
+			"Packets": stats.Packets,
+			"CRCOK":   stats.CRCOK,
+			"CRCBad":  stats.CRCBad,
+			"NoCRC":   stats.NoCRC,
+		}).Info("Uplink traffic statistics")
+		for _, channel := range stats.Channels {
+			ctx.WithFields(log.Fields{
+				"Frequency":  channel.Frequency,
+				"IFChain":    channel.IFChain,
+				"Packets":    channel.Packets,
+				"CRCOK":      channel.CRCOK,
+				"CRCBad":     channel.CRCBad,
+				"NoCRC":      channel.NoCRC,
+				"RSSIMin":    channel.RSSI.Min,
+				"RSSIMedian": channel.RSSI.Median,
+				"RSSIMax":    channel.RSSI.Max,
+				"SNRMin":     channel.SNR.Min,
+				"SNRMedian":  channel.SNR.Median,
+				"SNRMax":     channel.SNR.Max,
+				"NoiseFloor": channel.NoiseFloor,
+			}).Debug("Channel traffic statistics")
+		}
+		for _, datarate := range stats.Datarates {
+			ctx.WithFields(log.Fields{
+				"Datarate": datarate.Datarate,
+				"Packets":  datarate.Packets,
+				"CRCOK":    datarate.CRCOK,
+				"CRCBad":   datarate.CRCBad,
+				"NoCRC":    datarate.NoCRC,
+			}).Debug("Datarate traffic statistics")
+		}
+		for _, frequency := range stats.DeafChannels {
+			ctx.WithField("Frequency", frequency).Warn("No uplink received on channel while other channels received traffic")
+		}
+	}
+}
+
 func getOSInfo() *gateway.Status_OSMetrics {
+	// The temperature is read from the telemetry sources, see readTelemetry
 	osInfo := &gateway.Status_OSMetrics{}
-	/* Temperature not yet implemented due to disparities between
-	platforms (no standard way of getting temperature from a platform
-	to another: see https://github.com/shirou/gopsutil/issues/329) */
 
 	stats, err := cpu.Times(false)
 	if err == nil && len(stats) > 0 {
@@ -103,23 +242,20 @@ func getOSInfo() *gateway.Status_OSMetrics {
 }
 
 func (s *statusManager) GenerateStatus(rtt time.Duration) (*gateway.Status, error) {
-	var concentratorBootTime time.Duration
-	if s.bootTime == nil {
-		concentratorBootTime = 0
-	} else {
-		concentratorBootTime = time.Now().Sub(*s.bootTime)
-	}
+	concentratorBootTime := s.uptime()
 
 	osInfo := getOSInfo()
+	s.readTelemetry(osInfo)
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return nil, errors.Wrap(err, "Net interfaces obtention error")
 	}
 
+	// Link-local IPv6 addresses are left out, as they are only reachable from the local network
 	ips := make([]string, 0)
 	for _, a := range addrs {
 		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
+			if ipnet.IP.To4() != nil || !ipnet.IP.IsLinkLocalUnicast() {
 				ips = append(ips, ipnet.IP.String())
 			}
 		}
@@ -129,12 +265,13 @@ func (s *statusManager) GenerateStatus(rtt time.Duration) (*gateway.Status, erro
 		Timestamp:      uint32(util.TXTimestampFromDuration(concentratorBootTime)),
 		Time:           time.Now().UnixNano(),
 		GatewayTrusted: true,
-		Region:         s.frequencyPlan,
+		Region:         s.info.FrequencyPlan,
 		Ip:             ips,
-		Platform:       runtime.GOOS,
+		Platform:       s.info.platformDescription(),
+		Hal:            s.info.HALVersion,
 		// Contact-email: TODO once it has been implemented on the account server
 		ContactEmail: "",
-		Description:  s.gatewayDescription,
+		Description:  s.info.Description,
 		Rtt:          uint32(rtt.Nanoseconds() / 1000000),
 		RxIn:         atomic.LoadUint32(&s.rxIn),
 		RxOk:         atomic.LoadUint32(&s.rxOk),
@@ -142,34 +279,64 @@ func (s *statusManager) GenerateStatus(rtt time.Duration) (*gateway.Status, erro
 		TxOk:         atomic.LoadUint32(&s.txOk),
 		Os:           osInfo,
 	}
+	if s.info.FrequencyPlanHash != "" {
+		status.Messages = append(status.Messages, "frequency-plan-sha256="+s.info.FrequencyPlanHash)
+	}
 
-	coordinates := new(gateway.GPSMetadata)
-	if s.antennaLocation != nil { // Antenna location accessible from the account server
-		if s.antennaLocation.Latitude != nil {
-			coordinates.Latitude = float32(*s.antennaLocation.Latitude)
-		}
-		if s.antennaLocation.Longitude != nil {
-			coordinates.Longitude = float32(*s.antennaLocation.Longitude)
-		}
-		if s.antennaLocation.Altitude != nil {
-			coordinates.Altitude = int32(*s.antennaLocation.Altitude)
-		}
+	s.logTrafficStats()
+
+	if s.lbtEnabled {
+		txBlocked := atomic.LoadUint32(&s.txBlocked)
+		s.ctx.WithFields(log.Fields{
+			"TxIn":      status.TxIn,
+			"TxOk":      status.TxOk,
+			"TxBlocked": txBlocked,
+		}).Info("Listen-before-talk statistics")
+		// The status has no field for the downlinks blocked by listen-before-talk
+		status.Messages = append(status.Messages, fmt.Sprintf("lbt tx-blocked=%d", txBlocked))
 	}
 
-	if s.isGPSChip { // GPS chip available
-		gpsChipCoordinates, err := wrapper.GetGPSCoordinates()
-		if err != nil {
-			s.ctx.WithError(err).Warn("Unable to retrieve GPS coordinates from the GPS hardware")
+	if location, ok := s.location.Location(); ok {
+		status.Gps = location.Metadata(0)
+		status.Messages = append(status.Messages, location.Message())
+		s.ctx.WithFields(log.Fields{
+			"LocationSource":   location.Source,
+			"LocationAccuracy": location.Accuracy,
+		}).Info("Gateway location")
+	} else {
+		status.Gps = new(gateway.GPSMetadata)
+	}
+
+	if s.gps != nil { // GPS chip available
+		fix := s.gps.Fix()
+		s.ctx.WithFields(log.Fields{
+			"FixValid":           fix.Valid,
+			"FixQuality":         fix.Quality.String(),
+			"FixMode":            fix.Mode.String(),
+			"SatellitesUsed":     fix.SatellitesUsed,
+			"SatellitesInView":   fix.SatellitesInView,
+			"HDOP":               fix.HDOP,
+			"HorizontalAccuracy": fix.HorizontalAccuracy,
+			"VerticalAccuracy":   fix.VerticalAccuracy,
+		}).Info("GPS fix state")
+
+		timeSync := wrapper.GetGPSTimeSync()
+		ctx := s.ctx.WithFields(log.Fields{
+			"TimeSyncState": timeSync.State.String(),
+			"SyncAge":       timeSync.Age,
+			"SyncFailures":  timeSync.Failures,
+			"DriftPPM":      timeSync.DriftPPM,
+		})
+		if timeSync.State == wrapper.TimeSyncLost {
+			ctx.Warn("GPS time synchronisation lost, uplinks are not timestamped with the GPS time")
 		} else {
-			coordinates = &gateway.GPSMetadata{
-				Latitude:  float32(gpsChipCoordinates.Latitude),
-				Longitude: float32(gpsChipCoordinates.Longitude),
-				Altitude:  int32(gpsChipCoordinates.Altitude),
-			}
+			ctx.Info("GPS time synchronisation state")
 		}
-	}
 
-	status.Gps = coordinates
+		// The status has no GPS fix field, the fix state is sent as a message
+		status.Messages = append(status.Messages, fmt.Sprintf("gps-fix=%s valid=%t quality=%s satellites=%d/%d hdop=%.1f time-sync=%s",
+			fix.Mode.String(), fix.Valid, fix.Quality.String(), fix.SatellitesUsed, fix.SatellitesInView, fix.HDOP, timeSync.State.String()))
+	}
 
 	return status, nil
 }
@@ -0,0 +1,309 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+)
+
+// Telemetry values
+const (
+	TelemetrySoCTemperature          = "soc_temperature_celsius"
+	TelemetryConcentratorTemperature = "concentrator_temperature_celsius"
+	TelemetrySupplyVoltage           = "supply_voltage_volts"
+	TelemetryDiskFree                = "disk_free_bytes"
+)
+
+const (
+	sysfsThermal     = "/sys/class/thermal"
+	sysfsPowerSupply = "/sys/class/power_supply"
+	// telemetryDiskPath is the file system whose free space is measured
+	telemetryDiskPath = "/"
+)
+
+// TelemetryReading is a value measured on the gateway. Labels tell apart the readings of the same
+// value, such as the temperatures of several thermal zones.
+type TelemetryReading struct {
+	Name   string
+	Value  float64
+	Labels map[string]string
+}
+
+func (r TelemetryReading) String() string {
+	if len(r.Labels) == 0 {
+		return r.Name
+	}
+	labels := make([]string, 0, len(r.Labels))
+	for key, value := range r.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%q", key, value))
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%s{%s}", r.Name, strings.Join(labels, ","))
+}
+
+// TelemetrySource reads telemetry values of the gateway. A source returns no reading if the
+// platform doesn't expose its values.
+type TelemetrySource interface {
+	Name() string
+	Read() ([]TelemetryReading, error)
+}
+
+// thermalSource reads the temperature of the thermal zones of the SoC
+type thermalSource struct {
+	dir string
+}
+
+// NewThermalSource returns a TelemetrySource reading the temperature of the thermal zones exposed in dir
+func NewThermalSource(dir string) TelemetrySource {
+	return thermalSource{dir: dir}
+}
+
+func (s thermalSource) Name() string { return "thermal" }
+
+func (s thermalSource) Read() ([]TelemetryReading, error) {
+	zones, err := filepath.Glob(filepath.Join(s.dir, "thermal_zone*"))
+	if err != nil {
+		return nil, err
+	}
+	var readings []TelemetryReading
+	for _, zone := range zones {
+		milliCelsius, err := readSysfsFloat(filepath.Join(zone, "temp"))
+		if err != nil {
+			continue
+		}
+		zoneType, err := ioutil.ReadFile(filepath.Join(zone, "type"))
+		if err != nil {
+			zoneType = []byte(filepath.Base(zone))
+		}
+		readings = append(readings, TelemetryReading{
+			Name:   TelemetrySoCTemperature,
+			Value:  milliCelsius / 1000,
+			Labels: map[string]string{"zone": strings.TrimSpace(string(zoneType))},
+		})
+	}
+	return readings, nil
+}
+
+// concentratorSource reads the temperature of the concentrator, if the HAL exposes it
+type concentratorSource struct {
+	// lock is held while the concentrator is read
+	lock sync.Locker
+}
+
+// NewConcentratorSource returns a TelemetrySource reading the temperature of the concentrator
+func NewConcentratorSource(concentratorLock sync.Locker) TelemetrySource {
+	return concentratorSource{lock: concentratorLock}
+}
+
+func (s concentratorSource) Name() string { return "concentrator" }
+
+func (s concentratorSource) Read() ([]TelemetryReading, error) {
+	s.lock.Lock()
+	temperature, err := wrapper.GetConcentratorTemperature()
+	s.lock.Unlock()
+	if err != nil {
+		return nil, nil
+	}
+	return []TelemetryReading{{
+		Name:  TelemetryConcentratorTemperature,
+		Value: float64(temperature),
+	}}, nil
+}
+
+// supplySource reads the voltage of the power supplies exposed by the board
+type supplySource struct {
+	dir string
+}
+
+// NewSupplySource returns a TelemetrySource reading the voltage of the power supplies exposed in dir
+func NewSupplySource(dir string) TelemetrySource {
+	return supplySource{dir: dir}
+}
+
+func (s supplySource) Name() string { return "supply" }
+
+func (s supplySource) Read() ([]TelemetryReading, error) {
+	supplies, err := filepath.Glob(filepath.Join(s.dir, "*", "voltage_now"))
+	if err != nil {
+		return nil, err
+	}
+	var readings []TelemetryReading
+	for _, supply := range supplies {
+		microVolts, err := readSysfsFloat(supply)
+		if err != nil {
+			continue
+		}
+		readings = append(readings, TelemetryReading{
+			Name:   TelemetrySupplyVoltage,
+			Value:  microVolts / 1e6,
+			Labels: map[string]string{"supply": filepath.Base(filepath.Dir(supply))},
+		})
+	}
+	return readings, nil
+}
+
+// diskSource reads the free space of a file system
+type diskSource struct {
+	path string
+}
+
+// NewDiskSource returns a TelemetrySource reading the free space of the file system of path
+func NewDiskSource(path string) TelemetrySource {
+	return diskSource{path: path}
+}
+
+func (s diskSource) Name() string { return "disk" }
+
+func (s diskSource) Read() ([]TelemetryReading, error) {
+	free, err := diskFree(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return []TelemetryReading{{
+		Name:   TelemetryDiskFree,
+		Value:  float64(free),
+		Labels: map[string]string{"path": s.path},
+	}}, nil
+}
+
+func readSysfsFloat(path string) (float64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+}
+
+// TelemetryThresholds are the limits beyond which a telemetry value raises a warning. A zero
+// threshold is disabled.
+type TelemetryThresholds struct {
+	MaxSoCTemperature          float64
+	MaxConcentratorTemperature float64
+	MinSupplyVoltage           float64
+	MinDiskFree                uint64 // In bytes
+}
+
+// check returns the reason of the warning raised by the reading, if any
+func (t TelemetryThresholds) check(reading TelemetryReading) (string, bool) {
+	switch reading.Name {
+	case TelemetrySoCTemperature:
+		if t.MaxSoCTemperature != 0 && reading.Value > t.MaxSoCTemperature {
+			return fmt.Sprintf("SoC temperature above %.1f°C", t.MaxSoCTemperature), true
+		}
+	case TelemetryConcentratorTemperature:
+		if t.MaxConcentratorTemperature != 0 && reading.Value > t.MaxConcentratorTemperature {
+			return fmt.Sprintf("Concentrator temperature above %.1f°C", t.MaxConcentratorTemperature), true
+		}
+	case TelemetrySupplyVoltage:
+		if t.MinSupplyVoltage != 0 && reading.Value < t.MinSupplyVoltage {
+			return fmt.Sprintf("Supply voltage below %.2fV", t.MinSupplyVoltage), true
+		}
+	case TelemetryDiskFree:
+		if t.MinDiskFree != 0 && reading.Value < float64(t.MinDiskFree) {
+			return fmt.Sprintf("Free disk space below %d bytes", t.MinDiskFree), true
+		}
+	}
+	return "", false
+}
+
+// Telemetry reads the telemetry values of the gateway from its sources, and warns about the values
+// beyond their thresholds
+type Telemetry struct {
+	ctx        log.Interface
+	sources    []TelemetrySource
+	thresholds TelemetryThresholds
+	events     *EventJournal
+
+	mutex sync.Mutex
+	// warnings are the readings beyond their thresholds at the last check
+	warnings map[string]bool
+}
+
+// NewTelemetry returns a Telemetry reading the given sources
+func NewTelemetry(ctx log.Interface, sources []TelemetrySource, thresholds TelemetryThresholds, events *EventJournal) *Telemetry {
+	return &Telemetry{
+		ctx:        ctx,
+		sources:    sources,
+		thresholds: thresholds,
+		events:     events,
+		warnings:   make(map[string]bool),
+	}
+}
+
+// DefaultTelemetrySources are the telemetry sources of a gateway. concentratorLock is held while
+// the concentrator is read.
+func DefaultTelemetrySources(concentratorLock sync.Locker) []TelemetrySource {
+	return []TelemetrySource{
+		NewThermalSource(sysfsThermal),
+		NewConcentratorSource(concentratorLock),
+		NewSupplySource(sysfsPowerSupply),
+		NewDiskSource(telemetryDiskPath),
+	}
+}
+
+// Read returns the readings of all sources
+func (t *Telemetry) Read() []TelemetryReading {
+	var readings []TelemetryReading
+	for _, source := range t.sources {
+		sourceReadings, err := source.Read()
+		if err != nil {
+			t.ctx.WithError(err).WithField("Source", source.Name()).Debug("Couldn't read telemetry")
+			continue
+		}
+		readings = append(readings, sourceReadings...)
+	}
+	return readings
+}
+
+// Check warns about the readings beyond their thresholds. An event is recorded when a value goes
+// beyond its threshold.
+func (t *Telemetry) Check(readings []TelemetryReading) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	warnings := make(map[string]bool)
+	for _, reading := range readings {
+		reason, warning := t.thresholds.check(reading)
+		if !warning {
+			continue
+		}
+		key := reading.String()
+		warnings[key] = true
+		fields := log.Fields{"Reading": key, "Value": reading.Value}
+		t.ctx.WithFields(fields).Warn(reason)
+		if !t.warnings[key] {
+			t.events.Record(EventTelemetryWarning, reason, fields)
+		}
+	}
+	t.warnings = warnings
+}
+
+// maxReading returns the highest value of the readings with the name
+func maxReading(readings []TelemetryReading, name string) (float64, bool) {
+	var max float64
+	found := false
+	for _, reading := range readings {
+		if reading.Name == name && (!found || reading.Value > max) {
+			max = reading.Value
+			found = true
+		}
+	}
+	return max, found
+}
+
+// gatewayTemperature is the temperature reported in the gateway status: the highest temperature of
+// the SoC, or of the concentrators if the SoC temperature isn't available
+func gatewayTemperature(readings []TelemetryReading) (float64, bool) {
+	if temperature, ok := maxReading(readings, TelemetrySoCTemperature); ok {
+		return temperature, true
+	}
+	return maxReading(readings, TelemetryConcentratorTemperature)
+}
@@ -0,0 +1,11 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+// +build !linux
+
+package pktfwd
+
+import "github.com/pkg/errors"
+
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("Disk space measurement is only supported on Linux")
+}
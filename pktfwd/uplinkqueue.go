@@ -0,0 +1,236 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/ttn/api/router"
+)
+
+// congestionThreshold is the fill ratio of a queue above which the uplink pipeline is congested
+const congestionThreshold = 0.75
+
+// UplinkPriority is the priority of an uplink in the uplink pipeline. Lower values are sent first.
+type UplinkPriority int
+
+// Uplink priorities
+const (
+	UplinkPriorityJoin UplinkPriority = iota
+	UplinkPriorityConfirmed
+	UplinkPriorityUnconfirmed
+	nbUplinkPriorities
+)
+
+var uplinkPriorityNames = [nbUplinkPriorities]string{"join", "confirmed", "unconfirmed"}
+
+func (p UplinkPriority) String() string {
+	return uplinkPriorityNames[p]
+}
+
+// LoRaWAN message types, in the 3 most significant bits of the MHDR
+const (
+	mTypeJoinRequest     = 0
+	mTypeUnconfirmedDown = 3
+	mTypeConfirmedUp     = 4
+	mTypeConfirmedDown   = 5
+	mTypeRejoinRequest   = 6
+)
+
+// uplinkPriority returns the priority of an uplink from its LoRaWAN message type: join requests
+// are the most time-critical, as the end device waits for the join accept
+func uplinkPriority(message *router.UplinkMessage) UplinkPriority {
+	if len(message.Payload) == 0 {
+		return UplinkPriorityUnconfirmed
+	}
+	switch message.Payload[0] >> 5 {
+	case mTypeJoinRequest, mTypeRejoinRequest:
+		return UplinkPriorityJoin
+	case mTypeConfirmedUp:
+		return UplinkPriorityConfirmed
+	}
+	return UplinkPriorityUnconfirmed
+}
+
+// DropPolicy decides which uplink is dropped when a queue is full
+type DropPolicy string
+
+// Drop policies
+const (
+	DropOldest DropPolicy = "drop-oldest"
+	DropNewest DropPolicy = "drop-newest"
+)
+
+// ParseDropPolicy returns the drop policy named s
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch policy := DropPolicy(s); policy {
+	case DropOldest, DropNewest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unknown drop policy %s (should be %s or %s)", s, DropOldest, DropNewest)
+}
+
+// UplinkQueueStats counts the uplinks handled by a queue since the start of the packet forwarder
+type UplinkQueueStats struct {
+	Queued  uint64
+	Dropped uint64
+	Sent    uint64
+	Failed  uint64
+	Pending int
+}
+
+// uplinkQueue is a bounded FIFO of uplinks of the same priority
+type uplinkQueue struct {
+	mutex    sync.Mutex
+	messages []*router.UplinkMessage
+	capacity int
+	policy   DropPolicy
+	stats    UplinkQueueStats
+}
+
+func newUplinkQueue(capacity int, policy DropPolicy) *uplinkQueue {
+	return &uplinkQueue{
+		messages: make([]*router.UplinkMessage, 0, capacity),
+		capacity: capacity,
+		policy:   policy,
+	}
+}
+
+// push queues the message, and returns false if an uplink was dropped
+func (q *uplinkQueue) push(message *router.UplinkMessage) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stats.Queued++
+	accepted := true
+	if len(q.messages) >= q.capacity {
+		q.stats.Dropped++
+		accepted = false
+		if q.policy == DropNewest {
+			return false
+		}
+		q.messages = q.messages[1:]
+	}
+	q.messages = append(q.messages, message)
+	return accepted
+}
+
+// batch removes and returns up to max of the oldest uplinks of the queue
+func (q *uplinkQueue) batch(max int) []*router.UplinkMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.messages) < max {
+		max = len(q.messages)
+	}
+	batch := make([]*router.UplinkMessage, max)
+	copy(batch, q.messages)
+	q.messages = q.messages[max:]
+	return batch
+}
+
+// sent records the outcome of the transmission of a batch
+func (q *uplinkQueue) sent(sent, failed int) {
+	q.mutex.Lock()
+	q.stats.Sent += uint64(sent)
+	q.stats.Failed += uint64(failed)
+	q.mutex.Unlock()
+}
+
+func (q *uplinkQueue) congested() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return float64(len(q.messages)) > congestionThreshold*float64(q.capacity)
+}
+
+func (q *uplinkQueue) getStats() UplinkQueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	stats := q.stats
+	stats.Pending = len(q.messages)
+	return stats
+}
+
+// UplinkBackpressure is returned to the uplink routine when uplinks are queued
+type UplinkBackpressure struct {
+	// Dropped is the number of uplinks dropped because the queues were full
+	Dropped int
+	// Congested is true if a queue is close to full
+	Congested bool
+}
+
+// uplinkPipeline holds one bounded queue per priority. Queuing never blocks: when a queue is
+// full, an uplink is dropped according to the drop policy. The queues are drained by a single
+// sender, in priority order.
+type uplinkPipeline struct {
+	queues    [nbUplinkPriorities]*uplinkQueue
+	batchSize int
+	// notify is signalled when uplinks are queued
+	notify chan struct{}
+}
+
+func newUplinkPipeline(capacity, batchSize int, policy DropPolicy) *uplinkPipeline {
+	p := &uplinkPipeline{
+		batchSize: batchSize,
+		notify:    make(chan struct{}, 1),
+	}
+	for i := range p.queues {
+		p.queues[i] = newUplinkQueue(capacity, policy)
+	}
+	return p
+}
+
+// next removes and returns the next batch to send: the oldest uplinks of the queue with the highest
+// priority that isn't empty. As the sender takes a new batch after each batch, uplinks of a higher
+// priority wait at most for the batch being sent.
+func (p *uplinkPipeline) next() (UplinkPriority, []*router.UplinkMessage) {
+	for priority, queue := range p.queues {
+		if batch := queue.batch(p.batchSize); len(batch) > 0 {
+			return UplinkPriority(priority), batch
+		}
+	}
+	return 0, nil
+}
+
+// push queues the messages. The messages are not copied, and must not be modified afterwards.
+func (p *uplinkPipeline) push(messages []router.UplinkMessage) UplinkBackpressure {
+	var backpressure UplinkBackpressure
+	for i := range messages {
+		message := &messages[i]
+		queue := p.queues[uplinkPriority(message)]
+		if !queue.push(message) {
+			backpressure.Dropped++
+		}
+		if queue.congested() {
+			backpressure.Congested = true
+		}
+	}
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+	return backpressure
+}
+
+// stats returns the statistics of the queues, indexed by priority
+func (p *uplinkPipeline) stats() [nbUplinkPriorities]UplinkQueueStats {
+	var stats [nbUplinkPriorities]UplinkQueueStats
+	for priority, queue := range p.queues {
+		stats[priority] = queue.getStats()
+	}
+	return stats
+}
+
+// logStats logs the statistics of the queues
+func (p *uplinkPipeline) logStats(ctx log.Interface) {
+	for priority, stats := range p.stats() {
+		ctx.WithFields(log.Fields{
+			"Priority": UplinkPriority(priority),
+			"Queued":   stats.Queued,
+			"Dropped":  stats.Dropped,
+			"Sent":     stats.Sent,
+			"Failed":   stats.Failed,
+			"Pending":  stats.Pending,
+		}).Info("Uplink queue statistics")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TheThingsNetwork/ttn/api/router"
+)
+
+// testUplink returns an uplink of the LoRaWAN message type, identified by its second byte
+func testUplink(mType byte, id byte) router.UplinkMessage {
+	return router.UplinkMessage{Payload: []byte{mType << 5, id}}
+}
+
+func uplinkIDs(messages []*router.UplinkMessage) []byte {
+	ids := make([]byte, len(messages))
+	for i, message := range messages {
+		ids[i] = message.Payload[1]
+	}
+	return ids
+}
+
+func TestUplinkPriority(t *testing.T) {
+	for _, tc := range []struct {
+		payload  []byte
+		expected UplinkPriority
+	}{
+		{[]byte{mTypeJoinRequest << 5}, UplinkPriorityJoin},
+		{[]byte{mTypeRejoinRequest << 5}, UplinkPriorityJoin},
+		{[]byte{mTypeConfirmedUp << 5}, UplinkPriorityConfirmed},
+		{[]byte{2 << 5}, UplinkPriorityUnconfirmed},
+		{[]byte{7 << 5}, UplinkPriorityUnconfirmed},
+		{nil, UplinkPriorityUnconfirmed},
+	} {
+		if actual := uplinkPriority(&router.UplinkMessage{Payload: tc.payload}); actual != tc.expected {
+			t.Errorf("%x: expected %s, got %s", tc.payload, tc.expected, actual)
+		}
+	}
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	for _, name := range []string{"drop-oldest", "drop-newest"} {
+		if policy, err := ParseDropPolicy(name); err != nil || string(policy) != name {
+			t.Errorf("%s: expected valid policy, got %s (%v)", name, policy, err)
+		}
+	}
+	if _, err := ParseDropPolicy("drop-random"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestUplinkQueueDropPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   DropPolicy
+		expected []byte
+	}{
+		{DropOldest, []byte{3, 4, 5}},
+		{DropNewest, []byte{1, 2, 3}},
+	} {
+		q := newUplinkQueue(3, tc.policy)
+		var dropped int
+		for id := byte(1); id <= 5; id++ {
+			uplink := testUplink(2, id)
+			if !q.push(&uplink) {
+				dropped++
+			}
+		}
+		if dropped != 2 {
+			t.Errorf("%s: expected 2 dropped uplinks, got %d", tc.policy, dropped)
+		}
+		if !q.congested() {
+			t.Errorf("%s: expected full queue to be congested", tc.policy)
+		}
+		if ids := uplinkIDs(q.batch(10)); !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("%s: expected uplinks %v, got %v", tc.policy, tc.expected, ids)
+		}
+		q.sent(2, 1)
+		expected := UplinkQueueStats{Queued: 5, Dropped: 2, Sent: 2, Failed: 1}
+		if stats := q.getStats(); stats != expected {
+			t.Errorf("%s: expected stats %+v, got %+v", tc.policy, expected, stats)
+		}
+	}
+}
+
+func TestUplinkQueueBatch(t *testing.T) {
+	q := newUplinkQueue(8, DropOldest)
+	for id := byte(1); id <= 5; id++ {
+		uplink := testUplink(2, id)
+		q.push(&uplink)
+	}
+	if q.congested() {
+		t.Error("Expected queue under the congestion threshold not to be congested")
+	}
+	if ids := uplinkIDs(q.batch(2)); !reflect.DeepEqual(ids, []byte{1, 2}) {
+		t.Errorf("Expected the 2 oldest uplinks, got %v", ids)
+	}
+	if pending := q.getStats().Pending; pending != 3 {
+		t.Errorf("Expected 3 pending uplinks, got %d", pending)
+	}
+	if ids := uplinkIDs(q.batch(8)); !reflect.DeepEqual(ids, []byte{3, 4, 5}) {
+		t.Errorf("Expected the remaining uplinks, got %v", ids)
+	}
+	if batch := q.batch(8); len(batch) != 0 {
+		t.Errorf("Expected an empty batch, got %d uplinks", len(batch))
+	}
+}
+
+func TestUplinkPipelineOrder(t *testing.T) {
+	p := newUplinkPipeline(4, 2, DropOldest)
+	backpressure := p.push([]router.UplinkMessage{
+		testUplink(2, 1),
+		testUplink(2, 2),
+		testUplink(2, 3),
+		testUplink(mTypeConfirmedUp, 4),
+		testUplink(mTypeJoinRequest, 5),
+	})
+	if backpressure.Dropped != 0 || backpressure.Congested {
+		t.Errorf("Expected no backpressure, got %+v", backpressure)
+	}
+	select {
+	case <-p.notify:
+	default:
+		t.Error("Expected the sender to be notified")
+	}
+
+	// Uplinks of a higher priority queued while a batch is sent are sent next
+	var order [][]byte
+	priority, batch := p.next()
+	order = append(order, uplinkIDs(batch))
+	if priority != UplinkPriorityJoin {
+		t.Errorf("Expected join requests first, got %s", priority)
+	}
+	p.push([]router.UplinkMessage{testUplink(mTypeRejoinRequest, 6)})
+	for priority, batch = p.next(); len(batch) > 0; priority, batch = p.next() {
+		order = append(order, uplinkIDs(batch))
+	}
+	if expected := [][]byte{{5}, {6}, {4}, {1, 2}, {3}}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected batches %v, got %v", expected, order)
+	}
+}
+
+func TestUplinkPipelineBackpressure(t *testing.T) {
+	p := newUplinkPipeline(4, 2, DropNewest)
+	var messages []router.UplinkMessage
+	for id := byte(1); id <= 6; id++ {
+		messages = append(messages, testUplink(2, id))
+	}
+	messages = append(messages, testUplink(mTypeJoinRequest, 7))
+	backpressure := p.push(messages)
+	if backpressure.Dropped != 2 || !backpressure.Congested {
+		t.Errorf("Expected 2 dropped uplinks and congestion, got %+v", backpressure)
+	}
+
+	stats := p.stats()
+	if stats[UplinkPriorityUnconfirmed].Dropped != 2 || stats[UplinkPriorityUnconfirmed].Pending != 4 {
+		t.Errorf("Expected 2 dropped and 4 pending unconfirmed uplinks, got %+v", stats[UplinkPriorityUnconfirmed])
+	}
+	if stats[UplinkPriorityJoin].Dropped != 0 || stats[UplinkPriorityJoin].Pending != 1 {
+		t.Errorf("Expected the join request to be queued, got %+v", stats[UplinkPriorityJoin])
+	}
+}
@@ -4,8 +4,10 @@ package pktfwd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
 	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
 	"github.com/TheThingsNetwork/ttn/api/gateway"
 	"github.com/TheThingsNetwork/ttn/api/protocol"
@@ -21,7 +23,43 @@ func acceptedCRC(p wrapper.Packet) bool {
 	return false
 }
 
-func initGatewayMetadata(gatewayID string, packet wrapper.Packet) gateway.RxMetadata {
+// uplinkGPSMetadata returns the GPS metadata of an uplink: the location of the gateway, if available,
+// and the GPS time of the packet, if it could be determined
+func uplinkGPSMetadata(packet wrapper.Packet, location *Location) *gateway.GPSMetadata {
+	if location != nil {
+		return location.Metadata(packet.Gps.GetTime())
+	}
+	if packet.Gps != nil && packet.Gps.Time != 0 {
+		// The GPS position isn't reliable enough to be sent, but its time is
+		return &gateway.GPSMetadata{Time: packet.Gps.Time}
+	}
+	return nil
+}
+
+// setSystemTime stamps the packets that have no GPS time with the system time of their reception,
+// estimated from the time at which the packets were fetched from the concentrator
+func setSystemTime(packets []wrapper.Packet, fetchTime time.Time) {
+	if len(packets) == 0 {
+		return
+	}
+	// The counter of the last received packet is used as reference, accounting for counter roll-overs
+	latest := packets[0].CountUS
+	for _, p := range packets {
+		if int32(p.CountUS-latest) > 0 {
+			latest = p.CountUS
+		}
+	}
+	for i, p := range packets {
+		if p.TimeSource == wrapper.TimeSourceGPS {
+			continue
+		}
+		delay := time.Duration(latest-p.CountUS) * time.Microsecond
+		packets[i].Time = fetchTime.Add(-delay).UnixNano()
+		packets[i].TimeSource = wrapper.TimeSourceSystem
+	}
+}
+
+func initGatewayMetadata(gatewayID string, packet wrapper.Packet, location *Location) gateway.RxMetadata {
 	var gateway = gateway.RxMetadata{
 		GatewayId: gatewayID,
 		RfChain:   uint32(packet.RFChain),
@@ -31,7 +69,7 @@ func initGatewayMetadata(gatewayID string, packet wrapper.Packet) gateway.RxMeta
 		Snr:       packet.SNR,
 		Timestamp: packet.CountUS,
 		Time:      packet.Time,
-		Gps:       packet.Gps,
+		Gps:       uplinkGPSMetadata(packet, location),
 	}
 	return gateway
 }
@@ -85,10 +123,10 @@ func initLoRaData(packet wrapper.Packet) (lorawan.Metadata, error) {
 	return loRaData, nil
 }
 
-func createUplinkMessage(gatewayID string, packet wrapper.Packet) (router.UplinkMessage, error) {
+func createUplinkMessage(gatewayID string, packet wrapper.Packet, location *Location) (router.UplinkMessage, error) {
 	var uplink router.UplinkMessage
 
-	gateway := initGatewayMetadata(gatewayID, packet)
+	gateway := initGatewayMetadata(gatewayID, packet, location)
 	loraData, err := initLoRaData(packet)
 	if err != nil {
 		return uplink, err
@@ -108,18 +146,20 @@ func createUplinkMessage(gatewayID string, packet wrapper.Packet) (router.Uplink
 	return uplink, nil
 }
 
-func wrapUplinkPayload(ctx log.Interface, packets []wrapper.Packet, ignoreCRC bool, gatewayID string) []router.UplinkMessage {
+// wrapUplinkPayload converts the packets to the TTN format. location is the location of the gateway,
+// or nil if unavailable.
+func wrapUplinkPayload(ctx log.Interface, packets []wrapper.Packet, ignoreCRC bool, gatewayID string, location *Location) []router.UplinkMessage {
 	var messages = make([]router.UplinkMessage, 0, wrapper.NbMaxPackets)
 	// Iterating through every packet:
 	for _, inspectedPacket := range packets {
 		// First, we'll check the CRC is conform to the packets the gateway is configured to transmit
 		if !ignoreCRC && !acceptedCRC(inspectedPacket) {
-			ctx.Warn("Uplink packet received with an invalid CRC - ignoring")
+			util.RateLimited(ctx).Warn("Uplink packet received with an invalid CRC - ignoring")
 			continue
 		}
 
 		// Creating and filling the uplink message
-		message, err := createUplinkMessage(gatewayID, inspectedPacket)
+		message, err := createUplinkMessage(gatewayID, inspectedPacket, location)
 		if err != nil {
 			ctx.WithError(err).Error("Couldn't wrap uplink message to the TTN format")
 			continue
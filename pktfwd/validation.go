@@ -0,0 +1,308 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/TheThingsNetwork/ttn/api/gateway"
+	"github.com/TheThingsNetwork/ttn/api/protocol/lorawan"
+	"github.com/TheThingsNetwork/ttn/api/router"
+)
+
+// DownlinkErrorReason designates why a downlink can't be transmitted
+type DownlinkErrorReason string
+
+// Downlink error reasons
+const (
+	DownlinkReasonProtocol    DownlinkErrorReason = "protocol"
+	DownlinkReasonRFChain     DownlinkErrorReason = "rf-chain"
+	DownlinkReasonFrequency   DownlinkErrorReason = "frequency"
+	DownlinkReasonPower       DownlinkErrorReason = "power"
+	DownlinkReasonModulation  DownlinkErrorReason = "modulation"
+	DownlinkReasonPayloadSize DownlinkErrorReason = "payload-size"
+	DownlinkReasonTiming      DownlinkErrorReason = "timing"
+	DownlinkReasonCollision   DownlinkErrorReason = "collision"
+)
+
+// DownlinkError is returned when a downlink is refused before being scheduled
+type DownlinkError struct {
+	Reason  DownlinkErrorReason
+	Message string
+}
+
+func (e *DownlinkError) Error() string {
+	return fmt.Sprintf("Invalid downlink (%s): %s", e.Reason, e.Message)
+}
+
+func downlinkError(reason DownlinkErrorReason, format string, a ...interface{}) *DownlinkError {
+	return &DownlinkError{Reason: reason, Message: fmt.Sprintf(format, a...)}
+}
+
+const (
+	maxPayloadSize = 255
+	// phyPayloadOverhead is the size of the MHDR and MIC around the MAC payload
+	phyPayloadOverhead = 5
+)
+
+// maxMACPayloadSize is the maximal MAC payload size for each LoRa datarate, over all regions. It
+// applies to the frequency plans without their own limits in frequencyPlanMaxMACPayloadSize.
+var maxMACPayloadSize = map[string]int{
+	"SF12BW125": 59,
+	"SF11BW125": 59,
+	"SF10BW125": 59,
+	"SF9BW125":  123,
+	"SF8BW125":  250,
+	"SF7BW125":  250,
+	"SF7BW250":  250,
+	"SF12BW500": 61,
+	"SF11BW500": 137,
+	"SF10BW500": 250,
+	"SF9BW500":  250,
+	"SF8BW500":  250,
+	"SF7BW500":  250,
+}
+
+// bw125MaxMACPayloadSize is the maximal MAC payload size for the SF7BW125 to SF12BW125 datarates, in
+// the frequency plans without dwell time limits
+var bw125MaxMACPayloadSize = map[string]int{
+	"SF12BW125": 59,
+	"SF11BW125": 59,
+	"SF10BW125": 59,
+	"SF9BW125":  123,
+	"SF8BW125":  250,
+	"SF7BW125":  250,
+}
+
+// usMaxMACPayloadSize is the maximal MAC payload size for the 500kHz datarates of the frequency plans
+// with 500kHz downlink channels
+var usMaxMACPayloadSize = map[string]int{
+	"SF8BW500":  250,
+	"SF12BW500": 61,
+	"SF11BW500": 137,
+	"SF10BW500": 250,
+	"SF9BW500":  250,
+	"SF7BW500":  250,
+}
+
+// asMaxMACPayloadSize is the maximal MAC payload size for the datarates of the AS923 frequency plans,
+// with the dwell time limit of 400ms. SF11BW125 and SF12BW125 aren't used with this limit.
+var asMaxMACPayloadSize = map[string]int{
+	"SF10BW125": 19,
+	"SF9BW125":  61,
+	"SF8BW125":  133,
+	"SF7BW125":  250,
+	"SF7BW250":  250,
+}
+
+// frequencyPlanMaxMACPayloadSize is the maximal MAC payload size for each LoRa datarate of the
+// frequency plans. The datarates absent from the table of a frequency plan aren't used in it.
+var frequencyPlanMaxMACPayloadSize = map[string]map[string]int{
+	"EU_863_870": withDataRates(bw125MaxMACPayloadSize, map[string]int{"SF7BW250": 250}),
+	"US_902_928": withDataRates(usMaxMACPayloadSize, map[string]int{
+		"SF10BW125": 19,
+		"SF9BW125":  61,
+		"SF8BW125":  133,
+		"SF7BW125":  250,
+	}),
+	"AU_915_928": withDataRates(bw125MaxMACPayloadSize, usMaxMACPayloadSize),
+	"AS_920_923": asMaxMACPayloadSize,
+	"AS_923_925": asMaxMACPayloadSize,
+	"KR_920_923": bw125MaxMACPayloadSize,
+	"IN_865_867": bw125MaxMACPayloadSize,
+	"CN_470_510": bw125MaxMACPayloadSize,
+}
+
+// withDataRates returns the union of the MAC payload size tables
+func withDataRates(tables ...map[string]int) map[string]int {
+	union := make(map[string]int)
+	for _, table := range tables {
+		for dataRate, size := range table {
+			union[dataRate] = size
+		}
+	}
+	return union
+}
+
+// checkMACPayloadSize checks that the payload size is compatible with the LoRa datarate, with the
+// limits of the frequency plan if they are known
+func checkMACPayloadSize(frequencyPlan, dataRate string, payloadSize int) *DownlinkError {
+	limits, known := frequencyPlanMaxMACPayloadSize[frequencyPlan]
+	if !known {
+		limits = maxMACPayloadSize
+	}
+	max, ok := limits[dataRate]
+	if !ok {
+		if known {
+			return downlinkError(DownlinkReasonModulation, "datarate %s not used in the %s frequency plan", dataRate, frequencyPlan)
+		}
+		return nil
+	}
+	if payloadSize > max+phyPayloadOverhead {
+		return downlinkError(DownlinkReasonPayloadSize, "payload of %d bytes too big for %s (maximum %d)", payloadSize, dataRate, max+phyPayloadOverhead)
+	}
+	return nil
+}
+
+var validCodingRates = map[string]bool{
+	"4/5": true,
+	"4/6": true,
+	"2/3": true,
+	"4/7": true,
+	"4/8": true,
+	"1/2": true,
+}
+
+// validateLoRaWANConfiguration checks that the modulation parameters of the downlink are supported
+// by the concentrator, and that the payload size is compatible with the datarate in the frequency plan
+func validateLoRaWANConfiguration(lorawanConf *lorawan.TxConfiguration, frequencyPlan string, payloadSize int) error {
+	switch lorawanConf.GetModulation() {
+	case lorawan.Modulation_LORA:
+		dataRate := lorawanConf.GetDataRate()
+		var sf, bw uint32
+		if n, err := fmt.Sscanf(dataRate, "SF%dBW%d", &sf, &bw); err != nil || n != 2 {
+			return downlinkError(DownlinkReasonModulation, "unparseable LoRa datarate %s", dataRate)
+		}
+		if sf < 7 || sf > 12 || (bw != 125 && bw != 250 && bw != 500) {
+			return downlinkError(DownlinkReasonModulation, "unsupported LoRa datarate %s", dataRate)
+		}
+		if !validCodingRates[lorawanConf.GetCodingRate()] {
+			return downlinkError(DownlinkReasonModulation, "unsupported coding rate %s", lorawanConf.GetCodingRate())
+		}
+		if err := checkMACPayloadSize(frequencyPlan, dataRate, payloadSize); err != nil {
+			return err
+		}
+	case lorawan.Modulation_FSK:
+		if lorawanConf.GetBitRate() == 0 {
+			return downlinkError(DownlinkReasonModulation, "no FSK bitrate")
+		}
+	default:
+		return downlinkError(DownlinkReasonModulation, "modulation neither LoRa nor FSK")
+	}
+
+	if payloadSize > maxPayloadSize {
+		return downlinkError(DownlinkReasonPayloadSize, "payload of %d bytes too big (maximum %d)", payloadSize, maxPayloadSize)
+	}
+	return nil
+}
+
+// canTransmit returns nil if the radio can transmit on the frequency
+func canTransmit(radio util.RadioConf, rfChain int, frequency uint64) *DownlinkError {
+	if !radio.Enabled || !radio.TxEnabled {
+		return downlinkError(DownlinkReasonRFChain, "RF chain %d not enabled for transmission", rfChain)
+	}
+	if radio.TxMinFreq != nil && frequency < uint64(*radio.TxMinFreq) {
+		return downlinkError(DownlinkReasonFrequency, "frequency %d below the minimal frequency of RF chain %d (%d)", frequency, rfChain, *radio.TxMinFreq)
+	}
+	if radio.TxMaxFreq != nil && frequency > uint64(*radio.TxMaxFreq) {
+		return downlinkError(DownlinkReasonFrequency, "frequency %d above the maximal frequency of RF chain %d (%d)", frequency, rfChain, *radio.TxMaxFreq)
+	}
+	return nil
+}
+
+// selectRFChain checks that the RF chain of the downlink can transmit on its frequency. If it can't,
+// another RF chain that can is selected, and the returned bool indicates it.
+func selectRFChain(conf util.SX1301Conf, gatewayConf *gateway.TxConfiguration) (bool, error) {
+	radios := conf.GetRadios()
+	requested := int(gatewayConf.GetRfChain())
+	frequency := gatewayConf.GetFrequency()
+
+	var requestedErr *DownlinkError
+	if requested < len(radios) {
+		requestedErr = canTransmit(radios[requested], requested, frequency)
+		if requestedErr == nil {
+			return false, nil
+		}
+	} else {
+		requestedErr = downlinkError(DownlinkReasonRFChain, "RF chain %d not configured", requested)
+	}
+
+	for rfChain, radio := range radios {
+		if rfChain != requested && canTransmit(radio, rfChain, frequency) == nil {
+			gatewayConf.RfChain = uint32(rfChain)
+			return true, nil
+		}
+	}
+	return false, requestedErr
+}
+
+// txPower returns the highest EIRP, in dBm, of the TX gain LUT that doesn't exceed the requested
+// EIRP, accounting for the antenna gain
+func txPower(conf util.SX1301Conf, requested int32) (int32, error) {
+	rfPower := conf.RFPower(requested)
+	found := false
+	var power int32
+	for _, lut := range conf.GetTXLuts() {
+		lutPower := int32(lut.RfPower)
+		if lutPower <= rfPower && (!found || lutPower > power) {
+			power = lutPower
+			found = true
+		}
+	}
+	if !found {
+		return 0, downlinkError(DownlinkReasonPower, "no TX gain LUT entry at or below %d dBm (requested EIRP: %d dBm)", rfPower, requested)
+	}
+	return power + (requested - rfPower), nil
+}
+
+// validateBeacon selects the RF chain transmitting a beacon, and lowers its power to the closest
+// entry of the TX gain LUT if necessary, like for the downlinks
+func validateBeacon(conf util.SX1301Conf, beacon *wrapper.BeaconPacket) (downlinkAdjustments, error) {
+	var adjustments downlinkAdjustments
+	gatewayConf := &gateway.TxConfiguration{Frequency: uint64(beacon.Frequency), Power: int32(beacon.Power)}
+	var err error
+	adjustments.rfChainChanged, err = selectRFChain(conf, gatewayConf)
+	if err != nil {
+		return adjustments, err
+	}
+	power, err := txPower(conf, gatewayConf.Power)
+	if err != nil {
+		return adjustments, err
+	}
+	adjustments.powerLowered = power != gatewayConf.Power
+	beacon.RFChain = uint8(gatewayConf.RfChain)
+	beacon.Power = int8(power)
+	return adjustments, nil
+}
+
+// downlinkAdjustments describes the changes made to a downlink for the concentrator to transmit it
+type downlinkAdjustments struct {
+	rfChainChanged bool
+	powerLowered   bool
+}
+
+// validateDownlink checks that the downlink can be transmitted by the concentrator. The RF chain of
+// the downlink is changed if it can't transmit on its frequency, and its power is lowered to the
+// closest entry of the TX gain LUT if necessary. The payload size limits are those of the frequency
+// plan, or the largest over all regions if the frequency plan is unknown.
+func validateDownlink(conf util.SX1301Conf, frequencyPlan string, message *router.DownlinkMessage) (downlinkAdjustments, error) {
+	var adjustments downlinkAdjustments
+	lorawanConf := message.GetProtocolConfiguration().GetLorawan()
+	if lorawanConf == nil {
+		return adjustments, downlinkError(DownlinkReasonProtocol, "non-LoRaWAN downlink")
+	}
+	gatewayConf := message.GetGatewayConfiguration()
+	if gatewayConf == nil {
+		return adjustments, downlinkError(DownlinkReasonProtocol, "no gateway configuration")
+	}
+
+	if err := validateLoRaWANConfiguration(lorawanConf, frequencyPlan, len(message.GetPayload())); err != nil {
+		return adjustments, err
+	}
+
+	var err error
+	adjustments.rfChainChanged, err = selectRFChain(conf, gatewayConf)
+	if err != nil {
+		return adjustments, err
+	}
+
+	power, err := txPower(conf, gatewayConf.GetPower())
+	if err != nil {
+		return adjustments, err
+	}
+	adjustments.powerLowered = power != gatewayConf.Power
+	gatewayConf.Power = power
+	return adjustments, nil
+}
@@ -0,0 +1,201 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package pktfwd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/wrapper"
+	"github.com/pkg/errors"
+)
+
+// Default watchdog configuration
+const (
+	DefaultWatchdogInterval   = 30 * time.Second
+	DefaultWatchdogMinSilence = 10 * time.Minute
+)
+
+const (
+	// watchdogSilenceFactor is the number of mean intervals between packets without packet after
+	// which a concentrator is considered stuck
+	watchdogSilenceFactor = 10
+	// watchdogMinPackets is the number of packets a concentrator must have received before its
+	// silence is considered abnormal - the traffic of a gateway without packets isn't known
+	watchdogMinPackets = 10
+)
+
+// WatchdogConfig is the configuration of the concentrator watchdog
+type WatchdogConfig struct {
+	Enabled bool
+	// Interval is the interval at which the concentrator is checked
+	Interval time.Duration
+	// MinSilence is the minimal time without packets after which a concentrator is considered stuck
+	MinSilence time.Duration
+}
+
+// watchdog detects a concentrator that stopped working: a concentrator that doesn't answer, whose
+// counter stopped, or that didn't receive packets for much longer than its usual traffic
+type watchdog struct {
+	conf      WatchdogConfig
+	lastCheck time.Time
+	// since is the time from which the concentrator is watched - the start of the run, or the last
+	// recovery
+	since       time.Time
+	firstPacket time.Time
+	lastPacket  time.Time
+	packets     int
+	// counter is the counter read at the last check, if counterRead
+	counter     uint32
+	counterRead bool
+}
+
+func newWatchdog(conf WatchdogConfig, now time.Time) *watchdog {
+	if conf.Interval <= 0 {
+		conf.Interval = DefaultWatchdogInterval
+	}
+	if conf.MinSilence <= 0 {
+		conf.MinSilence = DefaultWatchdogMinSilence
+	}
+	return &watchdog{
+		conf:      conf,
+		lastCheck: now,
+		since:     now,
+	}
+}
+
+// received records the packets received by the concentrator
+func (w *watchdog) received(packets []wrapper.Packet, now time.Time) {
+	if len(packets) == 0 {
+		return
+	}
+	if w.packets == 0 {
+		w.firstPacket = now
+	}
+	w.lastPacket = now
+	w.packets += len(packets)
+}
+
+// expectedInterval returns the mean interval between the packets received by the concentrator
+func (w *watchdog) expectedInterval() (time.Duration, bool) {
+	if w.packets < watchdogMinPackets {
+		return 0, false
+	}
+	return w.lastPacket.Sub(w.firstPacket) / time.Duration(w.packets-1), true
+}
+
+// due returns true if the concentrator must be checked
+func (w *watchdog) due(now time.Time) bool {
+	if now.Sub(w.lastCheck) < w.conf.Interval {
+		return false
+	}
+	w.lastCheck = now
+	return true
+}
+
+// check returns an error if the concentrator stopped working
+func (w *watchdog) check(now time.Time) error {
+	counter, err := wrapper.GetInstantCounter()
+	freeRunning := err == nil
+	if err != nil {
+		counter, err = wrapper.GetTriggerCounter()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Concentrator not responding")
+	}
+	// The trigger counter is only latched on the PPS pulses
+	advancing := freeRunning || wrapper.GetGPSTimeSync().State == wrapper.TimeSyncLocked
+	stopped := advancing && w.counterRead && counter == w.counter
+	w.counter, w.counterRead = counter, advancing
+	if stopped {
+		return fmt.Errorf("Concentrator counter stopped at %d", counter)
+	}
+
+	if interval, ok := w.expectedInterval(); ok {
+		maxSilence := watchdogSilenceFactor * interval
+		if maxSilence < w.conf.MinSilence {
+			maxSilence = w.conf.MinSilence
+		}
+		last := w.lastPacket
+		if last.Before(w.since) {
+			last = w.since
+		}
+		if silence := now.Sub(last); silence > maxSilence {
+			return fmt.Errorf("No packet received for %v, expected every %v", silence/time.Second*time.Second, interval/time.Second*time.Second)
+		}
+	}
+	return nil
+}
+
+// recovered restarts the watch of the concentrator after its recovery. Its traffic is kept.
+func (w *watchdog) recovered(now time.Time) {
+	w.since = now
+	w.counterRead = false
+}
+
+// watchConcentrator checks the concentrator at the watchdog interval, and recovers it if it stopped
+// working. It is called by the uplink routine, so that no packet is polled during a recovery.
+func (m *Manager) watchConcentrator(ctx log.Interface) error {
+	if m.watchdog == nil {
+		return nil
+	}
+	now := time.Now()
+	if !m.watchdog.due(now) {
+		return nil
+	}
+	reason := m.watchdog.check(now)
+	if reason == nil {
+		return nil
+	}
+	if err := m.recoverConcentrator(ctx, reason); err != nil {
+		return errors.Wrap(err, "Couldn't recover concentrator")
+	}
+	return nil
+}
+
+// recoverConcentrator stops the concentrator, resets it if it has a reset pin, then configures and
+// starts it again. The other routines using the concentrator wait for the end of the recovery. As
+// the counter restarted, the GPS time reference is dropped until the next PPS pulse.
+func (m *Manager) recoverConcentrator(ctx log.Interface, reason error) error {
+	m.concentratorLock.Lock()
+	defer m.concentratorLock.Unlock()
+	ctx.WithError(reason).Warn("Concentrator stopped working, recovering it")
+	start := time.Now()
+
+	// A stuck concentrator can fail to stop - it is reset and started again anyway
+	if err := wrapper.StopLoRaGateway(); err != nil {
+		ctx.WithError(err).Warn("Couldn't stop concentrator")
+	}
+	if m.resetPin != 0 {
+		ctx.WithField("ResetPin", m.resetPin).Info("Resetting concentrator")
+		if err := ResetPin(m.resetPin); err != nil {
+			return errors.Wrap(err, "Couldn't reset concentrator")
+		}
+	}
+	if err := configureBoard(ctx, m.conf); err != nil {
+		return errors.Wrap(err, "Couldn't configure concentrator")
+	}
+	if err := wrapper.StartLoRaGateway(); err != nil {
+		return errors.Wrap(err, "Couldn't start concentrator")
+	}
+	wrapper.ResetGPSTimeReference()
+
+	now := time.Now()
+	m.watchdog.recovered(now)
+	m.resetBootTime(ctx)
+	fields := log.Fields{"Reason": reason.Error(), "Duration": now.Sub(start)}
+	ctx.WithField("Duration", now.Sub(start)).Info("Concentrator recovered")
+	m.events.Record(EventConcentratorRecovery, "Concentrator recovered", fields)
+	return nil
+}
+
+// resetBootTime determines again the boot time of the concentrator after its counter restarted. It
+// is read from the HAL, or estimated from the next packets. Until then, the previous boot time is
+// invalidated, so that no downlink is scheduled and no uptime reported from it.
+func (m *Manager) resetBootTime(ctx log.Interface) {
+	m.bootTimeSetters.SetBootTime(time.Time{})
+	m.foundBootTime = false
+	m.poller.setLowLatency(true)
+	m.readBootTime(ctx)
+}
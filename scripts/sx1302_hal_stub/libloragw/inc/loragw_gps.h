@@ -0,0 +1,31 @@
+/*
+ * Stub of the SX1302 HAL GPS API - see loragw_hal.h
+ */
+
+#ifndef _LORAGW_GPS_H
+#define _LORAGW_GPS_H
+
+#include <stdint.h>
+#include <time.h>
+#include <termios.h>
+
+#define LGW_GPS_SUCCESS 0
+#define LGW_GPS_ERROR -1
+
+/* Time reference used for UTC <-> timestamp conversion */
+struct tref {
+    time_t          systime;    /* system time when the reference was last updated */
+    uint32_t        count_us;   /* reference concentrator internal timestamp */
+    struct timespec utc;        /* reference UTC time (from GPS/NMEA) */
+    struct timespec gps;        /* reference GPS time (since 01.Jan.1980) */
+    double          xtal_err;   /* raw clock error (eg. <1 'slow' XTAL) */
+};
+
+int lgw_gps_enable(char* tty_path, char* gps_family, speed_t target_brate, int* fd_ptr);
+int lgw_gps_disable(int fd);
+
+int lgw_gps_sync(struct tref *ref, uint32_t count_us, struct timespec utc, struct timespec gps_time);
+int lgw_cnt2utc(struct tref ref, uint32_t count_us, struct timespec* utc);
+int lgw_utc2cnt(struct tref ref, struct timespec utc, uint32_t* count_us);
+
+#endif
@@ -0,0 +1,245 @@
+/*
+ * Stub of the SX1302 HAL, to build and run the halv2 backend of the packet forwarder without
+ * concentrator. The stub keeps the configuration it receives, runs the concentrator counter on the
+ * monotonic clock, receives a test uplink every STUB_UPLINK_PERIOD_US and accepts every downlink.
+ */
+
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <string.h>
+#include <time.h>
+
+#include "loragw_hal.h"
+#include "loragw_gps.h"
+
+#define STUB_UPLINK_PERIOD_US 5000000U
+#define STUB_TEMPERATURE 35.0
+
+static bool started = false;
+static struct timespec start_time;
+static uint32_t last_uplink_us;
+
+static struct lgw_conf_board_s board_conf;
+static struct lgw_conf_rxrf_s rxrf_conf[LGW_RF_CHAIN_NB];
+static struct lgw_conf_rxif_s rxif_conf[LGW_IF_CHAIN_NB];
+static struct lgw_tx_gain_lut_s txgain_conf[LGW_RF_CHAIN_NB];
+static struct lgw_conf_ftime_s ftime_conf;
+
+static uint32_t counter_us(void) {
+    struct timespec now;
+    clock_gettime(CLOCK_MONOTONIC, &now);
+    return (uint32_t)((now.tv_sec - start_time.tv_sec) * 1000000 + (now.tv_nsec - start_time.tv_nsec) / 1000);
+}
+
+int lgw_board_setconf(struct lgw_conf_board_s * conf) {
+    if (started || conf == NULL || conf->com_type != LGW_COM_SPI) {
+        return LGW_HAL_ERROR;
+    }
+    board_conf = *conf;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_rxrf_setconf(uint8_t rf_chain, struct lgw_conf_rxrf_s * conf) {
+    if (started || conf == NULL || rf_chain >= LGW_RF_CHAIN_NB) {
+        return LGW_HAL_ERROR;
+    }
+    rxrf_conf[rf_chain] = *conf;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_rxif_setconf(uint8_t if_chain, struct lgw_conf_rxif_s * conf) {
+    if (started || conf == NULL || if_chain >= LGW_IF_CHAIN_NB || conf->rf_chain >= LGW_RF_CHAIN_NB) {
+        return LGW_HAL_ERROR;
+    }
+    rxif_conf[if_chain] = *conf;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_txgain_setconf(uint8_t rf_chain, struct lgw_tx_gain_lut_s * conf) {
+    if (conf == NULL || rf_chain >= LGW_RF_CHAIN_NB || conf->size < 1 || conf->size > TX_GAIN_LUT_SIZE_MAX) {
+        return LGW_HAL_ERROR;
+    }
+    txgain_conf[rf_chain] = *conf;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_ftime_setconf(struct lgw_conf_ftime_s * conf) {
+    if (started || conf == NULL) {
+        return LGW_HAL_ERROR;
+    }
+    ftime_conf = *conf;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_start(void) {
+    if (started) {
+        return LGW_HAL_ERROR;
+    }
+    clock_gettime(CLOCK_MONOTONIC, &start_time);
+    last_uplink_us = 0;
+    started = true;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_stop(void) {
+    started = false;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_receive(uint8_t max_pkt, struct lgw_pkt_rx_s * pkt_data) {
+    static const uint8_t payload[] = {0x40, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x01, 0xAA, 0xBB, 0xCC, 0xDD};
+    uint32_t now;
+    int i;
+
+    if (!started || pkt_data == NULL) {
+        return LGW_HAL_ERROR;
+    }
+    now = counter_us();
+    if (max_pkt == 0 || now - last_uplink_us < STUB_UPLINK_PERIOD_US) {
+        return 0;
+    }
+    last_uplink_us = now;
+
+    /* Test uplink on the first enabled multi-SF channel */
+    for (i = 0; i < LGW_MULTI_NB && !rxif_conf[i].enable; i++);
+    if (i == LGW_MULTI_NB) {
+        return 0;
+    }
+    memset(pkt_data, 0, sizeof(*pkt_data));
+    pkt_data->freq_hz = rxrf_conf[rxif_conf[i].rf_chain].freq_hz + rxif_conf[i].freq_hz;
+    pkt_data->if_chain = i;
+    pkt_data->status = STAT_CRC_OK;
+    pkt_data->count_us = now;
+    pkt_data->rf_chain = rxif_conf[i].rf_chain;
+    pkt_data->modulation = MOD_LORA;
+    pkt_data->bandwidth = BW_125KHZ;
+    pkt_data->datarate = DR_LORA_SF7;
+    pkt_data->coderate = CR_LORA_4_5;
+    pkt_data->rssic = -60.0;
+    pkt_data->rssis = -61.0;
+    pkt_data->snr = 9.5;
+    pkt_data->snr_min = 8.0;
+    pkt_data->snr_max = 11.0;
+    pkt_data->size = sizeof(payload);
+    memcpy(pkt_data->payload, payload, sizeof(payload));
+    if (ftime_conf.enable) {
+        pkt_data->ftime_received = true;
+        pkt_data->ftime = (now % 1000000) * 1000;
+    }
+    return 1;
+}
+
+int lgw_send(struct lgw_pkt_tx_s * pkt_data) {
+    if (!started || pkt_data == NULL || pkt_data->rf_chain >= LGW_RF_CHAIN_NB || !rxrf_conf[pkt_data->rf_chain].tx_enable) {
+        return LGW_HAL_ERROR;
+    }
+    if (pkt_data->size > sizeof(pkt_data->payload)) {
+        return LGW_HAL_ERROR;
+    }
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_status(uint8_t rf_chain, uint8_t select, uint8_t * code) {
+    if (code == NULL || rf_chain >= LGW_RF_CHAIN_NB) {
+        return LGW_HAL_ERROR;
+    }
+    if (select == TX_STATUS) {
+        *code = started ? TX_FREE : TX_OFF;
+    } else if (select == RX_STATUS) {
+        *code = started ? RX_ON : RX_OFF;
+    } else {
+        return LGW_HAL_ERROR;
+    }
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_get_trigcnt(uint32_t * trig_cnt_us) {
+    if (!started || trig_cnt_us == NULL) {
+        return LGW_HAL_ERROR;
+    }
+    /* Latched on the last PPS pulse, on the full second */
+    *trig_cnt_us = counter_us() / 1000000 * 1000000;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_get_instcnt(uint32_t * inst_cnt_us) {
+    if (!started || inst_cnt_us == NULL) {
+        return LGW_HAL_ERROR;
+    }
+    *inst_cnt_us = counter_us();
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_get_eui(uint64_t * eui) {
+    if (eui == NULL) {
+        return LGW_HAL_ERROR;
+    }
+    *eui = 0x0016C001FF000000ULL;
+    return LGW_HAL_SUCCESS;
+}
+
+int lgw_get_temperature(float * temperature) {
+    if (!started || temperature == NULL) {
+        return LGW_HAL_ERROR;
+    }
+    *temperature = STUB_TEMPERATURE;
+    return LGW_HAL_SUCCESS;
+}
+
+const char * lgw_version_info(void) {
+    return "SX1302 HAL stub";
+}
+
+int lgw_gps_enable(char* tty_path, char* gps_family, speed_t target_brate, int* fd_ptr) {
+    (void)tty_path;
+    (void)gps_family;
+    (void)target_brate;
+    (void)fd_ptr;
+    /* No GPS on the stub */
+    return LGW_GPS_ERROR;
+}
+
+int lgw_gps_disable(int fd) {
+    (void)fd;
+    return LGW_GPS_SUCCESS;
+}
+
+int lgw_gps_sync(struct tref *ref, uint32_t count_us, struct timespec utc, struct timespec gps_time) {
+    if (ref == NULL) {
+        return LGW_GPS_ERROR;
+    }
+    ref->systime = time(NULL);
+    ref->count_us = count_us;
+    ref->utc = utc;
+    ref->gps = gps_time;
+    ref->xtal_err = 1.0;
+    return LGW_GPS_SUCCESS;
+}
+
+int lgw_cnt2utc(struct tref ref, uint32_t count_us, struct timespec* utc) {
+    int64_t delta_ns;
+
+    if (utc == NULL || ref.systime == 0) {
+        return LGW_GPS_ERROR;
+    }
+    delta_ns = (int64_t)(int32_t)(count_us - ref.count_us) * 1000 + ref.utc.tv_nsec;
+    utc->tv_sec = ref.utc.tv_sec + delta_ns / 1000000000;
+    utc->tv_nsec = delta_ns % 1000000000;
+    if (utc->tv_nsec < 0) {
+        utc->tv_sec--;
+        utc->tv_nsec += 1000000000;
+    }
+    return LGW_GPS_SUCCESS;
+}
+
+int lgw_utc2cnt(struct tref ref, struct timespec utc, uint32_t* count_us) {
+    int64_t delta_us;
+
+    if (count_us == NULL || ref.systime == 0) {
+        return LGW_GPS_ERROR;
+    }
+    delta_us = (int64_t)(utc.tv_sec - ref.utc.tv_sec) * 1000000 + (utc.tv_nsec - ref.utc.tv_nsec) / 1000;
+    *count_us = ref.count_us + (uint32_t)delta_us;
+    return LGW_GPS_SUCCESS;
+}
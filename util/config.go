@@ -19,6 +19,11 @@ type ChannelConf struct {
 	Bandwidth    *uint32 `json:"bandwidth,omitempty"`
 	Datarate     *uint32 `json:"datarate,omitempty"`
 	SpreadFactor *uint8  `json:"spread_factor,omitempty"`
+	// Implicit header mode of the LoRa standard channel - SX1302 only
+	ImplicitHeader        bool  `json:"implicit_hdr,omitempty"`
+	ImplicitPayloadLength uint8 `json:"implicit_payload_length,omitempty"`
+	ImplicitCRC           bool  `json:"implicit_crc_en,omitempty"`
+	ImplicitCoderate      uint8 `json:"implicit_coderate,omitempty"`
 }
 
 type ChannelFreqConf struct {
@@ -41,6 +46,22 @@ type GainTableConf struct {
 	DigGain     uint8   `json:"dig_gain"`
 	Description *string `json:"desc,omitempty"`
 	DacGain     *uint8  `json:"dac_gain,omitempty"`
+	PwrIdx      *uint8  `json:"pwr_idx,omitempty"` // Power index of SX1250 radios
+}
+
+// RssiTcompConf holds the coefficients of the temperature compensation of the RSSI of SX1302 radios
+type RssiTcompConf struct {
+	CoeffA float32 `json:"coeff_a"`
+	CoeffB float32 `json:"coeff_b"`
+	CoeffC float32 `json:"coeff_c"`
+	CoeffD float32 `json:"coeff_d"`
+	CoeffE float32 `json:"coeff_e"`
+}
+
+// FineTimestampConf configures the fine timestamping of the uplinks of SX1302 concentrators
+type FineTimestampConf struct {
+	Enabled bool   `json:"enable"`
+	Mode    string `json:"mode"` // high_capacity or all_sf
 }
 
 type RadioConf struct {
@@ -52,6 +73,10 @@ type RadioConf struct {
 	TxNotchFreq *int    `json:"tx_notch_freq,omitempty"`
 	TxMinFreq   *int    `json:"tx_freq_min,omitempty"`
 	TxMaxFreq   *int    `json:"tx_freq_max,omitempty"`
+	// SX1302 only
+	SingleInputMode bool            `json:"single_input_mode,omitempty"`
+	RssiTcomp       *RssiTcompConf  `json:"rssi_tcomp,omitempty"`
+	TxGainLut       []GainTableConf `json:"tx_gain_lut,omitempty"` // Overrides tx_lut_* for this radio
 }
 
 type SX1301Conf struct {
@@ -145,6 +170,12 @@ type SX1301Conf struct {
 	TxLut13                *GainTableConf `json:"tx_lut_13,omitempty"`
 	TxLut14                *GainTableConf `json:"tx_lut_14,omitempty"`
 	TxLut15                *GainTableConf `json:"tx_lut_15,omitempty"`
+
+	// SX1302 only
+	FullDuplex    bool               `json:"full_duplex,omitempty"`
+	ComType       *string            `json:"com_type,omitempty"`
+	ComPath       *string            `json:"com_path,omitempty"`
+	FineTimestamp *FineTimestampConf `json:"fine_timestamp,omitempty"`
 }
 
 func (s SX1301Conf) GetRadios() []RadioConf {
@@ -158,6 +189,15 @@ func (s SX1301Conf) GetRadios() []RadioConf {
 	return radios
 }
 
+// RFPower returns the power at the output of the concentrator to transmit with an EIRP, in dBm,
+// accounting for the antenna gain
+func (s SX1301Conf) RFPower(eirp int32) int32 {
+	if s.AntennaGain == nil {
+		return eirp
+	}
+	return eirp - int32(*s.AntennaGain)
+}
+
 func (s SX1301Conf) GetTXLuts() []GainTableConf {
 	gainTables := make([]GainTableConf, 0)
 	for _, i := range []*GainTableConf{
@@ -191,8 +231,30 @@ func (s SX1301Conf) GetMultiSFChannels() []ChannelConf {
 	return channels
 }
 
+// ChannelFrequencies returns the center frequencies, in Hz, of the enabled reception channels
+func (s SX1301Conf) ChannelFrequencies() []int {
+	radios := s.GetRadios()
+	channels := s.GetMultiSFChannels()
+	for _, channel := range []*ChannelConf{s.LoraSTDChannel, s.FSKChannel} {
+		if channel != nil {
+			channels = append(channels, *channel)
+		}
+	}
+
+	frequencies := make([]int, 0, len(channels))
+	for _, channel := range channels {
+		if !channel.Enabled || int(channel.Radio) >= len(radios) {
+			continue
+		}
+		frequencies = append(frequencies, radios[channel.Radio].Freq+int(channel.IfValue))
+	}
+	return frequencies
+}
+
 type Config struct {
 	Concentrator SX1301Conf `json:"SX1301_conf"`
+	// SX130x is the concentrator configuration of the frequency plans written for SX1302 gateways
+	SX130x *SX1301Conf `json:"SX130x_conf,omitempty"`
 }
 
 func jsonParseConfig(frequencyPlan []byte) (Config, error) {
@@ -200,6 +262,10 @@ func jsonParseConfig(frequencyPlan []byte) (Config, error) {
 	if err := json.Unmarshal(frequencyPlan, &conf); err != nil {
 		return conf, err
 	}
+	if conf.SX130x != nil {
+		conf.Concentrator = *conf.SX130x
+		conf.SX130x = nil
+	}
 	return conf, nil
 }
 
@@ -3,23 +3,231 @@
 package util
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	cliHandler "github.com/TheThingsNetwork/go-utils/handlers/cli"
 	ttnlog "github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/go-utils/log/apex"
 	"github.com/apex/log"
-	levelHandler "github.com/apex/log/handlers/level"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
-func GetLogger() ttnlog.Interface {
-	logLevel := log.InfoLevel
+// Components of the packet forwarder, whose log level can be set with --log-levels
+const (
+	UplinkComponent   = "uplink"
+	DownlinkComponent = "downlink"
+	NetworkComponent  = "network"
+	GPSComponent      = "gps"
+	StatusComponent   = "status"
+)
+
+// LogComponents are the components whose log level can be configured
+var LogComponents = []string{UplinkComponent, DownlinkComponent, NetworkComponent, GPSComponent, StatusComponent}
+
+// componentField is the log field identifying the component of the packet forwarder that logged an entry
+const componentField = "Component"
+
+// WithComponent returns a logger whose entries are attributed to the component
+func WithComponent(ctx ttnlog.Interface, component string) ttnlog.Interface {
+	return ctx.WithField(componentField, component)
+}
+
+// rateLimitedField marks the entries subject to the rate limit. It is removed before the entries
+// are written.
+const rateLimitedField = "RateLimited"
+
+// RateLimited returns a logger whose entries are subject to the rate limit, for messages that can
+// be logged many times per second, such as the invalid CRC warnings
+func RateLimited(ctx ttnlog.Interface) ttnlog.Interface {
+	return ctx.WithField(rateLimitedField, true)
+}
+
+// LogConfig describes how logs are formatted and where they are written
+type LogConfig struct {
+	Format     string // text, json or logfmt
+	Output     string // stdout, file, syslog or journald
+	File       string
+	MaxSize    int // In MB
+	MaxAge     time.Duration
+	MaxBackups int
+	Level      log.Level
+	// ComponentLevels override Level for the entries of a component
+	ComponentLevels map[string]log.Level
+	// RateLimit is the maximal number of identical rate-limited messages under the error level
+	// logged per minute
+	RateLimit int
+}
+
+// parseComponentLevels parses levels in a "uplink=debug,gps=warn" format
+func parseComponentLevels(levels string) (map[string]log.Level, error) {
+	componentLevels := make(map[string]log.Level)
+	for _, componentLevel := range strings.Split(levels, ",") {
+		componentLevel = strings.TrimSpace(componentLevel)
+		if componentLevel == "" {
+			continue
+		}
+		parts := strings.SplitN(componentLevel, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid component log level %s (should be <component>=<level>)", componentLevel)
+		}
+		component := strings.TrimSpace(parts[0])
+		if !isLogComponent(component) {
+			return nil, fmt.Errorf("Unknown log component %s (should be one of %s)", component, strings.Join(LogComponents, ", "))
+		}
+		level, err := log.ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid log level for %s", component)
+		}
+		componentLevels[component] = level
+	}
+	return componentLevels, nil
+}
+
+func isLogComponent(name string) bool {
+	for _, component := range LogComponents {
+		if component == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLogConfig reads the logging configuration from the flags, the environment and the configuration file
+func GetLogConfig() (LogConfig, error) {
+	conf := LogConfig{
+		Format:     viper.GetString("log-format"),
+		Output:     viper.GetString("log-output"),
+		File:       viper.GetString("log-file"),
+		MaxSize:    viper.GetInt("log-max-size"),
+		MaxAge:     viper.GetDuration("log-max-age"),
+		MaxBackups: viper.GetInt("log-max-backups"),
+		Level:      log.InfoLevel,
+		RateLimit:  viper.GetInt("log-rate-limit"),
+	}
+	if conf.Format == "" {
+		conf.Format = "text"
+	}
+	if conf.Output == "" {
+		conf.Output = "stdout"
+	}
 	if viper.GetBool("verbose") {
-		logLevel = log.DebugLevel
+		conf.Level = log.DebugLevel
+	}
+	componentLevels, err := parseComponentLevels(viper.GetString("log-levels"))
+	if err != nil {
+		return conf, err
+	}
+	conf.ComponentLevels = componentLevels
+	return conf, nil
+}
+
+// minLevel returns the lowest level logged by at least one component
+func (c LogConfig) minLevel() log.Level {
+	level := c.Level
+	for _, componentLevel := range c.ComponentLevels {
+		if componentLevel < level {
+			level = componentLevel
+		}
+	}
+	return level
+}
+
+// formatHandler returns the handler writing entries to w in the configured format
+func (c LogConfig) formatHandler(w io.Writer) (log.Handler, error) {
+	switch c.Format {
+	case "text":
+		return cliHandler.New(w), nil
+	case "json":
+		return newJSONHandler(w), nil
+	case "logfmt":
+		return newLogfmtHandler(w), nil
+	}
+	return nil, fmt.Errorf("Unknown log format %s (should be text, json or logfmt)", c.Format)
+}
+
+// outputHandler returns the handler writing the entries to the configured output. w is the
+// standard stream used by the stdout output.
+func (c LogConfig) outputHandler(w io.Writer) (log.Handler, error) {
+	switch c.Output {
+	case "stdout":
+		return c.formatHandler(w)
+	case "file":
+		if c.File == "" {
+			return nil, errors.New("No log file specified")
+		}
+		file, err := openLogFile(c.File, c.MaxSize, c.MaxAge, c.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return c.formatHandler(file)
+	case "syslog":
+		return newSyslogHandler()
+	case "journald":
+		return newJournaldHandler()
+	}
+	return nil, fmt.Errorf("Unknown log output %s (should be stdout, file, syslog or journald)", c.Output)
+}
+
+// Handler returns the handler applying the component levels and the rate limit before writing
+// the entries to the configured output
+func (c LogConfig) Handler(w io.Writer) (log.Handler, error) {
+	handler, err := c.outputHandler(w)
+	if err != nil {
+		return nil, err
+	}
+	handler = newRateLimitHandler(handler, c.RateLimit)
+	return newComponentLevelHandler(handler, c.Level, c.ComponentLevels), nil
+}
+
+var (
+	loggersMutex sync.Mutex
+	// loggers are shared, so that files and connections to the log outputs are only opened once
+	loggers = make(map[io.Writer]*log.Logger)
+)
+
+func GetLogger() ttnlog.Interface {
+	return GetLoggerTo(os.Stdout)
+}
+
+// GetLoggerTo returns a logger writing to w, for commands whose standard output is used for results.
+// w is only used if logs are written to the standard output.
+func GetLoggerTo(w io.Writer) ttnlog.Interface {
+	loggersMutex.Lock()
+	defer loggersMutex.Unlock()
+
+	conf, err := GetLogConfig()
+	key := w
+	if err == nil && conf.Output != "stdout" {
+		// The other outputs are shared by all the loggers
+		key = nil
+	}
+	if logger, ok := loggers[key]; ok {
+		return apex.Wrap(logger)
+	}
+
+	var handler log.Handler
+	if err == nil {
+		handler, err = conf.Handler(w)
+	}
+	if err != nil {
+		// Falling back on the default logger, to be able to report the error
+		conf = LogConfig{Level: conf.Level}
+		handler = newComponentLevelHandler(newRateLimitHandler(cliHandler.New(w), 0), conf.Level, nil)
+		key = w
+	}
+	logger := &log.Logger{
+		Handler: handler,
+		Level:   conf.minLevel(),
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Invalid logging configuration - using the default logging configuration")
 	}
-	ctx := apex.Wrap(&log.Logger{
-		Handler: levelHandler.New(cliHandler.New(os.Stdout), logLevel),
-	})
-	return ctx
+	loggers[key] = logger
+	return apex.Wrap(logger)
 }
@@ -0,0 +1,201 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	rateLimitWindow = time.Minute
+	// suppressedField is added to a rate-limited message, with the number of entries dropped in the previous windows
+	suppressedField = "Suppressed"
+)
+
+// sortedFieldNames returns the names of the fields in alphabetical order, so that the output is stable
+func sortedFieldNames(fields log.Fields) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldValue converts a field to a value that can be marshaled, or printed in a readable way
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+// jsonHandler writes one JSON object per entry
+type jsonHandler struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newJSONHandler(w io.Writer) *jsonHandler {
+	return &jsonHandler{w: w}
+}
+
+func (h *jsonHandler) HandleLog(e *log.Entry) error {
+	entry := make(map[string]interface{}, len(e.Fields)+3)
+	for name, value := range e.Fields {
+		entry[name] = fieldValue(value)
+	}
+	entry["time"] = e.Timestamp.Format(time.RFC3339Nano)
+	entry["level"] = e.Level.String()
+	entry["msg"] = e.Message
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.w.Write(append(line, '\n'))
+	return err
+}
+
+// logfmtValue quotes the value if it contains spaces, quotes or an equal sign
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(fieldValue(value))
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatLogfmt formats the message and the fields of the entry as key=value pairs
+func formatLogfmt(buf *bytes.Buffer, e *log.Entry) {
+	fmt.Fprintf(buf, "msg=%s", logfmtValue(e.Message))
+	for _, name := range sortedFieldNames(e.Fields) {
+		fmt.Fprintf(buf, " %s=%s", name, logfmtValue(e.Fields[name]))
+	}
+}
+
+// logfmtHandler writes one line of key=value pairs per entry
+type logfmtHandler struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newLogfmtHandler(w io.Writer) *logfmtHandler {
+	return &logfmtHandler{w: w}
+}
+
+func (h *logfmtHandler) HandleLog(e *log.Entry) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time=%s level=%s ", e.Timestamp.Format(time.RFC3339Nano), e.Level.String())
+	formatLogfmt(&buf, e)
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+// componentLevelHandler drops the entries under the level of their component
+type componentLevelHandler struct {
+	next            log.Handler
+	level           log.Level
+	componentLevels map[string]log.Level
+}
+
+func newComponentLevelHandler(next log.Handler, level log.Level, componentLevels map[string]log.Level) *componentLevelHandler {
+	return &componentLevelHandler{
+		next:            next,
+		level:           level,
+		componentLevels: componentLevels,
+	}
+}
+
+func (h *componentLevelHandler) HandleLog(e *log.Entry) error {
+	level := h.level
+	if component, ok := e.Fields[componentField].(string); ok {
+		if componentLevel, ok := h.componentLevels[component]; ok {
+			level = componentLevel
+		}
+	}
+	if e.Level < level {
+		return nil
+	}
+	return h.next.HandleLog(e)
+}
+
+// rateLimitHandler logs at most limit identical messages per minute under the error level, among the
+// entries of the loggers returned by RateLimited. The number of dropped entries is added to the
+// first entry of the message logged afterwards. With a limit of 0, no entry is dropped.
+type rateLimitHandler struct {
+	next  log.Handler
+	limit int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+	suppressed  map[string]int
+}
+
+func newRateLimitHandler(next log.Handler, limit int) *rateLimitHandler {
+	return &rateLimitHandler{
+		next:       next,
+		limit:      limit,
+		counts:     make(map[string]int),
+		suppressed: make(map[string]int),
+	}
+}
+
+func (h *rateLimitHandler) HandleLog(e *log.Entry) error {
+	if _, ok := e.Fields[rateLimitedField]; !ok {
+		return h.next.HandleLog(e)
+	}
+	suppressed := 0
+	if h.limit > 0 && e.Level < log.ErrorLevel {
+		key := e.Level.String() + " " + e.Message
+		h.mu.Lock()
+		if now := time.Now(); now.Sub(h.windowStart) >= rateLimitWindow {
+			h.windowStart = now
+			h.counts = make(map[string]int)
+		}
+		h.counts[key]++
+		if h.counts[key] > h.limit {
+			h.suppressed[key]++
+			h.mu.Unlock()
+			return nil
+		}
+		suppressed = h.suppressed[key]
+		delete(h.suppressed, key)
+		h.mu.Unlock()
+	}
+
+	fields := make(log.Fields, len(e.Fields))
+	for name, value := range e.Fields {
+		if name != rateLimitedField {
+			fields[name] = value
+		}
+	}
+	if suppressed > 0 {
+		fields[suppressedField] = suppressed
+	}
+	entry := *e
+	entry.Fields = fields
+	return h.next.HandleLog(&entry)
+}
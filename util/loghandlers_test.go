@@ -0,0 +1,149 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+)
+
+var testEntryTime = time.Date(2017, time.June, 1, 12, 30, 0, 0, time.UTC)
+
+func testEntry(level log.Level, message string, fields log.Fields) *log.Entry {
+	return &log.Entry{Level: level, Message: message, Fields: fields, Timestamp: testEntryTime}
+}
+
+func rateLimited(fields log.Fields) log.Fields {
+	limited := log.Fields{rateLimitedField: true}
+	for name, value := range fields {
+		limited[name] = value
+	}
+	return limited
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	output := memory.New()
+	h := newRateLimitHandler(output, 2)
+
+	for i := 0; i < 5; i++ {
+		h.HandleLog(testEntry(log.WarnLevel, "Invalid CRC", rateLimited(log.Fields{"Index": i})))
+		h.HandleLog(testEntry(log.WarnLevel, "Not rate limited", nil))
+		h.HandleLog(testEntry(log.ErrorLevel, "Error", rateLimited(nil)))
+	}
+	counts := make(map[string]int)
+	for _, e := range output.Entries {
+		counts[e.Message]++
+		if _, ok := e.Fields[rateLimitedField]; ok {
+			t.Errorf("Expected %s field to be removed from %q", rateLimitedField, e.Message)
+		}
+	}
+	if expected := map[string]int{"Invalid CRC": 2, "Not rate limited": 5, "Error": 5}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected %v entries per message, got %v", expected, counts)
+	}
+
+	// A new window starts a minute after the previous one, and reports the suppressed entries once
+	h.mu.Lock()
+	h.windowStart = h.windowStart.Add(-rateLimitWindow)
+	h.mu.Unlock()
+	output.Entries = nil
+	for i := 0; i < 3; i++ {
+		h.HandleLog(testEntry(log.WarnLevel, "Invalid CRC", rateLimited(nil)))
+	}
+	if len(output.Entries) != 2 {
+		t.Fatalf("Expected 2 entries in the new window, got %d", len(output.Entries))
+	}
+	if suppressed := output.Entries[0].Fields[suppressedField]; suppressed != 3 {
+		t.Errorf("Expected 3 suppressed entries on the first entry of the window, got %v", suppressed)
+	}
+	if _, ok := output.Entries[1].Fields[suppressedField]; ok {
+		t.Error("Expected suppressed entries to be reported once")
+	}
+}
+
+func TestRateLimitHandlerWithoutLimit(t *testing.T) {
+	output := memory.New()
+	h := newRateLimitHandler(output, 0)
+	for i := 0; i < 100; i++ {
+		h.HandleLog(testEntry(log.WarnLevel, "Invalid CRC", rateLimited(log.Fields{"Index": i})))
+	}
+	if len(output.Entries) != 100 {
+		t.Fatalf("Expected all entries without limit, got %d", len(output.Entries))
+	}
+	if fields := output.Entries[0].Fields; !reflect.DeepEqual(fields, log.Fields{"Index": 0}) {
+		t.Errorf("Expected %s field to be removed, got %v", rateLimitedField, fields)
+	}
+}
+
+func TestComponentLevelHandler(t *testing.T) {
+	output := memory.New()
+	h := newComponentLevelHandler(output, log.InfoLevel, map[string]log.Level{GPSComponent: log.WarnLevel, UplinkComponent: log.DebugLevel})
+	h.HandleLog(testEntry(log.DebugLevel, "Debug", nil))
+	h.HandleLog(testEntry(log.InfoLevel, "Info", nil))
+	h.HandleLog(testEntry(log.InfoLevel, "GPS info", log.Fields{componentField: GPSComponent}))
+	h.HandleLog(testEntry(log.WarnLevel, "GPS warning", log.Fields{componentField: GPSComponent}))
+	h.HandleLog(testEntry(log.DebugLevel, "Uplink debug", log.Fields{componentField: UplinkComponent}))
+
+	var messages []string
+	for _, e := range output.Entries {
+		messages = append(messages, e.Message)
+	}
+	if expected := []string{"Info", "GPS warning", "Uplink debug"}; !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v, got %v", expected, messages)
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := newJSONHandler(&buf)
+	err := h.HandleLog(testEntry(log.WarnLevel, "Downlink refused", log.Fields{
+		"Error":    errors.New("collision"),
+		"Time":     testEntryTime,
+		"Duration": 1500 * time.Millisecond,
+		"Count":    3,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Invalid JSON %q: %s", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"time":     "2017-06-01T12:30:00Z",
+		"level":    "warn",
+		"msg":      "Downlink refused",
+		"Error":    "collision",
+		"Time":     "2017-06-01T12:30:00Z",
+		"Duration": "1.5s",
+		"Count":    float64(3),
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Errorf("Expected %v, got %v", expected, entry)
+	}
+}
+
+func TestLogfmtHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := newLogfmtHandler(&buf)
+	err := h.HandleLog(testEntry(log.InfoLevel, "Uplink received", log.Fields{
+		"Frequency": 868100000,
+		"DataRate":  "SF7BW125",
+		"Error":     errors.New("invalid CRC"),
+		"Empty":     "",
+		"Quote":     `a"b`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `time=2017-06-01T12:30:00Z level=info msg="Uplink received" DataRate=SF7BW125 Empty="" Error="invalid CRC" Frequency=868100000 Quote="a\"b"` + "\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	logIdentifier = "packet-forwarder"
+	// journaldSocket is the socket of the native protocol of journald
+	journaldSocket = "/run/systemd/journal/socket"
+	// rotatedLogFileSuffix is appended to the name of the log files when they are rotated
+	rotatedLogFileSuffix = ".20060102-150405.000"
+)
+
+// rotatingFile is a log file, rotated when it reaches its maximal size or age. Rotated files are
+// renamed with their rotation time, and only the most recent backups are kept.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(path string, maxSizeMB int, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't open log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) needsRotation(writeSize int) bool {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(writeSize) > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Now().Sub(f.opened) > f.maxAge
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.path+time.Now().Format(rotatedLogFileSuffix)); err != nil {
+		return errors.Wrap(err, "Couldn't rotate log file")
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeOldBackups()
+}
+
+// removeOldBackups removes the rotated files beyond the maximal number of backups. The rotation
+// time in their name orders them chronologically.
+func (f *rotatingFile) removeOldBackups() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.needsRotation(len(p)) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// syslogHandler writes the entries to the local syslog daemon, in the logfmt format
+type syslogHandler struct {
+	w *syslog.Writer
+}
+
+func newSyslogHandler() (*syslogHandler, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't connect to syslog")
+	}
+	return &syslogHandler{w: w}, nil
+}
+
+func (h *syslogHandler) HandleLog(e *log.Entry) error {
+	var buf bytes.Buffer
+	formatLogfmt(&buf, e)
+	message := buf.String()
+	switch e.Level {
+	case log.DebugLevel:
+		return h.w.Debug(message)
+	case log.InfoLevel:
+		return h.w.Info(message)
+	case log.WarnLevel:
+		return h.w.Warning(message)
+	case log.ErrorLevel:
+		return h.w.Err(message)
+	}
+	return h.w.Crit(message)
+}
+
+// journaldPriorities are the syslog priorities of the log levels
+var journaldPriorities = map[log.Level]syslog.Priority{
+	log.DebugLevel: syslog.LOG_DEBUG,
+	log.InfoLevel:  syslog.LOG_INFO,
+	log.WarnLevel:  syslog.LOG_WARNING,
+	log.ErrorLevel: syslog.LOG_ERR,
+	log.FatalLevel: syslog.LOG_CRIT,
+}
+
+// journaldHandler sends the entries to journald with its native protocol, keeping the fields as
+// journal fields
+type journaldHandler struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHandler() (*journaldHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't connect to journald")
+	}
+	return &journaldHandler{conn: conn}, nil
+}
+
+// journaldFieldName converts a field name to a journal field name, made of uppercase letters,
+// digits and underscores
+func journaldFieldName(name string) string {
+	converted := []byte(strings.ToUpper(name))
+	for i, c := range converted {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			converted[i] = '_'
+		}
+	}
+	// Fields starting with an underscore are reserved to journald
+	return strings.TrimLeft(string(converted), "_")
+}
+
+// writeJournaldField appends a field in the format of the native protocol. Values containing a
+// newline are prefixed with their length.
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (h *journaldHandler) HandleLog(e *log.Entry) error {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", e.Message)
+	writeJournaldField(&buf, "PRIORITY", fmt.Sprint(int(journaldPriorities[e.Level])))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", logIdentifier)
+	for _, name := range sortedFieldNames(e.Fields) {
+		fieldName := journaldFieldName(name)
+		if fieldName == "" {
+			continue
+		}
+		writeJournaldField(&buf, fieldName, fmt.Sprint(fieldValue(e.Fields[name])))
+	}
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempLogFile(t *testing.T, maxBackups int) (*rotatingFile, string, func()) {
+	dir, err := ioutil.TempDir("", "pktfwd-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "pktfwd.log")
+	f, err := openLogFile(path, 0, 0, maxBackups)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return f, path, func() {
+		f.file.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func backups(t *testing.T, path string) []string {
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// writeLine writes a line to the log file, waiting for the rotation time suffix to change
+func writeLine(t *testing.T, f *rotatingFile, line string) {
+	time.Sleep(2 * time.Millisecond)
+	if _, err := f.Write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	f, path, cleanup := tempLogFile(t, 2)
+	defer cleanup()
+	f.maxSize = 10
+
+	writeLine(t, f, "first\n")
+	writeLine(t, f, "abc\n")
+	if n := len(backups(t, path)); n != 0 {
+		t.Fatalf("Expected no rotation under the maximal size, got %d backups", n)
+	}
+	writeLine(t, f, "second\n")
+	names := backups(t, path)
+	if len(names) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(names))
+	}
+	if content, _ := ioutil.ReadFile(names[0]); !bytes.Equal(content, []byte("first\nabc\n")) {
+		t.Errorf("Expected the previous lines in the backup, got %q", content)
+	}
+	if content, _ := ioutil.ReadFile(path); !bytes.Equal(content, []byte("second\n")) {
+		t.Errorf("Expected the new line in the log file, got %q", content)
+	}
+
+	// Only the most recent backups are kept
+	writeLine(t, f, "a line longer than the maximal size\n")
+	writeLine(t, f, "last\n")
+	names = backups(t, path)
+	if len(names) != 2 {
+		t.Fatalf("Expected only the 2 most recent backups to be kept, got %d", len(names))
+	}
+	if content, _ := ioutil.ReadFile(names[0]); !bytes.Equal(content, []byte("second\n")) {
+		t.Errorf("Expected the oldest backups to be removed, got %q in the oldest backup", content)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	f, path, cleanup := tempLogFile(t, 0)
+	defer cleanup()
+	f.maxAge = time.Hour
+
+	writeLine(t, f, "first\n")
+	if n := len(backups(t, path)); n != 0 {
+		t.Fatalf("Expected no rotation before the maximal age, got %d backups", n)
+	}
+	f.opened = f.opened.Add(-2 * time.Hour)
+	writeLine(t, f, "second\n")
+	if n := len(backups(t, path)); n != 1 {
+		t.Fatalf("Expected rotation after the maximal age, got %d backups", n)
+	}
+	if time.Now().Sub(f.opened) > time.Minute {
+		t.Error("Expected the age of the new file to be reset")
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	f, path, cleanup := tempLogFile(t, 0)
+	writeLine(t, f, "first\n")
+	f.file.Close()
+
+	reopened, err := openLogFile(path, 1, 0, 0)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer func() {
+		reopened.file.Close()
+		cleanup()
+	}()
+	if reopened.size != int64(len("first\n")) {
+		t.Errorf("Expected the size of the existing file, got %d", reopened.size)
+	}
+	writeLine(t, reopened, "second\n")
+	if content, _ := ioutil.ReadFile(path); !bytes.Equal(content, []byte("first\nsecond\n")) {
+		t.Errorf("Expected the log file to be appended, got %q", content)
+	}
+}
+
+func TestJournaldFieldName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Frequency":   "FREQUENCY",
+		"GPS-Time":    "GPS_TIME",
+		"_Private":    "PRIVATE",
+		"data.rate_2": "DATA_RATE_2",
+	} {
+		if actual := journaldFieldName(name); actual != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, actual)
+		}
+	}
+}
+
+func TestWriteJournaldField(t *testing.T) {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", "single line")
+	writeJournaldField(&buf, "ERROR", "two\nlines")
+	expected := "MESSAGE=single line\nERROR\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright © 2017 The Things Network. Use of this source code is governed by the MIT license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	// encryptedSecretPrefix marks the secrets encrypted with the machine key
+	encryptedSecretPrefix = "encrypted:"
+	// credentialsDirectoryEnv is set by systemd to the directory of the credentials of the service
+	credentialsDirectoryEnv = "CREDENTIALS_DIRECTORY"
+	machineKeyContext       = "ttn-packet-forwarder secret"
+)
+
+// machineIDFiles contain an identifier of the machine, stable across reboots
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// Secret is a sensitive value, such as the gateway key. It is redacted when formatted or marshaled,
+// so that it never appears in logs.
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// GoString redacts the secret when formatted with %#v
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// MarshalJSON redacts the secret when marshaled
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Value returns the secret in cleartext
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// LoadSecret loads the secret designated by name. It is read from the file set in <name>-file if
+// any, else from the systemd credential <name> if $CREDENTIALS_DIRECTORY contains it, else from the
+// value of <name>. <name>-file and <name> can be set in the flags, the environment or the
+// configuration file. Secrets encrypted with EncryptSecret are decrypted.
+func LoadSecret(name string) (Secret, error) {
+	var value string
+	if path := viper.GetString(name + "-file"); path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "Couldn't read %s file", name)
+		}
+		value = string(content)
+	} else if dir := os.Getenv(credentialsDirectoryEnv); dir != "" && credentialExists(dir, name) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", errors.Wrapf(err, "Couldn't read %s credential", name)
+		}
+		value = string(content)
+	} else {
+		value = viper.GetString(name)
+	}
+
+	value = strings.TrimSpace(value)
+	if IsEncryptedSecret(value) {
+		return DecryptSecret(value)
+	}
+	return Secret(value), nil
+}
+
+func credentialExists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+// machineKey derives an AES-256 key from the machine identifier, so that encrypted secrets can
+// only be decrypted on the machine that encrypted them. As the machine identifier is world-readable,
+// this only obfuscates the secrets: any local user can derive the key.
+func machineKey() ([]byte, error) {
+	for _, file := range machineIDFiles {
+		id, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if id := strings.TrimSpace(string(id)); id != "" {
+			key := sha256.Sum256([]byte(machineKeyContext + id))
+			return key[:], nil
+		}
+	}
+	return nil, errors.New("No machine identifier available to encrypt or decrypt secrets")
+}
+
+func machineCipher() (cipher.AEAD, error) {
+	key, err := machineKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret encrypts the secret with a key bound to the machine. This is obfuscation against
+// copies of the configuration file, not protection against the local users.
+func EncryptSecret(s Secret) (string, error) {
+	gcm, err := machineCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(s.Value()), nil)
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// IsEncryptedSecret returns true if the value was encrypted with EncryptSecret
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// DecryptSecret decrypts a secret encrypted with EncryptSecret on the same machine
+func DecryptSecret(value string) (Secret, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil {
+		return "", errors.Wrap(err, "Invalid encrypted secret")
+	}
+	gcm, err := machineCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("Invalid encrypted secret")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("Couldn't decrypt secret - was it encrypted on another machine?")
+	}
+	return Secret(plaintext), nil
+}
@@ -51,3 +51,16 @@ func GetConfigFile() string {
 	// no file found, set up correct fallback
 	return homeyml
 }
+
+// GetEventsFile returns the path of the event journal: the events-file setting, or a file in the
+// home directory
+func GetEventsFile() string {
+	if file := viper.GetString("events-file"); file != "" {
+		return file
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return path.Join(home, ".pktfwd-events.jsonl")
+}
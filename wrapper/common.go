@@ -3,20 +3,27 @@
 package wrapper
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/TheThingsNetwork/ttn/api/gateway"
 )
 
 const LengthPayload = 256 // length of the payload in bytes
 
+// ErrChannelBusy is returned when a downlink isn't transmitted because listen-before-talk detected
+// activity on its channel
+var ErrChannelBusy = errors.New("Channel busy, downlink not transmitted (listen-before-talk)")
+
 // Packet describes the packets manipulated by the gateway
 type Packet struct {
 	Freq       uint32               // central frequency of the IF chain (in Hz)
 	IFChain    uint8                // by which IF chain was packet received
 	Status     uint8                // status of the received Packet
 	CountUS    uint32               // internal concentrator counter for timestamping, 1 microsecond resolution
-	Time       int64                // GPS-determined time
+	Time       int64                // Reception time, determined by TimeSource
+	TimeSource TimeSource           // Source of Time
 	Gps        *gateway.GPSMetadata // GPS Metadata
 	RFChain    uint8                // by which RF chain was packet received
 	Modulation uint8                // modulation used by the packet
@@ -30,6 +37,102 @@ type Packet struct {
 	CRC        uint16               // CRC that was received in the payload
 	Size       uint32               // Payload size in bytes
 	Payload    []byte               // Buffer containing the payload, not yet base64-encoded
+	// Fine timestamp of the packet, in nanoseconds since the last PPS pulse - SX1302 concentrators only
+	FineTimestamp      uint32
+	FineTimestampValid bool
+}
+
+// TimeSource designates how the reception time of a packet was determined
+type TimeSource uint8
+
+// Time sources
+const (
+	TimeSourceNone   TimeSource = iota // Reception time unknown
+	TimeSourceGPS                      // Reception time computed from the GPS time reference, usable for geolocation
+	TimeSourceSystem                   // Reception time estimated from the system clock
+)
+
+// TimeSyncState is the state of the synchronisation of the concentrator counter with the GPS time
+type TimeSyncState uint8
+
+// Time synchronisation states
+const (
+	TimeSyncUnavailable TimeSyncState = iota // No GPS
+	TimeSyncLocked                           // Synchronised on the last PPS pulses
+	TimeSyncDrifting                         // PPS pulses missed, the time is extrapolated from the last synchronisation
+	TimeSyncLost                             // No synchronisation, or too old to be used
+)
+
+var timeSyncStateString = map[TimeSyncState]string{
+	TimeSyncUnavailable: "unavailable",
+	TimeSyncLocked:      "locked",
+	TimeSyncDrifting:    "drifting",
+	TimeSyncLost:        "lost",
+}
+
+func (s TimeSyncState) String() string {
+	if val, ok := timeSyncStateString[s]; ok {
+		return val
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// GPSTimeSync describes the synchronisation of the concentrator counter with the GPS time
+type GPSTimeSync struct {
+	State    TimeSyncState
+	LastSync time.Time     // System time of the last successful synchronisation - zero if none
+	Age      time.Duration // Time elapsed since LastSync
+	Failures int           // Synchronisations rejected since LastSync
+	DriftPPM float64       // Estimated drift of the concentrator clock, in parts per million
+}
+
+// TXMode designates when the concentrator transmits a downlink
+type TXMode uint8
+
+// Transmission modes
+const (
+	TXModeTimestamped TXMode = iota // At the concentrator counter value of the downlink timestamp
+	TXModeImmediate                 // As soon as it is received by the concentrator
+	TXModeOnGPS                     // On the next PPS pulse of the GPS
+)
+
+var txModeString = map[TXMode]string{
+	TXModeTimestamped: "timestamped",
+	TXModeImmediate:   "immediate",
+	TXModeOnGPS:       "on-gps",
+}
+
+func (m TXMode) String() string {
+	if val, ok := txModeString[m]; ok {
+		return val
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(m))
+}
+
+// BeaconPacket is a Class B beacon, transmitted on a PPS pulse
+type BeaconPacket struct {
+	Frequency       uint32 // In Hz
+	RFChain         uint8
+	SpreadingFactor uint32
+	Bandwidth       uint32 // In Hz
+	Power           int8   // EIRP, in dBm
+	Payload         []byte
+}
+
+// RSSIHistogramSize is the number of bins of an RSSI histogram
+const RSSIHistogramSize = 256
+
+// RSSIHistogram is the distribution of the RSSI samples measured by a spectral scan at a frequency
+type RSSIHistogram struct {
+	Frequency uint32 // In Hz
+	// Counts[i] is the number of samples measured with an RSSI of RSSIBin(i, offset)
+	Counts [RSSIHistogramSize]uint16
+}
+
+// RSSIBin returns the RSSI, in dBm, of a bin of an RSSI histogram. The bins are 0.5dB wide, from
+// the highest to the lowest RSSI, and offset is the RSSI offset of the radio.
+func RSSIBin(bin int, offset int) float64 {
+	return -float64(bin)/2 + float64(offset)
 }
 
 type GPSCoordinates struct {
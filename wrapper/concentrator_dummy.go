@@ -3,6 +3,8 @@
 package wrapper
 
 import (
+	"errors"
+
 	"github.com/TheThingsNetwork/go-utils/log"
 	"github.com/TheThingsNetwork/packet_forwarder/util"
 )
@@ -15,6 +17,14 @@ func StartLoRaGateway() error {
 	return nil
 }
 
+func GetInstantCounter() (uint32, error) {
+	return 0, errors.New("Dummy HAL - No concentrator counter")
+}
+
+func GetConcentratorTemperature() (float32, error) {
+	return 0, errors.New("Dummy HAL - No concentrator temperature sensor")
+}
+
 func StopLoRaGateway() error {
 	return nil
 }
@@ -23,6 +33,10 @@ func SetBoardConf(ctx log.Interface, conf util.Config) error {
 	return nil
 }
 
+func SetLBTConf(ctx log.Interface, lbtConf util.LbtConf) error {
+	return nil
+}
+
 func SetTXGainConf(ctx log.Interface, conc util.SX1301Conf) error {
 	return nil
 }
@@ -22,6 +22,12 @@ import (
 
 var concentratorMutex = &sync.Mutex{}
 
+// Range of the TX notch filter frequency of SX1257 radios, in Hz
+const (
+	minTXNotchFreq = 126000
+	maxTXNotchFreq = 250000
+)
+
 var loraChannelBandwidths = map[uint32]C.uint8_t{
 	7800:   C.BW_7K8HZ,
 	15600:  C.BW_15K6HZ,
@@ -57,6 +63,23 @@ func StartLoRaGateway() error {
 	return nil
 }
 
+// gpsSync wraps lgw_gps_sync, to update the GPS time reference
+func gpsSync(ref *C.struct_tref, count C.uint32_t, utc C.struct_timespec) bool {
+	return C.lgw_gps_sync(ref, count, utc) == C.LGW_GPS_SUCCESS
+}
+
+// GetInstantCounter returns the current value of the counter of the concentrator. libloragw v1
+// only exposes the counter latched on the PPS pulse.
+func GetInstantCounter() (uint32, error) {
+	return 0, errors.New("The instant counter of the concentrator isn't available with this HAL")
+}
+
+// GetConcentratorTemperature returns the temperature of the concentrator, in °C. libloragw v1
+// doesn't expose the temperature sensor of the board.
+func GetConcentratorTemperature() (float32, error) {
+	return 0, errors.New("The concentrator temperature isn't available with this HAL")
+}
+
 // StopLoRaGateway wraps the HAL function to stop the concentrator once started
 func StopLoRaGateway() error {
 	state := C.lgw_stop()
@@ -84,6 +107,38 @@ func SetBoardConf(ctx log.Interface, conf util.Config) error {
 	return nil
 }
 
+// SetLBTConf configures listen-before-talk on the concentrator. It must be called before the
+// concentrator is started.
+func SetLBTConf(ctx log.Interface, lbtConf util.LbtConf) error {
+	if len(lbtConf.ChannelsConfig) > C.LBT_CHANNEL_FREQ_NB {
+		return fmt.Errorf("Too many LBT channels configured (%d, maximum %d)", len(lbtConf.ChannelsConfig), C.LBT_CHANNEL_FREQ_NB)
+	}
+
+	var cLBTConf = C.struct_lgw_conf_lbt_s{
+		enable:      C.bool(lbtConf.Enabled),
+		rssi_target: C.int8_t(lbtConf.RssiTarget),
+		rssi_offset: C.int8_t(lbtConf.RssiOffset),
+		nb_channel:  C.uint8_t(len(lbtConf.ChannelsConfig)),
+	}
+	for i, channel := range lbtConf.ChannelsConfig {
+		// The FPGA only supports these scan times
+		if channel.ScanTime != 128 && channel.ScanTime != 5000 {
+			return fmt.Errorf("Unsupported LBT scan time %dµs for channel %d (supported: 128µs, 5000µs)", channel.ScanTime, channel.Freq)
+		}
+		cLBTConf.channels[i].freq_hz = C.uint32_t(channel.Freq)
+		cLBTConf.channels[i].scan_time_us = C.uint16_t(channel.ScanTime)
+	}
+
+	if C.lgw_lbt_setconf(cLBTConf) != C.LGW_HAL_SUCCESS {
+		return errors.New("Failed LBT configuration")
+	}
+	ctx.WithFields(log.Fields{
+		"RSSITarget": lbtConf.RssiTarget,
+		"Channels":   len(lbtConf.ChannelsConfig),
+	}).Info("Listen-before-talk configured")
+	return nil
+}
+
 /* prepareTXLut takes the pointer to an empty C.struct_lgw_tx_gain_s, its configuration wrapped in Go, and transposes
 the configuration in the C.struct_lgw_tx_gain_s. It also increments the size of the TX Gain Lut table. */
 func prepareTXLut(txLut *C.struct_lgw_tx_gain_s, txConf util.GainTableConf) {
@@ -131,6 +186,13 @@ func initRadio(radio util.RadioConf) (C.struct_lgw_conf_rxrf_s, error) {
 	switch radio.RadioType {
 	case "SX1257":
 		C.setType(&cRadio, C.LGW_RADIO_TYPE_SX1257)
+		// The TX notch filter is only available on SX1257 radios
+		if notch := radio.TxNotchFreq; notch != nil && radio.TxEnabled {
+			if *notch < minTXNotchFreq || *notch > maxTXNotchFreq {
+				return cRadio, fmt.Errorf("Invalid TX notch filter frequency %d (should be between %d and %d)", *notch, minTXNotchFreq, maxTXNotchFreq)
+			}
+			cRadio.tx_notch_freq = C.uint32_t(*notch)
+		}
 	case "SX1255":
 		C.setType(&cRadio, C.LGW_RADIO_TYPE_SX1255)
 	default:
@@ -158,11 +220,12 @@ func enableRadio(ctx log.Interface, radio util.RadioConf, nb uint8) error {
 	}
 
 	ctx.WithFields(log.Fields{
-		"Radio":      nb,
-		"Type":       radio.RadioType,
-		"EnabledTX":  radio.TxEnabled,
-		"Frequency":  radio.Freq,
-		"RSSIOffset": radio.RssiOffset,
+		"Radio":            nb,
+		"Type":             radio.RadioType,
+		"EnabledTX":        radio.TxEnabled,
+		"Frequency":        radio.Freq,
+		"RSSIOffset":       radio.RssiOffset,
+		"TXNotchFrequency": uint32(cRadio.tx_notch_freq),
 	}).Info("Radio configured")
 	return nil
 }
@@ -0,0 +1,395 @@
+// +build halv2
+
+package wrapper
+
+// #cgo CFLAGS: -I${SRCDIR}/../sx1302_hal/libloragw/inc
+// #cgo LDFLAGS: ${SRCDIR}/../sx1302_hal/libloragw/libloragw.a -lm -lpthread -lrt
+// #include <stdlib.h>
+// #include <string.h>
+// #include "loragw_hal.h"
+// #include "loragw_gps.h"
+// void setComPath(struct lgw_conf_board_s *boardConf, const char *path) {
+// 	strncpy(boardConf->com_path, path, sizeof(boardConf->com_path) - 1);
+// }
+import "C"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+)
+
+var concentratorMutex = &sync.Mutex{}
+
+// defaultSPIDevice is used if the frequency plan doesn't set the SPI device
+const defaultSPIDevice = "/dev/spidev0.0"
+
+// Default gains of the TX gain LUT entries
+const (
+	defaultDACGain = 3
+	defaultMixGain = 5
+)
+
+// gpsEpoch is the origin of the GPS time, and gpsLeapSeconds the difference between the GPS time and
+// UTC
+var gpsEpoch = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC)
+
+const gpsLeapSeconds = 18
+
+var loraChannelBandwidths = map[uint32]C.uint8_t{
+	125000: C.BW_125KHZ,
+	250000: C.BW_250KHZ,
+	500000: C.BW_500KHZ,
+}
+
+var loraChannelSpreadingFactors = map[uint32]C.uint32_t{
+	5:  C.DR_LORA_SF5,
+	6:  C.DR_LORA_SF6,
+	7:  C.DR_LORA_SF7,
+	8:  C.DR_LORA_SF8,
+	9:  C.DR_LORA_SF9,
+	10: C.DR_LORA_SF10,
+	11: C.DR_LORA_SF11,
+	12: C.DR_LORA_SF12,
+}
+
+var radioTypes = map[string]C.lgw_radio_type_t{
+	"SX1250": C.LGW_RADIO_TYPE_SX1250,
+	"SX1255": C.LGW_RADIO_TYPE_SX1255,
+	"SX1257": C.LGW_RADIO_TYPE_SX1257,
+}
+
+var fineTimestampModes = map[string]C.lgw_ftime_mode_t{
+	"high_capacity": C.LGW_FTIME_MODE_HIGH_CAPACITY,
+	"all_sf":        C.LGW_FTIME_MODE_ALL_SF,
+}
+
+// LoRaGatewayVersionInfo returns a string with information on the HAL
+func LoRaGatewayVersionInfo() string {
+	return C.GoString(C.lgw_version_info())
+}
+
+// gpsSync wraps lgw_gps_sync, that also takes the GPS time of the PPS pulse
+func gpsSync(ref *C.struct_tref, count C.uint32_t, utc C.struct_timespec) bool {
+	utcTime := time.Unix(int64(utc.tv_sec), int64(utc.tv_nsec))
+	gpsTime := utcTime.Sub(gpsEpoch) + gpsLeapSeconds*time.Second
+	var cGPSTime C.struct_timespec
+	cGPSTime.tv_sec = C.time_t(gpsTime / time.Second)
+	cGPSTime.tv_nsec = C.long(gpsTime % time.Second)
+	return C.lgw_gps_sync(ref, count, utc, cGPSTime) == C.LGW_GPS_SUCCESS
+}
+
+// StartLoRaGateway wraps the HAL function to start the concentrator once configured
+func StartLoRaGateway() error {
+	if C.lgw_start() != C.LGW_HAL_SUCCESS {
+		return errors.New("Failed to start concentrator")
+	}
+	return nil
+}
+
+// GetInstantCounter returns the current value of the counter of the concentrator
+func GetInstantCounter() (uint32, error) {
+	var count C.uint32_t
+	concentratorMutex.Lock()
+	ok := C.lgw_get_instcnt(&count) == C.LGW_HAL_SUCCESS
+	concentratorMutex.Unlock()
+	if !ok {
+		return 0, errors.New("Failed to read the concentrator counter")
+	}
+	return uint32(count), nil
+}
+
+// GetConcentratorTemperature returns the temperature of the concentrator, in °C
+func GetConcentratorTemperature() (float32, error) {
+	var temperature C.float
+	concentratorMutex.Lock()
+	ok := C.lgw_get_temperature(&temperature) == C.LGW_HAL_SUCCESS
+	concentratorMutex.Unlock()
+	if !ok {
+		return 0, errors.New("Failed to read the concentrator temperature")
+	}
+	return float32(temperature), nil
+}
+
+// StopLoRaGateway wraps the HAL function to stop the concentrator once started
+func StopLoRaGateway() error {
+	if C.lgw_stop() != C.LGW_HAL_SUCCESS {
+		return errors.New("Failed to stop concentrator gracefully")
+	}
+	return nil
+}
+
+// SetBoardConf configures the concentrator's board, and the fine timestamping of the uplinks
+func SetBoardConf(ctx log.Interface, conf util.Config) error {
+	if comType := conf.Concentrator.ComType; comType != nil && *comType != "SPI" {
+		return fmt.Errorf("Unsupported concentrator interface %s (only SPI is supported)", *comType)
+	}
+	device := defaultSPIDevice
+	if conf.Concentrator.ComPath != nil && *conf.Concentrator.ComPath != "" {
+		device = *conf.Concentrator.ComPath
+	}
+
+	var boardConf = C.struct_lgw_conf_board_s{
+		clksrc:         C.uint8_t(conf.Concentrator.Clksrc),
+		lorawan_public: C.bool(conf.Concentrator.LorawanPublic),
+		full_duplex:    C.bool(conf.Concentrator.FullDuplex),
+		com_type:       C.LGW_COM_SPI,
+	}
+	cDevice := C.CString(device)
+	defer C.free(unsafe.Pointer(cDevice))
+	C.setComPath(&boardConf, cDevice)
+
+	if C.lgw_board_setconf(&boardConf) != C.LGW_HAL_SUCCESS {
+		return errors.New("Failed board configuration")
+	}
+	ctx.WithFields(log.Fields{
+		"ClockSource":   conf.Concentrator.Clksrc,
+		"LorawanPublic": conf.Concentrator.LorawanPublic,
+		"FullDuplex":    conf.Concentrator.FullDuplex,
+		"SPIDevice":     device,
+	}).Info("SX1302 board configured")
+
+	return setFineTimestampConf(ctx, conf.Concentrator.FineTimestamp)
+}
+
+func setFineTimestampConf(ctx log.Interface, ftimeConf *util.FineTimestampConf) error {
+	if ftimeConf == nil || !ftimeConf.Enabled {
+		return nil
+	}
+	mode := ftimeConf.Mode
+	if mode == "" {
+		mode = "all_sf"
+	}
+	cMode, ok := fineTimestampModes[mode]
+	if !ok {
+		return fmt.Errorf("Unknown fine timestamp mode %s (should be high_capacity or all_sf)", mode)
+	}
+
+	var cConf = C.struct_lgw_conf_ftime_s{
+		enable: C.bool(true),
+		mode:   cMode,
+	}
+	if C.lgw_ftime_setconf(&cConf) != C.LGW_HAL_SUCCESS {
+		return errors.New("Failed fine timestamp configuration")
+	}
+	ctx.WithField("Mode", mode).Info("Fine timestamping configured")
+	return nil
+}
+
+// SetLBTConf returns an error if listen-before-talk is enabled: on SX1302 gateways, it requires the
+// additional SX1261 radio, which isn't supported by this backend
+func SetLBTConf(ctx log.Interface, lbtConf util.LbtConf) error {
+	if lbtConf.Enabled {
+		return errors.New("Listen-before-talk is not supported on SX1302 concentrators")
+	}
+	return nil
+}
+
+// prepareTXLut transposes a TX gain LUT entry of the configuration in a C.struct_lgw_tx_gain_s
+func prepareTXLut(txLut *C.struct_lgw_tx_gain_s, txConf util.GainTableConf) {
+	txLut.dac_gain = defaultDACGain
+	if txConf.DacGain != nil {
+		txLut.dac_gain = C.uint8_t(*txConf.DacGain)
+	}
+	txLut.mix_gain = defaultMixGain
+	if txConf.MixGain != 0 {
+		txLut.mix_gain = C.uint8_t(txConf.MixGain)
+	}
+	txLut.dig_gain = C.uint8_t(txConf.DigGain)
+	txLut.rf_power = C.int8_t(txConf.RfPower)
+	txLut.pa_gain = C.uint8_t(txConf.PaGain)
+	if txConf.PwrIdx != nil {
+		txLut.pwr_idx = C.uint8_t(*txConf.PwrIdx)
+	}
+}
+
+// SetTXGainConf sends the TX gain LUT of each radio enabled for transmission to the concentrator.
+// The tx_gain_lut of a radio has priority over the tx_lut_* entries of the concentrator.
+func SetTXGainConf(ctx log.Interface, conc util.SX1301Conf) error {
+	for rfChain, radio := range conc.GetRadios() {
+		if !radio.Enabled || !radio.TxEnabled {
+			continue
+		}
+		txLuts := radio.TxGainLut
+		if len(txLuts) == 0 {
+			txLuts = conc.GetTXLuts()
+		}
+		if len(txLuts) == 0 || len(txLuts) > C.TX_GAIN_LUT_SIZE_MAX {
+			return fmt.Errorf("Invalid TX gain LUT size for RF chain %d (%d, maximum %d)", rfChain, len(txLuts), C.TX_GAIN_LUT_SIZE_MAX)
+		}
+
+		var gainLut C.struct_lgw_tx_gain_lut_s
+		for i, txLut := range txLuts {
+			prepareTXLut(&gainLut.lut[i], txLut)
+		}
+		gainLut.size = C.uint8_t(len(txLuts))
+
+		if C.lgw_txgain_setconf(C.uint8_t(rfChain), &gainLut) != C.LGW_HAL_SUCCESS {
+			return fmt.Errorf("Failed to configure concentrator TX Gain LUT of RF chain %d", rfChain)
+		}
+		ctx.WithFields(log.Fields{
+			"RFChain": rfChain,
+			"Indexes": len(txLuts),
+		}).Info("Configured TX Lut")
+	}
+	return nil
+}
+
+// initRadio initiates a radio configuration in the C.struct_lgw_conf_rxrf_s format
+func initRadio(radio util.RadioConf) (C.struct_lgw_conf_rxrf_s, error) {
+	var cRadio = C.struct_lgw_conf_rxrf_s{
+		enable:            C.bool(radio.Enabled),
+		freq_hz:           C.uint32_t(radio.Freq),
+		rssi_offset:       C.float(radio.RssiOffset),
+		tx_enable:         C.bool(radio.TxEnabled),
+		single_input_mode: C.bool(radio.SingleInputMode),
+	}
+	radioType, ok := radioTypes[radio.RadioType]
+	if !ok {
+		return cRadio, errors.New("Invalid radio type (should be SX1250, SX1255 or SX1257)")
+	}
+	cRadio._type = radioType
+	if tcomp := radio.RssiTcomp; tcomp != nil {
+		cRadio.rssi_tcomp = C.struct_lgw_rssi_tcomp_s{
+			coeff_a: C.float(tcomp.CoeffA),
+			coeff_b: C.float(tcomp.CoeffB),
+			coeff_c: C.float(tcomp.CoeffC),
+			coeff_d: C.float(tcomp.CoeffD),
+			coeff_e: C.float(tcomp.CoeffE),
+		}
+	}
+	return cRadio, nil
+}
+
+// SetRFChannels sends the configuration of the radios to the concentrator
+func SetRFChannels(ctx log.Interface, conf util.Config) error {
+	for i, radio := range conf.Concentrator.GetRadios() {
+		if !radio.Enabled {
+			ctx.WithField("Radio", i).Info("Radio disabled")
+			continue
+		}
+		cRadio, err := initRadio(radio)
+		if err != nil {
+			return err
+		}
+		if C.lgw_rxrf_setconf(C.uint8_t(i), &cRadio) != C.LGW_HAL_SUCCESS {
+			ctx.WithField("Radio", i).Warn("Invalid configuration")
+			return errors.New("Radio configuration failed")
+		}
+		ctx.WithFields(log.Fields{
+			"Radio":           i,
+			"Type":            radio.RadioType,
+			"EnabledTX":       radio.TxEnabled,
+			"Frequency":       radio.Freq,
+			"RSSIOffset":      radio.RssiOffset,
+			"SingleInputMode": radio.SingleInputMode,
+		}).Info("Radio configured")
+	}
+	return nil
+}
+
+// SetSFChannels enables the different SF channels
+func SetSFChannels(ctx log.Interface, conf util.Config) error {
+	for i, channelConf := range conf.Concentrator.GetMultiSFChannels() {
+		if i >= C.LGW_MULTI_NB {
+			break
+		}
+		if !channelConf.Enabled {
+			ctx.WithField("Channel", i).Info("Lora multi-SF channel disabled")
+			continue
+		}
+		var cChannel = C.struct_lgw_conf_rxif_s{
+			enable:   C.bool(true),
+			rf_chain: C.uint8_t(channelConf.Radio),
+			freq_hz:  C.int32_t(channelConf.IfValue),
+		}
+		if C.lgw_rxif_setconf(C.uint8_t(i), &cChannel) != C.LGW_HAL_SUCCESS {
+			return fmt.Errorf("Missing configuration for SF channel %d", i)
+		}
+		ctx.WithFields(log.Fields{
+			"Lora multi-SF channel": i,
+			"RFChain":               channelConf.Radio,
+			"Freq":                  channelConf.IfValue,
+		}).Info("LoRa multi-SF channel configured")
+	}
+	return nil
+}
+
+// SetStandardChannel enables the LoRa standard channel from the configuration. Its spreading factor
+// is read from spread_factor, or from datarate for frequency plans written for SX1301 concentrators.
+func SetStandardChannel(ctx log.Interface, stdChan util.ChannelConf) error {
+	if !stdChan.Enabled {
+		ctx.Info("LoRa standard channel disabled")
+		return nil
+	}
+
+	var cChannel = C.struct_lgw_conf_rxif_s{
+		enable:                  C.bool(true),
+		rf_chain:                C.uint8_t(stdChan.Radio),
+		freq_hz:                 C.int32_t(stdChan.IfValue),
+		bandwidth:               C.BW_UNDEFINED,
+		datarate:                C.DR_UNDEFINED,
+		implicit_hdr:            C.bool(stdChan.ImplicitHeader),
+		implicit_payload_length: C.uint8_t(stdChan.ImplicitPayloadLength),
+		implicit_crc_en:         C.bool(stdChan.ImplicitCRC),
+		implicit_coderate:       C.uint8_t(stdChan.ImplicitCoderate),
+	}
+	if stdChan.Bandwidth != nil {
+		if bandwidth, ok := loraChannelBandwidths[*stdChan.Bandwidth]; ok {
+			cChannel.bandwidth = bandwidth
+		}
+	}
+	var spreadingFactor uint32
+	if stdChan.SpreadFactor != nil {
+		spreadingFactor = uint32(*stdChan.SpreadFactor)
+	} else if stdChan.Datarate != nil {
+		spreadingFactor = *stdChan.Datarate
+	}
+	if datarate, ok := loraChannelSpreadingFactors[spreadingFactor]; ok {
+		cChannel.datarate = datarate
+	}
+
+	if C.lgw_rxif_setconf(8, &cChannel) != C.LGW_HAL_SUCCESS {
+		return errors.New("Configuration for LoRa standard channel failed")
+	}
+	return nil
+}
+
+// SetFSKChannel sets the FSK Channel configuration on the concentrator
+func SetFSKChannel(ctx log.Interface, fskChan util.ChannelConf) error {
+	if !fskChan.Enabled {
+		ctx.Info("FSK channel disabled")
+		return nil
+	}
+	if fskChan.Bandwidth == nil {
+		return errors.New("No bandwidth information in the configuration for the FSK channel - cannot retransmit the FSK packet")
+	}
+
+	var cFSKChan = C.struct_lgw_conf_rxif_s{
+		enable:    C.bool(true),
+		rf_chain:  C.uint8_t(fskChan.Radio),
+		freq_hz:   C.int32_t(fskChan.IfValue),
+		bandwidth: C.BW_UNDEFINED,
+	}
+	if fskChan.Datarate != nil {
+		cFSKChan.datarate = C.uint32_t(*fskChan.Datarate)
+	}
+	// The SX1302 only has 125, 250 and 500kHz bandwidths
+	switch val := *fskChan.Bandwidth; {
+	case val > 0 && val <= 125000:
+		cFSKChan.bandwidth = C.BW_125KHZ
+	case val > 125000 && val <= 250000:
+		cFSKChan.bandwidth = C.BW_250KHZ
+	case val > 250000 && val <= 500000:
+		cFSKChan.bandwidth = C.BW_500KHZ
+	}
+
+	if C.lgw_rxif_setconf(9, &cFSKChan) != C.LGW_HAL_SUCCESS {
+		return errors.New("Configuration for FSK channel failed")
+	}
+	return nil
+}
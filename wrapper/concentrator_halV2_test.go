@@ -0,0 +1,157 @@
+// +build halv2
+
+package wrapper
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+	"github.com/TheThingsNetwork/ttn/api/gateway"
+	"github.com/TheThingsNetwork/ttn/api/protocol"
+	"github.com/TheThingsNetwork/ttn/api/protocol/lorawan"
+	"github.com/TheThingsNetwork/ttn/api/router"
+)
+
+// The tests of this file run against the stub of the SX1302 HAL, with
+// `make hal.deps hal.test HAL_CHOICE=halv2 HALV2_STUB=1`
+
+const testFrequencyPlan = `{"SX1301_conf": {
+	"lorawan_public": true,
+	"clksrc": 0,
+	"com_type": "SPI",
+	"com_path": "/dev/spidev0.0",
+	"radio_0": {"enable": true, "type": "SX1250", "freq": 867500000, "rssi_offset": -215.4, "tx_enable": true,
+		"tx_gain_lut": [{"rf_power": 12, "pa_gain": 0, "pwr_idx": 15}, {"rf_power": 14, "pa_gain": 0, "pwr_idx": 16}]},
+	"radio_1": {"enable": true, "type": "SX1250", "freq": 868500000, "rssi_offset": -215.4, "tx_enable": false},
+	"chan_multiSF_0": {"enable": true, "radio": 1, "if": -400000},
+	"chan_multiSF_1": {"enable": true, "radio": 1, "if": -200000},
+	"chan_multiSF_2": {"enable": true, "radio": 1, "if": 0}
+}}`
+
+func testConfig(t *testing.T) util.Config {
+	var conf util.Config
+	if err := json.Unmarshal([]byte(testFrequencyPlan), &conf); err != nil {
+		t.Fatalf("Invalid test frequency plan: %v", err)
+	}
+	return conf
+}
+
+func testDownlink(power int32) *router.DownlinkMessage {
+	return &router.DownlinkMessage{
+		Payload: []byte{0x60, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00},
+		GatewayConfiguration: &gateway.TxConfiguration{
+			RfChain:               0,
+			Frequency:             868100000,
+			Power:                 power,
+			PolarizationInversion: true,
+		},
+		ProtocolConfiguration: &protocol.TxConfiguration{Protocol: &protocol.TxConfiguration_Lorawan{Lorawan: &lorawan.TxConfiguration{
+			Modulation: lorawan.Modulation_LORA,
+			DataRate:   "SF7BW125",
+			CodingRate: "4/5",
+		}}},
+	}
+}
+
+func TestStubConcentrator(t *testing.T) {
+	ctx := log.Get()
+	conf := testConfig(t)
+	if err := SetBoardConf(ctx, conf); err != nil {
+		t.Fatalf("Couldn't configure the board: %v", err)
+	}
+	if err := SetTXGainConf(ctx, conf.Concentrator); err != nil {
+		t.Fatalf("Couldn't configure the TX gain LUT: %v", err)
+	}
+	if err := SetRFChannels(ctx, conf); err != nil {
+		t.Fatalf("Couldn't configure the radios: %v", err)
+	}
+	if err := SetSFChannels(ctx, conf); err != nil {
+		t.Fatalf("Couldn't configure the multi-SF channels: %v", err)
+	}
+	if err := StartLoRaGateway(); err != nil {
+		t.Fatalf("Couldn't start the concentrator: %v", err)
+	}
+	defer StopLoRaGateway()
+
+	first, err := GetInstantCounter()
+	if err != nil {
+		t.Fatalf("Couldn't read the counter: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	second, err := GetInstantCounter()
+	if err != nil {
+		t.Fatalf("Couldn't read the counter: %v", err)
+	}
+	if elapsed := second - first; elapsed < 10000 || elapsed > 1000000 {
+		t.Errorf("Counter advanced by %dµs in 10ms", elapsed)
+	}
+
+	if temperature, err := GetConcentratorTemperature(); err != nil || temperature != 35 {
+		t.Errorf("Concentrator temperature is %f, %v", temperature, err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		downlink *router.DownlinkMessage
+		mode     TXMode
+		err      bool
+	}{
+		{name: "Immediate", downlink: testDownlink(14), mode: TXModeImmediate},
+		{name: "Timestamped", downlink: testDownlink(12), mode: TXModeTimestamped},
+		{name: "Power not in the TX gain LUT", downlink: testDownlink(27), mode: TXModeImmediate, err: true},
+		{name: "Unknown TX mode", downlink: testDownlink(14), mode: TXMode(42), err: true},
+	} {
+		err := SendDownlink(tc.downlink, tc.mode, conf, ctx)
+		if tc.err && err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		} else if !tc.err && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+
+	if testing.Short() {
+		return
+	}
+	// The stub receives a test uplink every 5 seconds, on the first multi-SF channel
+	deadline := time.Now().Add(6 * time.Second)
+	for time.Now().Before(deadline) {
+		packets, err := Receive()
+		if err != nil {
+			t.Fatalf("Couldn't receive: %v", err)
+		}
+		if len(packets) == 0 {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		packet := packets[0]
+		if packet.Freq != 868100000 || packet.IFChain != 0 || packet.RFChain != 1 {
+			t.Errorf("Test uplink received on %dHz (IF chain %d, RF chain %d)", packet.Freq, packet.IFChain, packet.RFChain)
+		}
+		if packet.Status != StatusCRCOK || packet.Modulation != ModulationLoRa || len(packet.Payload) != 13 {
+			t.Errorf("Unexpected test uplink %+v", packet)
+		}
+		return
+	}
+	t.Error("No test uplink received")
+}
+
+func TestFineTime(t *testing.T) {
+	second := int64(time.Second)
+	for _, tc := range []struct {
+		name          string
+		gpsTime       int64
+		fineTimestamp uint32
+		expected      int64
+	}{
+		{name: "Same second", gpsTime: 100*second + 250000000, fineTimestamp: 250001234, expected: 100*second + 250001234},
+		{name: "Reception time late", gpsTime: 101*second + 10000000, fineTimestamp: 999990000, expected: 100*second + 999990000},
+		{name: "Reception time early", gpsTime: 100*second + 990000000, fineTimestamp: 10000, expected: 101*second + 10000},
+	} {
+		if fine := fineTime(tc.gpsTime, tc.fineTimestamp); fine != tc.expected {
+			t.Errorf("%s: fine time is %d, expected %d", tc.name, fine, tc.expected)
+		}
+	}
+}
@@ -8,7 +8,12 @@ import (
 	"github.com/TheThingsNetwork/ttn/api/router"
 )
 
-func SendDownlink(downlink *router.DownlinkMessage, conf util.Config, ctx log.Interface) error {
-	ctx.Info("Dummy HAL - Downlink accepted")
+func SendDownlink(downlink *router.DownlinkMessage, mode TXMode, conf util.Config, ctx log.Interface) error {
+	ctx.WithFields(log.Fields{"TXMode": mode.String()}).Info("Dummy HAL - Downlink accepted")
+	return nil
+}
+
+func SendBeacon(beacon BeaconPacket, conf util.Config, ctx log.Interface) error {
+	ctx.Info("Dummy HAL - Beacon accepted")
 	return nil
 }
@@ -22,11 +22,18 @@ import (
 const (
 	stdFSKPreamble  = 4
 	stdLoRaPreamble = 8
+	beaconPreamble  = 10
 	fieldInfo       = 0
 	crcPoly16       = uint16(0x1021)
 	crcInitVal16    = uint16(0xFFFF)
 )
 
+var txModeValueMap = map[TXMode]C.uint8_t{
+	TXModeTimestamped: C.TIMESTAMPED,
+	TXModeImmediate:   C.IMMEDIATE,
+	TXModeOnGPS:       C.ON_GPS,
+}
+
 var coderateValueMap = map[string]C.uint8_t{
 	"4/5": C.CR_LORA_4_5,
 	"4/6": C.CR_LORA_4_6,
@@ -108,8 +115,9 @@ func setupFSKDownlink(txPacket *C.struct_lgw_pkt_tx_s, downlink router.DownlinkM
 }
 
 func checkRFPower(cconf util.SX1301Conf, downlink router.DownlinkMessage) error {
+	rfPower := cconf.RFPower(downlink.GetGatewayConfiguration().GetPower())
 	for _, val := range cconf.GetTXLuts() {
-		if val.RfPower == int8(downlink.GetGatewayConfiguration().GetPower()) {
+		if int32(val.RfPower) == rfPower {
 			return nil
 		}
 	}
@@ -138,14 +146,21 @@ func insertPayload(downlink router.DownlinkMessage, txPacket *C.struct_lgw_pkt_t
 	return nil
 }
 
-func SendDownlink(downlink *router.DownlinkMessage, conf util.Config, ctx log.Interface) error {
+// SendDownlink transmits a downlink with the concentrator. The timestamp of the downlink is a value
+// of the counter of the concentrator.
+func SendDownlink(downlink *router.DownlinkMessage, mode TXMode, conf util.Config, ctx log.Interface) error {
+	txMode, ok := txModeValueMap[mode]
+	if !ok {
+		return errors.New("TX packet with unknown transmission mode")
+	}
+
 	var txPacket = C.struct_lgw_pkt_tx_s{
 		freq_hz:   C.uint32_t(downlink.GetGatewayConfiguration().GetFrequency()),
 		rf_chain:  C.uint8_t(downlink.GetGatewayConfiguration().GetRfChain()),
 		no_crc:    C.bool(false),
 		no_header: C.bool(false),
 		payload:   [256]C.uint8_t{},
-		tx_mode:   C.TIMESTAMPED,
+		tx_mode:   txMode,
 		count_us:  C.uint32_t(downlink.GetGatewayConfiguration().GetTimestamp()),
 	}
 
@@ -156,11 +171,7 @@ func SendDownlink(downlink *router.DownlinkMessage, conf util.Config, ctx log.In
 	}
 
 	// Antenna gain
-	if antennaGain := conf.Concentrator.AntennaGain; antennaGain != nil {
-		txPacket.rf_power = C.int8_t(downlink.GetGatewayConfiguration().GetPower() - int32(*antennaGain))
-	} else {
-		txPacket.rf_power = C.int8_t(downlink.GetGatewayConfiguration().GetPower())
-	}
+	txPacket.rf_power = C.int8_t(conf.Concentrator.RFPower(downlink.GetGatewayConfiguration().GetPower()))
 
 	// LoRa/FSK parameters
 	if err := setupDownlinkModulation(*downlink, &txPacket); err != nil {
@@ -177,6 +188,45 @@ func SendDownlink(downlink *router.DownlinkMessage, conf util.Config, ctx log.In
 	return sendDownlinkConcentrator(txPacket, ctx)
 }
 
+// SendBeacon transmits a beacon on the next PPS pulse of the GPS
+func SendBeacon(beacon BeaconPacket, conf util.Config, ctx log.Interface) error {
+	datarate, err := sfValue(beacon.SpreadingFactor)
+	if err != nil {
+		return err
+	}
+	bandwidth, err := bandwidthValue(beacon.Bandwidth)
+	if err != nil {
+		return err
+	}
+	if len(beacon.Payload) > 256 {
+		return errors.New("Beacon too big to transmit")
+	}
+
+	// Beacons have their own CRCs, and a fixed size that doesn't require a header
+	var txPacket = C.struct_lgw_pkt_tx_s{
+		freq_hz:    C.uint32_t(beacon.Frequency),
+		tx_mode:    C.ON_GPS,
+		rf_chain:   C.uint8_t(beacon.RFChain),
+		modulation: C.MOD_LORA,
+		datarate:   datarate,
+		bandwidth:  bandwidth,
+		coderate:   C.CR_LORA_4_5,
+		invert_pol: C.bool(false),
+		preamble:   C.uint16_t(beaconPreamble),
+		no_crc:     C.bool(true),
+		no_header:  C.bool(true),
+		size:       C.uint16_t(len(beacon.Payload)),
+	}
+	for i := 0; i < len(beacon.Payload); i++ {
+		txPacket.payload[i] = C.uint8_t(beacon.Payload[i])
+	}
+
+	// Antenna gain
+	txPacket.rf_power = C.int8_t(conf.Concentrator.RFPower(int32(beacon.Power)))
+
+	return sendDownlinkConcentrator(txPacket, ctx)
+}
+
 func sendDownlinkConcentrator(txPacket C.struct_lgw_pkt_tx_s, ctx log.Interface) error {
 	for {
 		var txStatus C.uint8_t
@@ -201,6 +251,10 @@ func sendDownlinkConcentrator(txPacket C.struct_lgw_pkt_tx_s, ctx log.Interface)
 	result := C.lgw_send(txPacket)
 	concentratorMutex.Unlock()
 
+	if result == C.LGW_LBT_ISSUE {
+		ctx.WithField("Frequency", uint32(txPacket.freq_hz)).Warn("Channel busy, downlink not transmitted")
+		return ErrChannelBusy
+	}
 	if result == C.LGW_HAL_ERROR {
 		ctx.Warn("Downlink transmission to the concentrator failed")
 		return errors.New("Downlink transmission to the concentrator failed")
@@ -2,16 +2,58 @@
 
 package wrapper
 
-import "github.com/TheThingsNetwork/go-utils/log"
+import (
+	"io"
+	"os"
+	"time"
 
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/pkg/errors"
+)
+
+var gps *os.File
+
+// LoRaGPSEnable opens the GPS path without configuring it, which allows replaying recorded GPS logs
 func LoRaGPSEnable(TTYPath string) error {
-	return nil
+	var err error
+	gps, err = os.Open(TTYPath)
+	return err
+}
+
+func GPSInterface() (io.Reader, error) {
+	if gps == nil {
+		return nil, errors.New("GPS interface not enabled")
+	}
+	return gps, nil
 }
 
+func EnableExternalGPS() {}
+
 func GetGPSCoordinates() (GPSCoordinates, error) {
 	return GPSCoordinates{}, nil
 }
 
-func UpdateGPSData(ctx log.Interface) error {
+func SetGPSCoordinates(c GPSCoordinates) {}
+
+func SyncGPSTime(ctx log.Interface, utc time.Time) error {
 	return nil
 }
+
+func ResetGPSTimeReference() {}
+
+func GetGPSTimeSync() GPSTimeSync {
+	return GPSTimeSync{State: TimeSyncUnavailable}
+}
+
+func GPSTimeToTimestamp(utc time.Time) (uint32, error) {
+	return 0, errors.New("No valid GPS time reference")
+}
+
+func TimestampToGPSTime(timestamp uint32) (time.Time, error) {
+	return time.Time{}, errors.New("No valid GPS time reference")
+}
+
+// GetTriggerCounter returns the counter latched on the PPS pulse, which never advances without GPS
+func GetTriggerCounter() (uint32, error) {
+	return 0, nil
+}
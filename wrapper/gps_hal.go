@@ -0,0 +1,303 @@
+// +build halv1 halv2
+
+package wrapper
+
+// The GPS functions of libloragw v1 and of the SX1302 HAL are the same, except lgw_gps_sync that is
+// wrapped by gpsSync in each HAL.
+
+// #cgo halv1 CFLAGS: -I${SRCDIR}/../lora_gateway/libloragw/inc
+// #cgo halv1 LDFLAGS: -lm ${SRCDIR}/../lora_gateway/libloragw/libloragw.a
+// #cgo halv2 CFLAGS: -I${SRCDIR}/../sx1302_hal/libloragw/inc
+// #cgo halv2 LDFLAGS: ${SRCDIR}/../sx1302_hal/libloragw/libloragw.a -lm -lpthread -lrt
+// #include "loragw_hal.h"
+// #include "loragw_gps.h"
+// struct timespec makeTimespec(time_t sec, long nsec) {
+// 	struct timespec ts = {sec, nsec};
+// 	return ts;
+// }
+import "C"
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/ttn/api/gateway"
+	"github.com/pkg/errors"
+)
+
+var gps *os.File
+
+// externalGPS is set when GPS data is fed by a source outside of the HAL, such as gpsd
+var externalGPS bool
+
+var gpsTimeReference = C.struct_tref{}
+var gpsTimeReferenceMutex = &sync.Mutex{}
+
+// gpsLastSync and gpsSyncFailures are protected by gpsTimeReferenceMutex
+var gpsLastSync time.Time
+var gpsSyncFailures int
+
+var validCoordinates bool
+var coordinates GPSCoordinates
+var coordinatesMutex = &sync.Mutex{}
+
+var gpsMaxAge = time.Second * 30
+
+// gpsLockMaxAge is the age after which the time reference is considered drifting - the GPS sends
+// its time every second, so a few PPS pulses have been missed
+var gpsLockMaxAge = time.Second * 5
+
+func GetGPSCoordinates() (GPSCoordinates, error) {
+	coordinatesMutex.Lock()
+	defer coordinatesMutex.Unlock()
+	tmpCoordinates := coordinates
+
+	if !validCoordinates {
+		return tmpCoordinates, errors.New("No valid coordinates obtained from GPS yet")
+	}
+
+	if !gpsActive() {
+		return tmpCoordinates, errors.New("GPS not active")
+	}
+
+	return tmpCoordinates, nil
+}
+
+// timeReference returns the GPS time reference in a time.Time format
+func timeReference() time.Time {
+	gpsTimeReferenceMutex.Lock()
+	currentTimeReference := gpsTimeReference
+	gpsTimeReferenceMutex.Unlock()
+	return time.Unix(int64(currentTimeReference.systime), 0)
+}
+
+// LoRaGPSEnable acts as a wrapper for lgw_gps_enable
+func LoRaGPSEnable(TTYPath string) error {
+	fd := C.int(0)
+
+	// HAL only supports u-blox7 for now, so gps_family must be "ubx7"
+	ok := (C.lgw_gps_enable(C.CString(TTYPath), C.CString("ubx7"), C.speed_t(0), &fd) == C.LGW_GPS_SUCCESS)
+	if !ok {
+		return errors.New("Failed GPS configuration - impossible to open port for GPS sync (check permissions?)")
+	}
+
+	gps = os.NewFile(uintptr(fd), "GPS")
+
+	return nil
+}
+
+// GPSInterface returns the interface opened by LoRaGPSEnable, from which the GPS data stream can be read
+func GPSInterface() (io.Reader, error) {
+	if gps == nil {
+		return nil, errors.New("GPS interface not enabled")
+	}
+	return gps, nil
+}
+
+// EnableExternalGPS activates GPS support without opening a TTY through the HAL. Time and
+// coordinates are then fed with SyncGPSTime and SetGPSCoordinates.
+func EnableExternalGPS() {
+	externalGPS = true
+}
+
+func gpsActive() bool {
+	return gps != nil || externalGPS
+}
+
+func checkGPSTimeReference() bool {
+	state := GetGPSTimeSync().State
+	return state == TimeSyncLocked || state == TimeSyncDrifting
+}
+
+// GetGPSTimeSync returns the state of the synchronisation of the concentrator counter with the GPS time
+func GetGPSTimeSync() GPSTimeSync {
+	if !gpsActive() {
+		return GPSTimeSync{State: TimeSyncUnavailable}
+	}
+
+	gpsTimeReferenceMutex.Lock()
+	timeSync := GPSTimeSync{
+		LastSync: gpsLastSync,
+		Failures: gpsSyncFailures,
+		DriftPPM: (float64(gpsTimeReference.xtal_err) - 1) * 1e6,
+	}
+	gpsTimeReferenceMutex.Unlock()
+
+	if timeSync.LastSync.IsZero() {
+		timeSync.State = TimeSyncLost
+		timeSync.DriftPPM = 0
+		return timeSync
+	}
+
+	timeSync.Age = time.Since(timeSync.LastSync)
+	switch {
+	case timeSync.Age > gpsMaxAge:
+		// GPS Time Reference considered obsolete
+		timeSync.State = TimeSyncLost
+	case timeSync.Age > gpsLockMaxAge:
+		timeSync.State = TimeSyncDrifting
+	default:
+		timeSync.State = TimeSyncLocked
+	}
+	return timeSync
+}
+
+// ResetGPSTimeReference drops the GPS time reference after the concentrator counter restarted. It
+// is built again on the next synchronisations.
+func ResetGPSTimeReference() {
+	gpsTimeReferenceMutex.Lock()
+	gpsTimeReference = C.struct_tref{}
+	gpsLastSync = time.Time{}
+	gpsSyncFailures = 0
+	gpsTimeReferenceMutex.Unlock()
+}
+
+// SyncGPSTime synchronises the GPS time reference with the UTC time of the last PPS pulse
+func SyncGPSTime(ctx log.Interface, utc time.Time) error {
+	utcTime := C.makeTimespec(C.time_t(utc.Unix()), C.long(utc.Nanosecond()))
+	if !syncTimeReference(ctx, utcTime) {
+		return errors.New("GPS time synchronisation failed")
+	}
+	return nil
+}
+
+// GPSTimeToTimestamp returns the value of the concentrator counter at a UTC time, using the GPS
+// time reference.
+func GPSTimeToTimestamp(utc time.Time) (uint32, error) {
+	if !checkGPSTimeReference() {
+		return 0, errors.New("No valid GPS time reference")
+	}
+
+	gpsTimeReferenceMutex.Lock()
+	currentTimeReference := gpsTimeReference
+	gpsTimeReferenceMutex.Unlock()
+
+	var count C.uint32_t
+	utcTime := C.makeTimespec(C.time_t(utc.Unix()), C.long(utc.Nanosecond()))
+	if C.lgw_utc2cnt(currentTimeReference, utcTime, &count) != C.LGW_GPS_SUCCESS {
+		return 0, errors.New("Failed conversion of the UTC time to a concentrator timestamp")
+	}
+	return uint32(count), nil
+}
+
+// TimestampToGPSTime returns the UTC time at which the concentrator counter reaches a value, using
+// the GPS time reference.
+func TimestampToGPSTime(timestamp uint32) (time.Time, error) {
+	if !checkGPSTimeReference() {
+		return time.Time{}, errors.New("No valid GPS time reference")
+	}
+
+	gpsTimeReferenceMutex.Lock()
+	currentTimeReference := gpsTimeReference
+	gpsTimeReferenceMutex.Unlock()
+
+	var utcTime C.struct_timespec
+	if C.lgw_cnt2utc(currentTimeReference, C.uint32_t(timestamp), &utcTime) != C.LGW_GPS_SUCCESS {
+		return time.Time{}, errors.New("Failed conversion of the concentrator timestamp to a UTC time")
+	}
+	return time.Unix(int64(utcTime.tv_sec), int64(utcTime.tv_nsec)), nil
+}
+
+// GetTriggerCounter returns the value of the concentrator counter latched on the last
+// PPS pulse. The value doesn't change without GPS.
+func GetTriggerCounter() (uint32, error) {
+	var count C.uint32_t
+	concentratorMutex.Lock()
+	ok := C.lgw_get_trigcnt(&count) == C.LGW_GPS_SUCCESS
+	concentratorMutex.Unlock()
+	if !ok {
+		return 0, errors.New("Failed to read the concentrator trigger counter")
+	}
+	return uint32(count), nil
+}
+
+// syncTimeReference updates the GPS time reference, by associating the concentrator counter value
+// at the last PPS pulse to the UTC time of that pulse
+func syncTimeReference(ctx log.Interface, utcTime C.struct_timespec) bool {
+	var ts C.uint32_t
+
+	ctx.Debug("Fetching GPS timestamp")
+	concentratorMutex.Lock()
+	ok := C.lgw_get_trigcnt(&ts) == C.LGW_GPS_SUCCESS
+	concentratorMutex.Unlock()
+
+	if !ok {
+		ctx.Warn("Failed to read concentrator timestamp")
+		return false
+	}
+
+	ctx.Debug("Fetching GPS time reference")
+	gpsTimeReferenceMutex.Lock()
+	ok = gpsSync(&gpsTimeReference, ts, utcTime)
+	if ok {
+		gpsLastSync = time.Now()
+		gpsSyncFailures = 0
+	} else {
+		gpsSyncFailures++
+	}
+	gpsTimeReferenceMutex.Unlock()
+
+	if !ok {
+		ctx.Warn("GPS out of sync, keeping previous time reference")
+		return false
+	}
+	ctx.WithField("GPSDateComputation", timeReference()).Debug("Date sync with GPS complete")
+	return true
+}
+
+// gpsReference is used to pass the GPS reference when building packets
+type gpsReference struct {
+	valid              bool
+	validTimeReference bool
+	timeReference      C.struct_tref
+	locationReference  GPSCoordinates
+}
+
+// currentGPSReference returns the GPS reference used to build a batch of packets. Using one
+// reference per batch avoids having one mutex lock per packet.
+func currentGPSReference() gpsReference {
+	var reference gpsReference
+	if !gpsActive() {
+		return reference
+	}
+	reference.valid = true
+	reference.validTimeReference = checkGPSTimeReference()
+	gpsTimeReferenceMutex.Lock()
+	reference.timeReference = gpsTimeReference
+	gpsTimeReferenceMutex.Unlock()
+	coordinatesMutex.Lock()
+	reference.locationReference = coordinates
+	coordinatesMutex.Unlock()
+	return reference
+}
+
+// setGPSMetadata sets the GPS metadata of a packet, and its reception time if the GPS time
+// reference is valid
+func (r gpsReference) setGPSMetadata(p *Packet) {
+	if !r.valid {
+		return
+	}
+	p.Gps = &gateway.GPSMetadata{
+		Latitude:  float32(r.locationReference.Latitude),
+		Longitude: float32(r.locationReference.Longitude),
+		Altitude:  int32(r.locationReference.Altitude),
+	}
+
+	var pktUtcTime C.struct_timespec
+	if r.validTimeReference && C.lgw_cnt2utc(r.timeReference, C.uint32_t(p.CountUS), &pktUtcTime) == C.LGW_GPS_SUCCESS {
+		// conversion successful
+		p.Time = time.Unix(int64(pktUtcTime.tv_sec), int64(pktUtcTime.tv_nsec)).UnixNano()
+		p.TimeSource = TimeSourceGPS
+		p.Gps.Time = p.Time
+	}
+}
+
+// SetGPSCoordinates updates the coordinates returned by GetGPSCoordinates and attached to uplinks
+func SetGPSCoordinates(c GPSCoordinates) {
+	coordinatesMutex.Lock()
+	coordinates = c
+	validCoordinates = true
+	coordinatesMutex.Unlock()
+}
@@ -0,0 +1,22 @@
+// +build dummy
+
+package wrapper
+
+import (
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+)
+
+// dummyNoiseBin is the histogram bin in which the dummy HAL puts all the RSSI samples
+const dummyNoiseBin = 240
+
+func SpectralScan(ctx log.Interface, conf util.Config, frequencies []uint32, samples uint16) ([]RSSIHistogram, error) {
+	histograms := make([]RSSIHistogram, 0, len(frequencies))
+	for _, frequency := range frequencies {
+		histogram := RSSIHistogram{Frequency: frequency}
+		histogram.Counts[dummyNoiseBin] = samples
+		histograms = append(histograms, histogram)
+	}
+	ctx.Info("Dummy HAL - Spectral scan done")
+	return histograms, nil
+}
@@ -0,0 +1,164 @@
+// +build halv1
+
+package wrapper
+
+// #cgo CFLAGS: -I${SRCDIR}/../lora_gateway/libloragw/inc
+// #cgo LDFLAGS: -lm ${SRCDIR}/../lora_gateway/libloragw/libloragw.a
+// #include "config.h"
+// #include "loragw_hal.h"
+// #include "loragw_reg.h"
+// #include "loragw_fpga.h"
+// #include "loragw_radio.h"
+import "C"
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+)
+
+const (
+	// fpgaFeatureSpectralScan is the bit of the FPGA feature register set when the FPGA supports spectral scans
+	fpgaFeatureSpectralScan = 1 << 1
+	// fpgaStatusHistogramReady is the bit of the FPGA status register set when a histogram acquisition is done
+	fpgaStatusHistogramReady = 1 << 5
+
+	spectralScanPollingRate = 100 * time.Millisecond
+	spectralScanTimeout     = 30 * time.Second
+)
+
+func fpgaWrite(register C.uint16_t, value int32) error {
+	if C.lgw_fpga_reg_w(register, C.int32_t(value)) != C.LGW_REG_SUCCESS {
+		return fmt.Errorf("Failed to write FPGA register %d", register)
+	}
+	return nil
+}
+
+func fpgaRead(register C.uint16_t) (int32, error) {
+	var value C.int32_t
+	if C.lgw_fpga_reg_r(register, &value) != C.LGW_REG_SUCCESS {
+		return 0, fmt.Errorf("Failed to read FPGA register %d", register)
+	}
+	return int32(value), nil
+}
+
+func radioType(radio util.RadioConf) (C.uint8_t, error) {
+	switch radio.RadioType {
+	case "SX1257":
+		return C.LGW_RADIO_TYPE_SX1257, nil
+	case "SX1255":
+		return C.LGW_RADIO_TYPE_SX1255, nil
+	}
+	return 0, errors.New("Invalid radio type (should be SX1255 or SX1257)")
+}
+
+// SpectralScan measures the RSSI at each frequency with the first radio of the concentrator, and
+// returns the histogram of the RSSI samples of each frequency. It requires an FPGA supporting
+// spectral scans, and can't be used while the concentrator is started.
+func SpectralScan(ctx log.Interface, conf util.Config, frequencies []uint32, samples uint16) ([]RSSIHistogram, error) {
+	radios := conf.Concentrator.GetRadios()
+	if len(radios) == 0 {
+		return nil, errors.New("No radio configured")
+	}
+	rfType, err := radioType(radios[0])
+	if err != nil {
+		return nil, err
+	}
+
+	concentratorMutex.Lock()
+	defer concentratorMutex.Unlock()
+
+	if C.lgw_connect(false, C.LGW_DEFAULT_NOTCH_FREQ) != C.LGW_REG_SUCCESS {
+		return nil, errors.New("Failed to connect to the concentrator")
+	}
+	defer C.lgw_disconnect()
+
+	features, err := fpgaRead(C.LGW_FPGA_FEATURE)
+	if err != nil {
+		return nil, err
+	}
+	if features&fpgaFeatureSpectralScan == 0 {
+		return nil, fmt.Errorf("Spectral scan not supported by the concentrator FPGA (features: 0x%x)", features)
+	}
+
+	if err := fpgaWrite(C.LGW_FPGA_CTRL_FEATURE_START, 0); err != nil {
+		return nil, err
+	}
+	if err := fpgaWrite(C.LGW_FPGA_HISTO_NB_READ, int32(samples)); err != nil {
+		return nil, err
+	}
+
+	// Enabling and resetting the radios
+	C.lgw_reg_w(C.LGW_RADIO_A_EN, 1)
+	C.lgw_reg_w(C.LGW_RADIO_B_EN, 1)
+	time.Sleep(500 * time.Millisecond)
+	C.lgw_reg_w(C.LGW_RADIO_RST, 1)
+	time.Sleep(5 * time.Millisecond)
+	C.lgw_reg_w(C.LGW_RADIO_RST, 0)
+
+	histograms := make([]RSSIHistogram, 0, len(frequencies))
+	for _, frequency := range frequencies {
+		histogram, err := scanFrequency(uint8(conf.Concentrator.Clksrc), rfType, frequency)
+		if err != nil {
+			return nil, err
+		}
+		ctx.WithField("Frequency", frequency).Debug("Frequency scanned")
+		histograms = append(histograms, histogram)
+	}
+	return histograms, nil
+}
+
+// scanFrequency tunes the first radio on the frequency, and reads the RSSI histogram measured by the FPGA
+func scanFrequency(clksrc uint8, rfType C.uint8_t, frequency uint32) (RSSIHistogram, error) {
+	histogram := RSSIHistogram{Frequency: frequency}
+	if C.lgw_setup_sx125x(0, C.uint8_t(clksrc), true, rfType, C.uint32_t(frequency)) != C.LGW_REG_SUCCESS {
+		return histogram, fmt.Errorf("Failed to tune the radio on %d Hz", frequency)
+	}
+
+	if err := fpgaWrite(C.LGW_FPGA_CTRL_CLEAR_HISTO_MEM, 1); err != nil {
+		return histogram, err
+	}
+	if err := fpgaWrite(C.LGW_FPGA_CTRL_CLEAR_HISTO_MEM, 0); err != nil {
+		return histogram, err
+	}
+	if err := fpgaWrite(C.LGW_FPGA_CTRL_ACCESS_HISTO_MEM, 0); err != nil {
+		return histogram, err
+	}
+	if err := fpgaWrite(C.LGW_FPGA_CTRL_FEATURE_START, 1); err != nil {
+		return histogram, err
+	}
+	defer fpgaWrite(C.LGW_FPGA_CTRL_FEATURE_START, 0)
+
+	deadline := time.Now().Add(spectralScanTimeout)
+	for {
+		status, err := fpgaRead(C.LGW_FPGA_STATUS)
+		if err != nil {
+			return histogram, err
+		}
+		if status&fpgaStatusHistogramReady != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return histogram, fmt.Errorf("Spectral scan of %d Hz timed out", frequency)
+		}
+		time.Sleep(spectralScanPollingRate)
+	}
+
+	if err := fpgaWrite(C.LGW_FPGA_CTRL_ACCESS_HISTO_MEM, 1); err != nil {
+		return histogram, err
+	}
+	if err := fpgaWrite(C.LGW_FPGA_HISTO_RAM_ADDR, 0); err != nil {
+		return histogram, err
+	}
+	var data [RSSIHistogramSize * 2]byte
+	if C.lgw_fpga_reg_rb(C.LGW_FPGA_HISTO_RAM_DATA, (*C.uint8_t)(unsafe.Pointer(&data[0])), C.uint16_t(len(data))) != C.LGW_REG_SUCCESS {
+		return histogram, errors.New("Failed to read the RSSI histogram")
+	}
+	for i := range histogram.Counts {
+		histogram.Counts[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+	}
+	return histogram, nil
+}
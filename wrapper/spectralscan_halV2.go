@@ -0,0 +1,17 @@
+// +build halv2
+
+package wrapper
+
+import (
+	"errors"
+
+	"github.com/TheThingsNetwork/go-utils/log"
+	"github.com/TheThingsNetwork/packet_forwarder/util"
+)
+
+// SpectralScan isn't supported on SX1302 concentrators: their spectral scan (lgw_spectral_scan_start)
+// runs on the additional SX1261 radio, which this backend doesn't configure, and only while the
+// concentrator is started - while spectral-scan requires the packet forwarder to be stopped
+func SpectralScan(ctx log.Interface, conf util.Config, frequencies []uint32, samples uint16) ([]RSSIHistogram, error) {
+	return nil, errors.New("Spectral scan is not supported on SX1302 concentrators")
+}